@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/privacybydesign/irmago/irmaclient"
+)
+
+// The outcome of an input line of -batch that is not a session pointer
+const outcomeInvalid outcomeKind = "invalid"
+
+// batchResult is the line written to -batch-out for a line of the -batch input.
+type batchResult struct {
+	Line       int               `json:"line"`
+	Outcome    outcomeKind       `json:"outcome"`
+	DurationMS int64             `json:"duration_ms"`
+	Error      string            `json:"error,omitempty"`
+	Disclosed  map[string]string `json:"disclosed,omitempty"`
+}
+
+// batchSummary is the last line written to -batch-out.
+type batchSummary struct {
+	Summary     bool `json:"summary"`
+	Lines       int  `json:"lines"`
+	Successes   int  `json:"successes"`
+	Failures    int  `json:"failures"`
+	Invalid     int  `json:"invalid"`
+	Interrupted bool `json:"interrupted"`
+}
+
+// batchPointer returns the session pointer on the input line, which is either a session
+// pointer or session request as JSON object, or a JSON string containing one or a link.
+func batchPointer(line string) (string, error) {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, `"`) {
+		var pointer string
+		if err := json.Unmarshal([]byte(line), &pointer); err != nil {
+			return "", err
+		}
+		line = pointer
+	}
+	return resolveSessionPointer(line)
+}
+
+// runBatch performs a session for every line of the -batch input, -parallel at a time,
+// accepting every permission request, and writes the result of each line to -batch-out as
+// JSON, followed by a summary. Invalid lines are reported in the output without stopping the
+// batch. It returns exitSuccess if every session succeeded.
+func runBatch(client *irmaclient.Client, commands *dispatcher, pins *pinSupplier, interrupted <-chan struct{}) int {
+	in, err := os.Open(*batchFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open batch input: %v\n", err)
+		return exitStartup
+	}
+	defer in.Close()
+	out, err := os.Create(*batchOut)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create batch output: %v\n", err)
+		return exitStartup
+	}
+	defer out.Close()
+
+	// The summary counts the lines whose result has been written, so that a line interrupted
+	// before its session started is left out
+	var (
+		wg       sync.WaitGroup
+		mutex    sync.Mutex // guards summary, writeErr and the encoder
+		encoder  = json.NewEncoder(out)
+		summary  = batchSummary{Summary: true}
+		running  = make(chan struct{}, *parallel)
+		writeErr error
+	)
+	write := func(result batchResult) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		summary.Lines++
+		switch result.Outcome {
+		case outcomeSuccess:
+			summary.Successes++
+		case outcomeInvalid:
+			summary.Invalid++
+		default:
+			summary.Failures++
+		}
+		if err := encoder.Encode(result); err != nil && writeErr == nil {
+			writeErr = err
+		}
+	}
+
+	scanner := bufio.NewScanner(in)
+	// Session requests can be long
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	number := 0
+loop:
+	for scanner.Scan() {
+		number++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		pointer, err := batchPointer(scanner.Text())
+		if err != nil {
+			write(batchResult{Line: number, Outcome: outcomeInvalid, Error: err.Error()})
+			continue
+		}
+
+		select {
+		case running <- struct{}{}:
+		case <-interrupted:
+			break loop
+		}
+		wg.Add(1)
+		go func(line int, pointer string) {
+			defer wg.Done()
+			defer func() { <-running }()
+			// Sessions are only numbered when running in parallel, as with -parallel
+			id := 0
+			if *parallel > 1 {
+				id = line
+			}
+			start := time.Now()
+			result, _ := handleSession(client, commands, id, command{line: pointer}, pins, interrupted)
+			countOutcome(result)
+			batch := batchResult{
+				Line:       line,
+				Outcome:    result.kind,
+				DurationMS: time.Since(start).Milliseconds(),
+				Disclosed:  result.disclosed,
+			}
+			if result.err != nil {
+				batch.Error = result.err.Error()
+			}
+			write(batch)
+		}(number, pointer)
+	}
+	wg.Wait()
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read batch input: %v\n", err)
+		return exitFailure
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	select {
+	case <-interrupted:
+		summary.Interrupted = true
+	default:
+	}
+	if err := encoder.Encode(summary); err != nil && writeErr == nil {
+		writeErr = err
+	}
+	if writeErr != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write batch output: %v\n", writeErr)
+		return exitFailure
+	}
+	emit("batch-done", "lines", summary.Lines, "successes", summary.Successes, "failures", summary.Failures,
+		"invalid", summary.Invalid, "interrupted", summary.Interrupted)
+	if summary.Successes != summary.Lines {
+		return exitFailure
+	}
+	return exitSuccess
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// runTestBatch runs the emulator on a batch of the given lines, returning the lines it wrote
+// to -batch-out and its exit code.
+func runTestBatch(t *testing.T, lines string, args ...string) ([]map[string]interface{}, int) {
+	t.Helper()
+	dir := t.TempDir()
+	in, out := filepath.Join(dir, "batch.jsonl"), filepath.Join(dir, "results.jsonl")
+	if err := ioutil.WriteFile(in, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr, code := runEmulator(t, "", true, emulatorArgs(t, append([]string{"-batch", in, "-batch-out", out}, args...)...)...)
+	f, err := os.Open(out)
+	if err != nil {
+		t.Fatalf("%v\n%s%s", err, stdout, stderr)
+	}
+	defer f.Close()
+	results := []map[string]interface{}{}
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		result := map[string]interface{}{}
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			t.Fatalf("wrote %q: %v", scanner.Text(), err)
+		}
+		results = append(results, result)
+	}
+	return results, code
+}
+
+func TestBatch(t *testing.T) {
+	results, code := runTestBatch(t, studentIDRequest+"\n\n"+studentIDRequest+"\n")
+	if code != exitSuccess || len(results) != 3 {
+		t.Fatalf("exit code %d, results %v", code, results)
+	}
+	for i, line := range []float64{1, 3} {
+		if results[i]["line"] != line || results[i]["outcome"] != string(outcomeSuccess) {
+			t.Errorf("result %v for line %.0f", results[i], line)
+		}
+	}
+	summary := results[2]
+	if summary["summary"] != true || summary["lines"] != 2.0 || summary["successes"] != 2.0 ||
+		summary["failures"] != 0.0 || summary["invalid"] != 0.0 || summary["interrupted"] != false {
+		t.Errorf("summary %v", summary)
+	}
+}
+
+func TestBatchInvalidLines(t *testing.T) {
+	// Invalid lines are reported without stopping the batch, but fail it
+	results, code := runTestBatch(t, "no pointer\n"+studentIDRequest+"\n\"unterminated\n", "-parallel", "2")
+	if code != exitFailure || len(results) != 4 {
+		t.Fatalf("exit code %d, results %v", code, results)
+	}
+	outcomes := map[float64]interface{}{}
+	for _, result := range results[:3] {
+		outcomes[result["line"].(float64)] = result["outcome"]
+		if result["outcome"] == string(outcomeInvalid) && result["error"] == nil {
+			t.Errorf("no error for invalid line %v", result)
+		}
+	}
+	if outcomes[1] != string(outcomeInvalid) || outcomes[2] != string(outcomeSuccess) || outcomes[3] != string(outcomeInvalid) {
+		t.Errorf("outcomes by line %v", outcomes)
+	}
+	summary := results[3]
+	if summary["lines"] != 3.0 || summary["successes"] != 1.0 || summary["invalid"] != 2.0 || summary["failures"] != 0.0 {
+		t.Errorf("summary %v", summary)
+	}
+}
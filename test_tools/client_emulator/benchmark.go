@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+)
+
+// benchmarkStartup times opening the client the given number of times, emitting the
+// duration of every run. When copySchemes is set, the copy of the schemes that the client
+// keeps in its storage is removed before every run, so that every run also times copying the
+// schemes from the configuration into the storage. This does not make the filesystem cache
+// cold; the schemes just read are still cached.
+func benchmarkStartup(runs int, copySchemes bool) int {
+	for run := 1; run <= runs; run++ {
+		if copySchemes {
+			if err := os.RemoveAll(filepath.Join(*storagePath, "irma_configuration")); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to remove the schemes from the storage: %v\n", err)
+				return exitStartup
+			}
+		}
+
+		start := time.Now()
+		client, err := irmaclient.New(*storagePath, *configPath, &ClientHandler{})
+		duration := time.Since(start)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to start client: %v\n", err)
+			return exitStartup
+		}
+		client.Close()
+
+		emit("startup", "run", run, "copy_schemes", copySchemes, "duration", duration)
+	}
+	return exitSuccess
+}
+
+// benchmarkProof handles "benchmark-proof <request> <iterations>", building the disclosure
+// proof for the disclosure request locally the given number of times, without contacting
+// any server, and emitting timing statistics. The first candidate of every disjunction is
+// disclosed. Signature requests are refused, as their proofs require a timestamp from the
+// timestamp server, and so are requests involving a keyshare server.
+func benchmarkProof(client *irmaclient.Client, args string) {
+	i := strings.LastIndexAny(args, " \t")
+	if i < 0 {
+		emit("benchmark-proof-failed", "error", "expected benchmark-proof <request> <iterations>")
+		return
+	}
+	iterations, err := strconv.Atoi(args[i+1:])
+	if err != nil || iterations <= 0 {
+		emit("benchmark-proof-failed", "error", fmt.Sprintf("invalid number of iterations %q", args[i+1:]))
+		return
+	}
+	request, err := parseSessionRequest(strings.TrimSpace(args[:i]))
+	if err != nil {
+		emit("benchmark-proof-failed", "error", err)
+		return
+	}
+	if request.Action() != irma.ActionDisclosing {
+		emit("benchmark-proof-failed", "error", "only disclosure requests can be benchmarked")
+		return
+	}
+	if managers := keyshareManagers(client.Configuration, request); len(managers) > 0 {
+		emit("benchmark-proof-failed", "error", fmt.Sprintf("proofs for %s require its keyshare server", identifiers(managers)))
+		return
+	}
+	candidates, satisfiable, err := client.Candidates(request)
+	if err != nil {
+		emit("benchmark-proof-failed", "error", err)
+		return
+	}
+	if !satisfiable {
+		emit("benchmark-proof-failed", "error", "request cannot be satisfied", "unsatisfiable",
+			joinInts(unsatisfiableDisjunctions(candidates)))
+		return
+	}
+	choice, err := makeFirstDisclosureChoice(candidates)
+	if err != nil {
+		emit("benchmark-proof-failed", "error", err)
+		return
+	}
+
+	durations := make([]time.Duration, 0, iterations)
+	var total time.Duration
+	for run := 0; run < iterations; run++ {
+		start := time.Now()
+		if _, _, err := client.Proofs(choice, request); err != nil {
+			emit("benchmark-proof-failed", "error", err, "iteration", run+1)
+			return
+		}
+		duration := time.Since(start)
+		durations = append(durations, duration)
+		total += duration
+	}
+
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	emit("benchmark-proof",
+		"iterations", iterations,
+		"mean", total/time.Duration(iterations),
+		"median", durations[iterations/2],
+		"p95", durations[(iterations*95-1)/100],
+		"min", durations[0],
+		"max", durations[iterations-1],
+	)
+}
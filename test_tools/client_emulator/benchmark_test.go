@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBenchmarkStartup(t *testing.T) {
+	log := captureEvents(t)
+	storage := testStorage(t)
+	setFlag(t, "storage", storage)
+	setFlag(t, "config", testConfiguration(t))
+
+	if code := benchmarkStartup(2, true); code != exitSuccess {
+		t.Fatalf("exit code %d\n%s", code, log)
+	}
+	runs := log.named("startup")
+	if len(runs) != 2 {
+		t.Fatalf("startup events %v", runs)
+	}
+	for i, run := range runs {
+		if run["run"] != float64(i+1) || run["copy_schemes"] != true || run["duration"] == "" {
+			t.Errorf("startup event %v", run)
+		}
+	}
+	// The client copied the schemes back into the storage they were removed from
+	if _, err := os.Stat(filepath.Join(storage, "irma_configuration", "irma-demo")); err != nil {
+		t.Errorf("schemes not copied into the storage: %v", err)
+	}
+
+	setFlag(t, "storage", filepath.Join(storage, "nonexistent"))
+	if code := benchmarkStartup(1, false); code != exitStartup {
+		t.Errorf("exit code %d with a missing storage", code)
+	}
+}
+
+func TestBenchmarkProof(t *testing.T) {
+	log := captureEvents(t)
+	client, _ := newTestClient(t)
+
+	benchmarkProof(client, studentIDRequest+" 5")
+	results := log.named("benchmark-proof")
+	if len(results) != 1 || results[0]["iterations"] != 5.0 || len(log.named("benchmark-proof-failed")) != 0 {
+		t.Fatalf("benchmarking a disclosure proof emitted\n%s", log)
+	}
+	for _, field := range []string{"mean", "median", "p95", "min", "max"} {
+		if _, ok := results[0][field].(string); !ok {
+			t.Errorf("no %s in %v", field, results[0])
+		}
+	}
+
+	failures := map[string]string{
+		studentIDRequest:        "expected benchmark-proof <request> <iterations>",
+		studentIDRequest + " 0": `invalid number of iterations "0"`,
+		`{"@context":"https://irma.app/ld/request/signature/v2","message":"x","disclose":[[["irma-demo.RU.studentCard.studentID"]]]} 1`: "only disclosure requests can be benchmarked",
+		`{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.MijnOverheid.root.BSN"]]]} 1`:                 "request cannot be satisfied",
+	}
+	for args, want := range failures {
+		benchmarkProof(client, args)
+		failed := log.named("benchmark-proof-failed")
+		if len(failed) == 0 || failed[len(failed)-1]["error"] != want {
+			t.Errorf("benchmark-proof %s emitted %v, want error %q", args, failed, want)
+		}
+	}
+}
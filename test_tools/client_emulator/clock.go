@@ -0,0 +1,51 @@
+package main
+
+import (
+	"time"
+
+	"github.com/privacybydesign/irmago/irmaclient"
+)
+
+// now returns the time against which the emulator itself checks credential expiry. With
+// -fake-now or -now it always returns the given time. irmaclient has no such hook, so its
+// own checks, e.g. whether a credential can still be used in its proofs, keep using the
+// real time; only the emulator's classification of candidates follows the fake clock.
+var now = time.Now
+
+// setFakeNow makes now return the given RFC 3339 time.
+func setFakeNow(value string) error {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return err
+	}
+	now = func() time.Time { return t }
+	return nil
+}
+
+// reclassifyExpiry recomputes the Expired flag of the candidates that are present in storage
+// against now, instead of against the real time as irmaclient does. It returns whether the
+// request is satisfiable according to the new classification.
+func reclassifyExpiry(client *irmaclient.Client, candidates [][]irmaclient.DisclosureCandidates) bool {
+	expires := map[string]time.Time{}
+	for _, info := range client.CredentialInfoList() {
+		expires[info.Hash] = time.Time(info.Expires)
+	}
+	for _, discon := range candidates {
+		for _, con := range discon {
+			for _, candidate := range con {
+				if expiry, ok := expires[candidate.CredentialHash]; ok {
+					candidate.Expired = !now().Before(expiry)
+				}
+			}
+		}
+	}
+	return len(unsatisfiableDisjunctions(candidates)) == 0
+}
+
+// applyFakeNow reclassifies the candidates of the request against the -fake-now time.
+func (s *SessionHandler) applyFakeNow(req *permissionRequest) bool {
+	if *fakeNow != "" {
+		req.satisfiable = reclassifyExpiry(s.client, req.candidates)
+	}
+	return true
+}
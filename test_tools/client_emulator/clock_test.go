@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestFakeNow(t *testing.T) {
+	// The test storage's studentCard expires long before then
+	const future = "2100-01-01T00:00:00Z"
+	expired := func(t *testing.T, args ...string) bool {
+		t.Helper()
+		stdout, stderr, _ := runEmulator(t, "expiry\n", true, emulatorArgs(t, args...)...)
+		events := eventsIn(stdout, "expiry")
+		if len(events) != 1 {
+			t.Fatalf("expiry events %v\n%s%s", events, stdout, stderr)
+		}
+		for _, cred := range events[0]["expired"].([]interface{}) {
+			if cred.(map[string]interface{})["type"] == "irma-demo.RU.studentCard" {
+				return true
+			}
+		}
+		return false
+	}
+
+	if expired(t) {
+		t.Error("credentials expired without a fake clock")
+	}
+	if !expired(t, "-fake-now", future) {
+		t.Error("credentials not expired with -fake-now")
+	}
+	if !expired(t, "-fake-now", future, "-no-developer-mode") {
+		t.Error("-fake-now not applied outside developer mode")
+	}
+	if !expired(t, "-now", future) {
+		t.Error("credentials not expired with -now")
+	}
+
+	for _, args := range [][]string{
+		{"-now", future, "-no-developer-mode"},
+		{"-now", future, "-fake-now", "2099-01-01T00:00:00Z"},
+		{"-fake-now", "tomorrow"},
+	} {
+		if _, stderr, code := runEmulator(t, "", true, emulatorArgs(t, args...)...); code != exitStartup {
+			t.Errorf("%v: exit code %d\n%s", args, code, stderr)
+		}
+	}
+}
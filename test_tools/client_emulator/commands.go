@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// command is a single line read from stdin.
+type command struct {
+	line string // the line without its trailing newline
+	name string // the first word of the line
+	args string // the remainder of the line after the first word
+
+	// Only set by JSON commands, see parseJSONCommand
+	session int        // the session the command is meant for, if non-zero
+	choice  [][]string // the attribute types to disclose for each disjunction
+}
+
+func parseCommand(line string) command {
+	line = strings.TrimRight(line, "\r\n")
+	trimmed := strings.TrimSpace(line)
+	name, args := trimmed, ""
+	if i := strings.IndexAny(trimmed, " \t"); i >= 0 {
+		name, args = trimmed[:i], strings.TrimSpace(trimmed[i:])
+	}
+	return command{line: line, name: name, args: args}
+}
+
+// jsonCommand is a command as given with -json-commands. Unknown fields are ignored.
+type jsonCommand struct {
+	Cmd     string          `json:"cmd"`
+	Session int             `json:"session"`
+	Value   string          `json:"value"`
+	Pointer json.RawMessage `json:"pointer"`
+	Choice  [][]string      `json:"choice"`
+}
+
+// parseJSONCommand parses a JSON command such as {"cmd":"pin","value":"12345"} into the
+// command its text form would give. The session pointer of {"cmd":"session"} may be given
+// as a string or as a JSON object.
+func parseJSONCommand(line string) (command, error) {
+	var jc jsonCommand
+	if err := json.Unmarshal([]byte(line), &jc); err != nil {
+		return command{}, err
+	}
+	if jc.Cmd == "" {
+		return command{}, errors.New("missing cmd")
+	}
+
+	args := jc.Value
+	if len(jc.Pointer) > 0 {
+		var pointer string
+		if err := json.Unmarshal(jc.Pointer, &pointer); err != nil {
+			pointer = string(jc.Pointer)
+		}
+		args = pointer
+	}
+	var cmd command
+	if jc.Cmd == "session" {
+		if args == "" {
+			return command{}, errors.New("missing pointer")
+		}
+		cmd = parseCommand(args)
+	} else {
+		cmd = parseCommand(strings.TrimSpace(jc.Cmd + " " + args))
+	}
+	cmd.session, cmd.choice = jc.Session, jc.Choice
+	return cmd, nil
+}
+
+// dispatcher is the single owner of stdin. A dedicated goroutine reads and parses commands,
+// and hands them one by one to whichever part of the emulator is currently waiting for input
+// (e.g. the session pointer or a permission decision). Commands that are typed ahead of time
+// are queued until someone asks for them. Commands that can be answered without any pending
+// decision, such as "status", are handled directly by the reading goroutine.
+type dispatcher struct {
+	commands chan command
+
+	// When set, each line is a JSON command, see parseJSONCommand
+	jsonCommands bool
+
+	mutex     sync.Mutex
+	immediate map[string]func(cmd command)
+	status    func() []interface{}
+	err       error
+
+	// The prompt waited for on each queue, by session identifier (0 for the shared queue)
+	waiting map[int]string
+
+	// When set, commands starting with a session identifier (e.g. "2 cancel") are queued
+	// for that session, see awaitWithin
+	routeSessions bool
+	sessions      map[int]chan command
+	closed        bool
+
+	// The prompts whose wait timed out, by session identifier (0 for the shared queue), until
+	// the next wait on the same queue starts; see awaitWithin
+	timedOut map[int]string
+	// A command taken from a queue when its wait timed out that is not discarded, by session
+	// identifier, to be returned by the next wait on the queue
+	held map[int]command
+}
+
+// The number of commands that can be typed ahead before the reading goroutine stops reading.
+const commandQueueSize = 64
+
+func newDispatcher() *dispatcher {
+	d := &dispatcher{
+		commands:  make(chan command, commandQueueSize),
+		immediate: map[string]func(cmd command){},
+		sessions:  map[int]chan command{},
+		waiting:   map[int]string{},
+		timedOut:  map[int]string{},
+		held:      map[int]command{},
+	}
+	d.handle("status", d.printStatus)
+	return d
+}
+
+// start starts reading commands from input.
+func (d *dispatcher) start(input io.Reader) {
+	go d.read(bufio.NewReader(input))
+}
+
+// handle registers a command that is executed as soon as it is read, instead of being
+// queued for whoever waits for the next command. Commands should be registered before
+// the dispatcher is started.
+func (d *dispatcher) handle(name string, fn func(cmd command)) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.immediate[name] = fn
+}
+
+func (d *dispatcher) read(reader *bufio.Reader) {
+	defer d.close()
+	for number := 1; ; number++ {
+		line, err := reader.ReadString('\n')
+		switch {
+		case d.jsonCommands && strings.TrimSpace(line) != "":
+			cmd, err := parseJSONCommand(line)
+			if err != nil {
+				emit("command-error", "line", number, "error", err)
+				break
+			}
+			d.dispatch(cmd)
+		case !d.jsonCommands && line != "":
+			d.dispatch(parseCommand(line))
+		}
+		if err != nil {
+			if err != io.EOF {
+				d.mutex.Lock()
+				d.err = err
+				d.mutex.Unlock()
+			}
+			return
+		}
+	}
+}
+
+func (d *dispatcher) close() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.closed = true
+	close(d.commands)
+	for _, queue := range d.sessions {
+		close(queue)
+	}
+}
+
+func (d *dispatcher) dispatch(cmd command) {
+	d.mutex.Lock()
+	fn, ok := d.immediate[cmd.name]
+	route := d.routeSessions
+	d.mutex.Unlock()
+	if ok {
+		fn(cmd)
+		return
+	}
+	if route && cmd.session > 0 {
+		if !d.discardLate(cmd.session, cmd) {
+			d.sessionQueue(cmd.session) <- cmd
+		}
+		return
+	}
+	if id, err := strconv.Atoi(cmd.name); route && err == nil && id > 0 {
+		cmd = parseCommand(cmd.args)
+		if !d.discardLate(id, cmd) {
+			d.sessionQueue(id) <- cmd
+		}
+		return
+	}
+	if !d.discardLate(0, cmd) {
+		d.commands <- cmd
+	}
+}
+
+// discardLate discards the command if it is the first decision to arrive for the queue of the
+// session (0 for the shared queue) after a wait on it timed out, as it then answers the prompt
+// that timed out rather than the next one. Other commands, such as the pointer of the next
+// session, are meant for what comes next and pass. It returns whether the command was discarded.
+func (d *dispatcher) discardLate(id int, cmd command) bool {
+	d.mutex.Lock()
+	prompt, late := d.timedOut[id]
+	late = late && answers(prompt, cmd)
+	if late {
+		delete(d.timedOut, id)
+	}
+	d.mutex.Unlock()
+	if late {
+		emitFor(id, "command-discarded", "command", cmd.name, "prompt", prompt, "reason", "timed out")
+	}
+	return late
+}
+
+// answers reports whether the command is a decision for the prompt, which may be prefixed with
+// the session identifier as in "2:pin".
+func answers(prompt string, cmd command) bool {
+	if i := strings.LastIndex(prompt, ":"); i >= 0 {
+		prompt = prompt[i+1:]
+	}
+	switch prompt {
+	case "permission":
+		switch cmd.name {
+		case "yes", "no", "proceed", "cancel", "choose":
+			return true
+		}
+		return cmd.choice != nil
+	case "pin":
+		switch cmd.name {
+		case "pin", "abort", "cancel":
+			return true
+		}
+		_, err := strconv.Atoi(cmd.name)
+		return err == nil && cmd.args == ""
+	}
+	return false
+}
+
+// sessionQueue returns the queue of commands for the session, creating it if necessary.
+func (d *dispatcher) sessionQueue(id int) chan command {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	queue, ok := d.sessions[id]
+	if !ok {
+		queue = make(chan command, commandQueueSize)
+		if d.closed {
+			close(queue)
+		}
+		d.sessions[id] = queue
+	}
+	return queue
+}
+
+func (d *dispatcher) printStatus(command) {
+	d.mutex.Lock()
+	fields := []interface{}{"waiting", d.prompts()}
+	if d.status != nil {
+		fields = append(fields, d.status()...)
+	}
+	d.mutex.Unlock()
+	emit("status", fields...)
+}
+
+// prompts returns the prompts currently waited for, in the order of the queues waiting for
+// them, separated by commas. The mutex must be held.
+func (d *dispatcher) prompts() string {
+	ids := make([]int, 0, len(d.waiting))
+	for id := range d.waiting {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	prompts := make([]string, len(ids))
+	for i, id := range ids {
+		prompts[i] = d.waiting[id]
+	}
+	return strings.Join(prompts, ",")
+}
+
+// setStatus registers a function providing extra fields for the status command.
+func (d *dispatcher) setStatus(status func() []interface{}) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.status = status
+}
+
+// await blocks until the next command is available, recording what it is waiting for
+// so that the status command can report it. It returns false once stdin is exhausted.
+func (d *dispatcher) await(prompt string) (command, bool) {
+	d.mutex.Lock()
+	d.waiting[0] = prompt
+	delete(d.timedOut, 0)
+	cmd, ok := d.held[0]
+	delete(d.held, 0)
+	d.mutex.Unlock()
+
+	if !ok {
+		cmd, ok = <-d.commands
+	}
+
+	d.mutex.Lock()
+	delete(d.waiting, 0)
+	d.mutex.Unlock()
+	return cmd, ok
+}
+
+// awaitWithin is like await, but gives up once timeout fires, in which case it returns
+// true as its last value. A non-zero id waits for the next command meant for that session.
+// After a timeout, the first answer to the prompt to arrive before the next wait is discarded,
+// so that a late answer to this prompt is not taken as the answer to the next one.
+func (d *dispatcher) awaitWithin(id int, prompt string, timeout <-chan time.Time) (command, bool, bool) {
+	queue := d.commands
+	if id != 0 {
+		queue = d.sessionQueue(id)
+		prompt = fmt.Sprintf("%d:%s", id, prompt)
+	}
+	d.mutex.Lock()
+	d.waiting[id] = prompt
+	delete(d.timedOut, id)
+	cmd, ok := d.held[id]
+	delete(d.held, id)
+	d.mutex.Unlock()
+
+	timedOut := false
+	if !ok {
+		select {
+		case cmd, ok = <-queue:
+		case <-timeout:
+			timedOut = true
+		}
+	}
+
+	d.mutex.Lock()
+	delete(d.waiting, id)
+	if timedOut {
+		d.timedOut[id] = prompt
+	}
+	d.mutex.Unlock()
+	if timedOut {
+		// A command that arrived along with the timeout is just as late
+		select {
+		case late, ok := <-queue:
+			if ok && !d.discardLate(id, late) {
+				d.mutex.Lock()
+				d.held[id] = late
+				d.mutex.Unlock()
+			}
+		default:
+		}
+	}
+	return cmd, ok, timedOut
+}
+
+// readErr returns the error that stopped the reading goroutine, if it was not the end of input.
+func (d *dispatcher) readErr() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.err
+}
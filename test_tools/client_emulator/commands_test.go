@@ -0,0 +1,204 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDispatcherWaitingPerSession(t *testing.T) {
+	log := captureEvents(t)
+	input, typed := io.Pipe()
+	defer typed.Close()
+	commands := newDispatcher()
+	commands.routeSessions = true
+	commands.start(input)
+
+	answered := make(chan command, 2)
+	for _, wait := range []struct {
+		id     int
+		prompt string
+	}{{1, "permission"}, {2, "pin"}} {
+		wait := wait
+		go func() {
+			cmd, _, _ := commands.awaitWithin(wait.id, wait.prompt, nil)
+			answered <- cmd
+		}()
+	}
+	awaitPrompts := func(expected string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			commands.mutex.Lock()
+			waiting := commands.prompts()
+			commands.mutex.Unlock()
+			if waiting == expected {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("waiting for %q, want %q", waiting, expected)
+			}
+		}
+	}
+	awaitPrompts("1:permission,2:pin")
+
+	// Answering one session leaves the wait of the other one alone
+	if _, err := io.WriteString(typed, "2 yes\n"); err != nil {
+		t.Fatal(err)
+	}
+	awaitPrompts("1:permission")
+	commands.printStatus(command{})
+	if status := log.named("status"); len(status) != 1 || status[0]["waiting"] != "1:permission" {
+		t.Errorf("status events %v", status)
+	}
+
+	if _, err := io.WriteString(typed, "1 yes\n"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case cmd := <-answered:
+			if cmd.name != "yes" {
+				t.Errorf("session got %+v", cmd)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("session got no answer")
+		}
+	}
+}
+
+func TestDispatcherTimeoutPerSession(t *testing.T) {
+	log := captureEvents(t)
+	input, typed := io.Pipe()
+	defer typed.Close()
+	commands := newDispatcher()
+	commands.routeSessions = true
+	commands.start(input)
+
+	answered := make(chan command, 1)
+	go func() {
+		cmd, _, _ := commands.awaitWithin(1, "permission", nil)
+		answered <- cmd
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		commands.mutex.Lock()
+		waiting := commands.prompts()
+		commands.mutex.Unlock()
+		if waiting == "1:permission" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("waiting for %q", waiting)
+		}
+	}
+
+	// Another session timing out leaves the wait of the first one alone
+	timeout := make(chan time.Time)
+	close(timeout)
+	if _, _, timedOut := commands.awaitWithin(2, "pin", timeout); !timedOut {
+		t.Fatal("wait did not time out")
+	}
+	commands.printStatus(command{})
+	if status := log.named("status"); len(status) != 1 || status[0]["waiting"] != "1:permission" {
+		t.Errorf("status events %v", status)
+	}
+
+	if _, err := io.WriteString(typed, "2 cancel\n1 yes\n"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case cmd := <-answered:
+		if cmd.name != "yes" {
+			t.Errorf("session 1 got %+v", cmd)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session 1 got no answer")
+	}
+	if discarded := log.named("command-discarded"); len(discarded) != 1 || discarded[0]["prompt"] != "2:pin" {
+		t.Errorf("command-discarded events %v\n%s", discarded, log)
+	}
+}
+
+func TestParseJSONCommand(t *testing.T) {
+	tests := []struct {
+		line string
+		want command
+	}{
+		{`{"cmd":"pin","value":"12345"}`, command{line: "pin 12345", name: "pin", args: "12345"}},
+		{`{"cmd":"yes","session":2,"choice":[["irma-demo.RU.studentCard.studentID"]]}`,
+			command{line: "yes", name: "yes", session: 2, choice: [][]string{{"irma-demo.RU.studentCard.studentID"}}}},
+		{`{"cmd":"session","pointer":{"u":"https://example.com/irma/session/abc","irmaqr":"disclosing"}}`,
+			command{
+				line: `{"u":"https://example.com/irma/session/abc","irmaqr":"disclosing"}`,
+				name: `{"u":"https://example.com/irma/session/abc","irmaqr":"disclosing"}`,
+			}},
+	}
+	for _, test := range tests {
+		cmd, err := parseJSONCommand(test.line)
+		if err != nil {
+			t.Errorf("%s: %v", test.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(cmd, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.line, cmd, test.want)
+		}
+	}
+
+	for _, line := range []string{`{"value":"12345"}`, `{"cmd":"session"}`, `pin 12345`} {
+		if _, err := parseJSONCommand(line); err == nil {
+			t.Errorf("%s: no error", line)
+		}
+	}
+}
+
+func TestDiscardLateDecisionsOnly(t *testing.T) {
+	log := captureEvents(t)
+	input, typed := io.Pipe()
+	defer typed.Close()
+	commands := newDispatcher()
+	commands.start(input)
+
+	timeout := make(chan time.Time)
+	close(timeout)
+	if _, _, timedOut := commands.awaitWithin(0, "permission", timeout); !timedOut {
+		t.Fatal("wait did not time out")
+	}
+
+	// The pointer of the next session is not an answer to the permission prompt, so it is queued,
+	// while the late answer typed after it is discarded
+	go io.WriteString(typed, "{\"u\":\"https://example.com/irma/session/abc\"}\nyes\nstatus\n")
+	deadline := time.Now().Add(5 * time.Second)
+	for len(log.named("status")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if discarded := log.named("command-discarded"); len(discarded) != 1 || discarded[0]["command"] != "yes" {
+		t.Errorf("command-discarded events %v\n%s", discarded, log)
+	}
+	cmd, ok := commands.await("session")
+	if !ok || cmd.name != `{"u":"https://example.com/irma/session/abc"}` {
+		t.Errorf("next session got %+v", cmd)
+	}
+}
+
+func TestAnswers(t *testing.T) {
+	tests := []struct {
+		prompt, line string
+		answers      bool
+	}{
+		{"permission", "yes", true},
+		{"permission", "cancel", true},
+		{"2:permission", "no", true},
+		{"permission", `{"u":"https://example.com/irma/session/abc"}`, false},
+		{"permission", "force-update", false},
+		{"pin", "12345", true},
+		{"3:pin", "pin 12345", true},
+		{"pin", "abort", true},
+		{"pin", "yes", false},
+		{"session", "cancel", false},
+	}
+	for _, test := range tests {
+		if answers := answers(test.prompt, parseCommand(test.line)); answers != test.answers {
+			t.Errorf("%q answers %s: %t, want %t", test.line, test.prompt, answers, test.answers)
+		}
+	}
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+	"go.etcd.io/bbolt"
+)
+
+// exportedCredential is the format in which stored credentials are written to file. Besides
+// the information about the credential it holds the credential as irmaclient stores it, from
+// which -import-credential stores it again.
+type exportedCredential struct {
+	Type irma.CredentialTypeIdentifier `json:"type"`
+	*irma.CredentialInfo
+	AttributeList *irma.AttributeList `json:"attribute_list,omitempty"`
+	Signature     json.RawMessage     `json:"signature,omitempty"`
+	// The fingerprint of the device secret the credential is bound to
+	Device string `json:"device,omitempty"`
+}
+
+// newestCredential returns the most recently signed instance of the credential type, if any.
+func newestCredential(client *irmaclient.Client, credtype irma.CredentialTypeIdentifier) *irma.CredentialInfo {
+	var newest *irma.CredentialInfo
+	for _, info := range client.CredentialInfoList() {
+		if info.Identifier() != credtype {
+			continue
+		}
+		if newest == nil || time.Time(info.SignedOn).After(time.Time(newest.SignedOn)) {
+			newest = info
+		}
+	}
+	return newest
+}
+
+// exportCredential writes the newest instance of the credential type to the file as JSON,
+// reading its signature from a copy of the storage database in dir.
+func exportCredential(client *irmaclient.Client, dir string, credtype irma.CredentialTypeIdentifier, path string) error {
+	info := newestCredential(client, credtype)
+	if info == nil {
+		return fmt.Errorf("no credential of type %s stored", credtype)
+	}
+	exported := exportedCredential{Type: credtype, CredentialInfo: info}
+
+	db, closeDB, err := snapshotStorage(dir)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+	err = db.View(func(tx *bbolt.Tx) error {
+		lists, err := storedAttributeLists(tx, credtype)
+		if err != nil {
+			return err
+		}
+		for _, list := range lists {
+			if list.Hash() == info.Hash {
+				exported.AttributeList = list
+			}
+		}
+		if bucket := tx.Bucket([]byte(signaturesBucket)); bucket != nil {
+			exported.Signature = append(json.RawMessage{}, bucket.Get([]byte(info.Hash))...)
+		}
+		if exported.AttributeList == nil || len(exported.Signature) == 0 {
+			return fmt.Errorf("credential %s not found in storage %s", info.Hash, dir)
+		}
+		secret, err := storedDeviceSecret(tx)
+		if secret != nil {
+			exported.Device = deviceFingerprint(secret)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	bts, err := json.MarshalIndent(exported, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, bts, 0600)
+}
+
+// importCredential adds the credential exported to the file by -export-credential to the
+// storage database in dir before the client starts, unless it is already stored, and returns
+// it. A credential is bound to the device secret it was issued against, so it can only be
+// disclosed if the storage has the same secret, e.g. because it was set with -device-secret.
+func importCredential(dir, path string) (*exportedCredential, error) {
+	bts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cred := &exportedCredential{}
+	if err = json.Unmarshal(bts, cred); err != nil {
+		return nil, fmt.Errorf("malformed credential export %s: %v", path, err)
+	}
+	if cred.CredentialInfo == nil || cred.AttributeList == nil || len(cred.AttributeList.Ints) == 0 || len(cred.Signature) == 0 {
+		return nil, fmt.Errorf("credential export %s does not contain the stored credential", path)
+	}
+	if hash := cred.AttributeList.Hash(); hash != cred.Hash {
+		return nil, fmt.Errorf("credential export %s: attributes do not match hash %s", path, cred.Hash)
+	}
+
+	db, err := bbolt.Open(filepath.Join(dir, storageDatabase), 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	imported := false
+	err = db.Update(func(tx *bbolt.Tx) error {
+		lists, err := storedAttributeLists(tx, cred.Type)
+		if err != nil {
+			return err
+		}
+		for _, list := range lists {
+			if list.Hash() == cred.Hash {
+				return nil
+			}
+		}
+		attributes, err := tx.CreateBucketIfNotExists([]byte(attributesBucket))
+		if err != nil {
+			return err
+		}
+		listsJSON, err := json.Marshal(append(lists, cred.AttributeList))
+		if err != nil {
+			return err
+		}
+		if err = attributes.Put([]byte(cred.Type.String()), listsJSON); err != nil {
+			return err
+		}
+		signatures, err := tx.CreateBucketIfNotExists([]byte(signaturesBucket))
+		if err != nil {
+			return err
+		}
+		imported = true
+		return signatures.Put([]byte(cred.Hash), cred.Signature)
+	})
+	if err != nil {
+		return nil, err
+	}
+	emit("credential-imported", "type", cred.Type, "hash", cred.Hash, "already_stored", !imported,
+		"same_device", device.secret != nil && cred.Device == deviceFingerprint(device.secret))
+	return cred, nil
+}
+
+// storedAttributeLists returns the attributes of the stored instances of the credential type.
+func storedAttributeLists(tx *bbolt.Tx, credtype irma.CredentialTypeIdentifier) ([]*irma.AttributeList, error) {
+	var lists []*irma.AttributeList
+	bucket := tx.Bucket([]byte(attributesBucket))
+	if bucket == nil {
+		return lists, nil
+	}
+	if bts := bucket.Get([]byte(credtype.String())); bts != nil {
+		if err := json.Unmarshal(bts, &lists); err != nil {
+			return nil, fmt.Errorf("credentials of %s: %v", credtype, err)
+		}
+	}
+	return lists, nil
+}
+
+// printCredentialAttributes emits the attributes of the stored credential with the given hash
+// in the order in which the credential type defines them, which is the order in which they
+// occur in the credential's proofs.
+func printCredentialAttributes(client *irmaclient.Client, hash string) {
+	var info *irma.CredentialInfo
+	for _, candidate := range client.CredentialInfoList() {
+		if candidate.Hash == hash {
+			info = candidate
+		}
+	}
+	if info == nil {
+		emit("credential-not-found", "hash", hash)
+		return
+	}
+	credtype := info.GetCredentialType(client.Configuration)
+	if credtype == nil {
+		emit("credential-not-found", "hash", hash, "type", info.Identifier())
+		return
+	}
+
+	for i, attr := range credtype.AttributeTypes {
+		value := ""
+		if translated := info.Attributes[attr.GetAttributeTypeIdentifier()]; translated != nil {
+			value = translated[""]
+		}
+		emit("credential-attribute", "hash", hash, "index", i, "name", attr.ID, "value", value)
+	}
+}
+
+// deleteCredential removes all stored instances of the given credential type, so that
+// credential state can be reset without removing the whole storage directory.
+func deleteCredential(client *irmaclient.Client, credtype string) {
+	id := irma.NewCredentialTypeIdentifier(credtype)
+	if _, ok := client.Configuration.CredentialTypes[id]; !ok {
+		emit("delete-credential-failed", "type", credtype, "error", "unknown credential type")
+		return
+	}
+	count := 0
+	for _, info := range client.CredentialInfoList() {
+		if info.Identifier() == id {
+			count++
+		}
+	}
+	if count == 0 {
+		emit("delete-credential-failed", "type", credtype, "error", "credential not stored")
+		return
+	}
+	// Remove the last instance first, so that the indices of the others do not change
+	for index := count - 1; index >= 0; index-- {
+		if err := client.RemoveCredential(id, index); err != nil {
+			emit("delete-credential-failed", "type", credtype, "error", err)
+			return
+		}
+	}
+	emit("credential-deleted", "type", credtype, "count", count)
+}
+
+// findCredentials emits the stored credentials having an attribute that matches the pattern
+// in args, of the form <attributeid>[=<value>], along with their hashes so that they can be
+// passed to credential-attributes. The identifier may end with a * to match all attributes
+// starting with what precedes it; the value, if given, must match exactly.
+func findCredentials(client *irmaclient.Client, args string) {
+	pattern, value := args, ""
+	matchValue := false
+	if i := strings.Index(args, "="); i >= 0 {
+		pattern, value, matchValue = args[:i], args[i+1:], true
+	}
+	if pattern == "" {
+		emit("find-failed", "pattern", args, "error", "missing attribute identifier")
+		return
+	}
+	matchesID := func(id string) bool { return id == pattern }
+	if prefix := strings.TrimSuffix(pattern, "*"); prefix != pattern {
+		matchesID = func(id string) bool { return strings.HasPrefix(id, prefix) }
+	}
+
+	matches := 0
+	for _, info := range client.CredentialInfoList() {
+		var attributes []string
+		for id, translated := range info.Attributes {
+			if !matchesID(id.String()) || (matchValue && (translated == nil || translated[""] != value)) {
+				continue
+			}
+			attributes = append(attributes, id.String())
+		}
+		if len(attributes) == 0 {
+			continue
+		}
+		sort.Strings(attributes)
+		matches++
+		emit("credential-found", "type", info.Identifier(), "hash", info.Hash, "attributes", strings.Join(attributes, ","))
+	}
+	emit("find-done", "pattern", args, "matches", matches)
+}
+
+// storedInstance is a stored instance of a credential type, in the order of storage.
+type storedInstance struct {
+	hash     string
+	signedOn time.Time
+}
+
+func storedInstances(client *irmaclient.Client, credtype irma.CredentialTypeIdentifier) []storedInstance {
+	var instances []storedInstance
+	for i := 0; ; i++ {
+		attrs := client.Attributes(credtype, i)
+		if attrs == nil {
+			return instances
+		}
+		instances = append(instances, storedInstance{hash: attrs.Hash(), signedOn: attrs.SigningDate()})
+	}
+}
+
+// preferredInstance returns the hash of the instance of the credential type that the emulator
+// discloses by default, i.e. the first one that irmaclient offers as a usable candidate, or ""
+// if none is usable.
+func preferredInstance(client *irmaclient.Client, ct *irma.CredentialType) string {
+	var attr *irma.AttributeType
+	for _, candidate := range ct.AttributeTypes {
+		if !candidate.IsOptional() && !candidate.RevocationAttribute {
+			attr = candidate
+			break
+		}
+	}
+	if attr == nil {
+		return ""
+	}
+	candidates, _, err := client.Candidates(irma.NewDisclosureRequest(attr.GetAttributeTypeIdentifier()))
+	if err != nil || len(candidates) == 0 {
+		return ""
+	}
+	for _, con := range candidates[0] {
+		if _, err := con.Choose(); err == nil && len(con) > 0 {
+			return con[0].CredentialHash
+		}
+	}
+	return ""
+}
+
+// dedupeCredentials implements the dedupe-report and dedupe commands. It emits for every stored
+// credential type how many instances there are, whether the type should be a singleton, and
+// which instance is the newest and which one is disclosed by default, flagging singleton types
+// with several instances as duplicates. With apply, all but the newest instance of those types
+// are removed.
+func dedupeCredentials(client *irmaclient.Client, apply bool) {
+	credtypes := map[string]struct{}{}
+	for _, info := range client.CredentialInfoList() {
+		credtypes[info.Identifier().String()] = struct{}{}
+	}
+
+	duplicates, removed := 0, 0
+	for _, id := range sortedKeys(credtypes) {
+		credtype := irma.NewCredentialTypeIdentifier(id)
+		instances := storedInstances(client, credtype)
+		newest := 0
+		for i, instance := range instances {
+			if instance.signedOn.After(instances[newest].signedOn) {
+				newest = i
+			}
+		}
+		ct := client.Configuration.CredentialTypes[credtype]
+		singleton := ct != nil && ct.IsSingleton
+		duplicate := singleton && len(instances) > 1
+		preferred := ""
+		if ct != nil {
+			preferred = preferredInstance(client, ct)
+		}
+		emit("credential-instances", "type", id, "instances", len(instances), "singleton", singleton,
+			"duplicate", duplicate, "newest", instances[newest].hash, "preferred", preferred)
+		if !duplicate {
+			continue
+		}
+		duplicates++
+		if !apply {
+			continue
+		}
+		for i, instance := range instances {
+			if i == newest {
+				continue
+			}
+			if err := client.RemoveCredentialByHash(instance.hash); err != nil {
+				emit("dedupe-failed", "type", id, "hash", instance.hash, "error", err)
+				continue
+			}
+			removed++
+			emit("credential-deduplicated", "type", id, "hash", instance.hash, "kept", instances[newest].hash)
+		}
+	}
+	emit("dedupe-done", "types", len(credtypes), "duplicates", duplicates, "removed", removed, "applied", apply)
+}
+
+// ExpiringCredential describes a stored credential in the expiry event.
+type ExpiringCredential struct {
+	Type          string    `json:"type"`
+	Hash          string    `json:"hash"`
+	SignedOn      time.Time `json:"signed_on"`
+	Expires       time.Time `json:"expires"`
+	DaysRemaining int       `json:"days_remaining"` // negative once expired
+	Revoked       bool      `json:"revoked"`
+}
+
+// The window of the expiry command when none is given
+const defaultExpiryWindow = 30 * 24 * time.Hour
+
+// printExpiry emits the stored credentials that expire within the window given in args,
+// either as a number of days (e.g. 30d) or as a duration, and those that have already
+// expired, both sorted by expiry date.
+func printExpiry(client *irmaclient.Client, args string) {
+	window, err := parseExpiryWindow(args)
+	if err != nil {
+		emit("expiry-failed", "error", err)
+		return
+	}
+
+	expiring, expired := []ExpiringCredential{}, []ExpiringCredential{}
+	for _, info := range client.CredentialInfoList() {
+		expires := time.Time(info.Expires)
+		remaining := expires.Sub(now())
+		cred := ExpiringCredential{
+			Type:          info.Identifier().String(),
+			Hash:          info.Hash,
+			SignedOn:      time.Time(info.SignedOn),
+			Expires:       expires,
+			DaysRemaining: int(math.Floor(remaining.Hours() / 24)),
+			Revoked:       info.Revoked,
+		}
+		switch {
+		case remaining <= 0:
+			expired = append(expired, cred)
+		case remaining <= window:
+			expiring = append(expiring, cred)
+		}
+	}
+	for _, list := range [][]ExpiringCredential{expiring, expired} {
+		sort.SliceStable(list, func(i, j int) bool { return list[i].Expires.Before(list[j].Expires) })
+	}
+	emit("expiry", "window", window, "expiring", jsonField{expiring}, "expired", jsonField{expired})
+}
+
+func parseExpiryWindow(args string) (time.Duration, error) {
+	if args == "" {
+		return defaultExpiryWindow, nil
+	}
+	if strings.HasSuffix(args, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(args, "d"))
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("invalid window %q, expected e.g. 30d or 72h", args)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	window, err := time.ParseDuration(args)
+	if err != nil || window < 0 {
+		return 0, fmt.Errorf("invalid window %q, expected e.g. 30d or 72h", args)
+	}
+	return window, nil
+}
+
+// verifyCredentialSignature checks the issuer's signature on the stored credential by having
+// the client disclose all of its attributes, and verifying the resulting proof against the
+// issuer public keys in the configuration. This does not work for credentials of schemes
+// using a keyshare server, as their proofs also require the keyshare server.
+func verifyCredentialSignature(client *irmaclient.Client, info *irma.CredentialInfo) error {
+	credtype := info.GetCredentialType(client.Configuration)
+	if credtype == nil {
+		return fmt.Errorf("unknown credential type %s", info.Identifier())
+	}
+	if client.Configuration.SchemeManagers[credtype.SchemeManagerIdentifier()].Distributed() {
+		return fmt.Errorf("credentials of scheme %s cannot be verified without its keyshare server", credtype.SchemeManagerID)
+	}
+
+	request := irma.NewDisclosureRequest()
+	chosen := []*irma.AttributeIdentifier{}
+	con := irma.AttributeCon{}
+	for _, attr := range credtype.AttributeTypes {
+		id := attr.GetAttributeTypeIdentifier()
+		if info.Attributes[id] == nil {
+			continue
+		}
+		con = append(con, irma.AttributeRequest{Type: id})
+		chosen = append(chosen, &irma.AttributeIdentifier{Type: id, CredentialHash: info.Hash})
+	}
+	request.Disclose = irma.AttributeConDisCon{irma.AttributeDisCon{con}}
+
+	disclosure, _, err := client.Proofs(&irma.DisclosureChoice{Attributes: [][]*irma.AttributeIdentifier{chosen}}, request)
+	if err != nil {
+		return err
+	}
+	_, status, err := disclosure.Verify(client.Configuration, request)
+	if err != nil {
+		return err
+	}
+	if status != irma.ProofStatusValid {
+		return fmt.Errorf("proof status %s", status)
+	}
+	return nil
+}
+
+// verifyIssuedCredentials verifies the signatures of the newest instances of the given
+// credential types, emitting the result for each.
+func verifyIssuedCredentials(client *irmaclient.Client, handler *SessionHandler, credtypes []irma.CredentialTypeIdentifier) {
+	for _, credtype := range credtypes {
+		info := newestCredential(client, credtype)
+		if info == nil {
+			handler.emit("signature-invalid", "type", credtype, "error", "credential not stored")
+			continue
+		}
+		if err := verifyCredentialSignature(client, info); err != nil {
+			handler.emit("signature-invalid", "type", credtype, "hash", info.Hash, "error", err)
+			continue
+		}
+		handler.emit("signature-valid", "type", credtype, "hash", info.Hash)
+	}
+}
+
+// rememberIssued records the credential types that the issuance session is about to issue, so
+// that -verify-signatures can check them once they are received.
+func (s *SessionHandler) rememberIssued(req *permissionRequest) bool {
+	if issuance, ok := req.request.(*irma.IssuanceRequest); ok {
+		s.mutex.Lock()
+		for _, cred := range issuance.Credentials {
+			s.issued = append(s.issued, cred.CredentialTypeID)
+		}
+		s.mutex.Unlock()
+	}
+	return true
+}
+
+// walletWatcher lets sessions wait for credentials to be added to the wallet.
+type walletWatcher struct {
+	mutex   sync.Mutex
+	changed chan struct{} // closed and replaced when a credential is received
+}
+
+// Notified by ClientHandler.UpdateAttributes
+var wallet = &walletWatcher{changed: make(chan struct{})}
+
+func (w *walletWatcher) notify() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+// changes returns a channel that is closed when the next credential is received.
+func (w *walletWatcher) changes() <-chan struct{} {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.changed
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+)
+
+func TestExportCredential(t *testing.T) {
+	client, _ := newTestClient(t)
+	storage := filepath.Dir(client.Configuration.Path)
+	credtype := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	path := filepath.Join(t.TempDir(), "studentCard.json")
+
+	if err := exportCredential(client, storage, credtype, path); err != nil {
+		t.Fatal(err)
+	}
+	bts, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported := exportedCredential{}
+	if err := json.Unmarshal(bts, &exported); err != nil {
+		t.Fatalf("malformed export: %v\n%s", err, bts)
+	}
+	if exported.Type != credtype || exported.CredentialInfo == nil || exported.Hash != newestCredential(client, credtype).Hash {
+		t.Errorf("exported %s", bts)
+	}
+	if value := exported.Attributes[irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")][""]; value != "456" {
+		t.Errorf("exported studentID %q", value)
+	}
+	if exported.AttributeList == nil || exported.AttributeList.Hash() != exported.Hash || len(exported.Signature) == 0 || exported.Device == "" {
+		t.Errorf("stored credential missing from export %s", bts)
+	}
+
+	missing := filepath.Join(t.TempDir(), "fullName.json")
+	if err := exportCredential(client, storage, irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.fullName"), missing); err == nil {
+		t.Error("exporting a credential that is not stored succeeded")
+	}
+	if _, err := ioutil.ReadFile(missing); err == nil {
+		t.Error("file written for a credential that is not stored")
+	}
+}
+
+func TestImportCredential(t *testing.T) {
+	log := captureEvents(t)
+	client, _ := newTestClient(t)
+	credtype := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	path := filepath.Join(t.TempDir(), "studentCard.json")
+	if err := exportCredential(client, filepath.Dir(client.Configuration.Path), credtype, path); err != nil {
+		t.Fatal(err)
+	}
+	exported := newestCredential(client, credtype)
+
+	storage := t.TempDir()
+	for i := 0; i < 2; i++ {
+		if _, err := importCredential(storage, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	imported := log.named("credential-imported")
+	if len(imported) != 2 || imported[0]["already_stored"] != false || imported[1]["already_stored"] != true || imported[0]["hash"] != exported.Hash {
+		t.Errorf("credential-imported events %v", imported)
+	}
+
+	client, err := irmaclient.New(storage, testConfiguration(t), newClientHandler())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if infos := client.CredentialInfoList(); len(infos) != 1 || !reflect.DeepEqual(infos[0], exported) {
+		t.Fatalf("imported %v, exported %v", infos, exported)
+	}
+	candidates, satisfiable, err := client.Candidates(irma.NewDisclosureRequest(
+		irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")))
+	if err != nil || !satisfiable || candidates[0][0][0].CredentialHash != exported.Hash {
+		t.Errorf("imported credential is not a candidate: %v", err)
+	}
+}
+
+func TestImportCredentialWithoutSignature(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "studentCard.json")
+	if err := ioutil.WriteFile(path, []byte(`{"type":"irma-demo.RU.studentCard","Hash":"abc"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := importCredential(t.TempDir(), path); err == nil {
+		t.Error("imported an export without the stored credential")
+	}
+}
+
+func TestDeleteCredential(t *testing.T) {
+	log := captureEvents(t)
+	client, _ := newTestClient(t)
+	credtype := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	stored := len(client.CredentialInfoList())
+
+	deleteCredential(client, credtype.String())
+	if deleted := log.named("credential-deleted"); len(deleted) != 1 || deleted[0]["count"] != float64(1) {
+		t.Fatalf("credential-deleted events %v\n%s", deleted, log)
+	}
+	if newestCredential(client, credtype) != nil {
+		t.Error("credential still stored")
+	}
+	if left := len(client.CredentialInfoList()); left != stored-1 {
+		t.Errorf("%d of %d credentials left, want all but the deleted one", left, stored)
+	}
+
+	deleteCredential(client, credtype.String())
+	deleteCredential(client, "irma-demo.RU.nothing")
+	failed := log.named("delete-credential-failed")
+	if len(failed) != 2 || failed[0]["error"] != "credential not stored" || failed[1]["error"] != "unknown credential type" {
+		t.Errorf("delete-credential-failed events %v", failed)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/gabi/gabikeys"
+	"github.com/privacybydesign/irmago/irmaclient"
+	"go.etcd.io/bbolt"
+)
+
+// The key in the userdata bucket under which irmaclient stores the device secret
+const secretKeyKey = "sk"
+
+// storedSecretKey is the device secret as irmaclient stores it
+type storedSecretKey struct {
+	Key *big.Int
+}
+
+// The device secret of the client as it was when the client started, read by
+// readDeviceSecret or readGeneratedDeviceSecret or set by injectDeviceSecret, as irmaclient
+// does not expose it and keeps the storage locked while running
+var device struct {
+	secret   *big.Int
+	injected bool
+}
+
+// parseDeviceSecret parses a -device-secret, a decimal number or a hexadecimal one prefixed
+// with 0x, which must be a positive number that fits in the bits of a generated secret.
+func parseDeviceSecret(s string) (*big.Int, error) {
+	secret := new(big.Int)
+	ok := false
+	if hexSecret := strings.TrimPrefix(strings.ToLower(s), "0x"); hexSecret != strings.ToLower(s) {
+		_, ok = secret.SetString(hexSecret, 16)
+	} else {
+		_, ok = secret.SetString(s, 10)
+	}
+	if !ok {
+		return nil, fmt.Errorf("expected a decimal number or a hexadecimal one prefixed with 0x")
+	}
+	if bits := gabikeys.DefaultSystemParameters[1024].Lm; secret.Sign() <= 0 || uint(secret.BitLen()) > bits {
+		return nil, fmt.Errorf("expected a positive number of at most %d bits", bits)
+	}
+	return secret, nil
+}
+
+// readDeviceSecret reads the device secret from the storage database in dir before the client
+// starts, without modifying the storage. The secret stays unknown when the storage does not
+// hold one yet, as irmaclient only generates it once the client starts; see
+// readGeneratedDeviceSecret.
+func readDeviceSecret(dir string) error {
+	db, err := openStorage(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return loadDeviceSecret(db)
+}
+
+// readGeneratedDeviceSecret reads the device secret that irmaclient generated when it started
+// on a storage that did not hold one yet. As the running client keeps the storage locked, it is
+// read from a copy.
+func readGeneratedDeviceSecret(dir string) error {
+	db, cleanup, err := snapshotStorage(dir)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	return loadDeviceSecret(db)
+}
+
+// loadDeviceSecret sets the device secret to the one stored in db, if any.
+func loadDeviceSecret(db *bbolt.DB) error {
+	return db.View(func(tx *bbolt.Tx) error {
+		stored, err := storedDeviceSecret(tx)
+		if err == nil {
+			device.secret = stored
+		}
+		return err
+	})
+}
+
+// injectDeviceSecret stores the -device-secret in the storage database in dir before the
+// client starts, replacing the one irmaclient generated. This is refused if credentials are
+// stored under another secret, as they are bound to the secret they were issued against.
+func injectDeviceSecret(dir string, secret *big.Int) error {
+	db, err := bbolt.Open(filepath.Join(dir, storageDatabase), 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bbolt.Tx) error {
+		stored, err := storedDeviceSecret(tx)
+		if err != nil {
+			return err
+		}
+		if stored != nil && stored.Cmp(secret) != 0 {
+			if credentials := tx.Bucket([]byte(attributesBucket)); credentials != nil && credentials.Stats().KeyN > 0 {
+				return fmt.Errorf("storage holds credentials issued against another device secret")
+			}
+		}
+		bucket, err := tx.CreateBucketIfNotExists([]byte(userdataBucket))
+		if err != nil {
+			return err
+		}
+		bts, err := json.Marshal(storedSecretKey{Key: secret})
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte(secretKeyKey), bts); err != nil {
+			return err
+		}
+		device.secret, device.injected = secret, true
+		return nil
+	})
+}
+
+// storedDeviceSecret returns the device secret in the storage, or nil if there is none.
+func storedDeviceSecret(tx *bbolt.Tx) (*big.Int, error) {
+	bucket := tx.Bucket([]byte(userdataBucket))
+	if bucket == nil {
+		return nil, nil
+	}
+	bts := bucket.Get([]byte(secretKeyKey))
+	if bts == nil {
+		return nil, nil
+	}
+	stored := storedSecretKey{}
+	if err := json.Unmarshal(bts, &stored); err != nil {
+		return nil, fmt.Errorf("stored device secret: %v", err)
+	}
+	return stored.Key, nil
+}
+
+// deviceFingerprint returns the hex-encoded first 16 bytes of the SHA-256 hash of the secret,
+// which identifies the device secret without revealing it.
+func deviceFingerprint(secret *big.Int) string {
+	hash := sha256.Sum256(secret.Bytes())
+	return hex.EncodeToString(hash[:16])
+}
+
+// deviceInfo implements the device-info command: it emits the fingerprint of the device
+// secret, whether it was set by -device-secret, and the scheme managers at which the client
+// is enrolled. The secret itself is never emitted. Only available in developer mode.
+func deviceInfo(client *irmaclient.Client) {
+	if !client.Preferences.DeveloperMode {
+		emit("device-info-failed", "error", "device-info is only available in developer mode")
+		return
+	}
+	if device.secret == nil {
+		emit("device-info-failed", "error", "device secret unknown, as it could not be read from the storage")
+		return
+	}
+	managers := make([]string, 0, len(client.EnrolledSchemeManagers()))
+	for _, manager := range client.EnrolledSchemeManagers() {
+		managers = append(managers, manager.String())
+	}
+	emit("device-info", "fingerprint", deviceFingerprint(device.secret), "bits", device.secret.BitLen(),
+		"injected", device.injected, "keyshare", jsonField{managers})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/gabi/gabikeys"
+)
+
+func TestParseDeviceSecret(t *testing.T) {
+	for s, want := range map[string]int64{"12345": 12345, "0x1f": 31, "0X1F": 31} {
+		if secret, err := parseDeviceSecret(s); err != nil || secret.Cmp(big.NewInt(want)) != 0 {
+			t.Errorf("parsed %q as %v, %v", s, secret, err)
+		}
+	}
+
+	bits := gabikeys.DefaultSystemParameters[1024].Lm
+	largest := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), bits), big.NewInt(1))
+	if _, err := parseDeviceSecret(largest.String()); err != nil {
+		t.Errorf("refused a secret of %d bits: %v", bits, err)
+	}
+	tooLarge := new(big.Int).Add(largest, big.NewInt(1))
+	for _, s := range []string{"", "abc", "0x", "0xzz", "1f", "0", "-5", tooLarge.String()} {
+		if secret, err := parseDeviceSecret(s); err == nil {
+			t.Errorf("parsed %q as %v", s, secret)
+		}
+	}
+}
+
+func TestDeviceSecret(t *testing.T) {
+	storage, conf := t.TempDir(), testConfiguration(t)
+	args := []string{"-storage", storage, "-config", conf, "-output-format", "json"}
+	want := deviceFingerprint(big.NewInt(0x1234))
+
+	// The injected secret is used by the new client, and kept by later runs without the flag.
+	// Without a session pointer the emulator fails once stdin closes, but only after starting.
+	stdout, stderr, code := runEmulator(t, "device-info\n", true, append(args, "-device-secret", "0x1234")...)
+	if !strings.Contains(stderr, "No session pointer received") {
+		t.Fatalf("exit code %d\n%s%s", code, stdout, stderr)
+	}
+	if injected := eventsIn(stdout, "device-secret-injected"); len(injected) != 1 || injected[0]["fingerprint"] != want {
+		t.Errorf("device-secret-injected events %v, want fingerprint %s", injected, want)
+	}
+	info := eventsIn(stdout, "device-info")
+	if len(info) != 1 || info[0]["fingerprint"] != want || info[0]["injected"] != true || info[0]["bits"] != 13.0 {
+		t.Errorf("device-info events %v with -device-secret", info)
+	}
+	if strings.Contains(stdout, "1234") || strings.Contains(stdout, "4660") {
+		t.Errorf("emitted the secret itself:\n%s", stdout)
+	}
+
+	stdout, stderr, code = runEmulator(t, "device-info\n", true, args...)
+	if !strings.Contains(stderr, "No session pointer received") {
+		t.Fatalf("exit code %d\n%s%s", code, stdout, stderr)
+	}
+	if info := eventsIn(stdout, "device-info"); len(info) != 1 || info[0]["fingerprint"] != want || info[0]["injected"] != false {
+		t.Errorf("device-info events %v in a later run", info)
+	}
+
+	// Replacing the secret would orphan the credentials issued against the stored one
+	stdout, stderr, code = runEmulator(t, "", true, emulatorArgs(t, "-device-secret", "0x1234")...)
+	if code != exitStartup || !strings.Contains(stderr, "storage holds credentials issued against another device secret") {
+		t.Errorf("exit code %d with credentials under another secret\n%s%s", code, stdout, stderr)
+	}
+
+	// On a fresh storage the secret that irmaclient generates is reported
+	fresh := t.TempDir()
+	stdout, stderr, code = runEmulator(t, "device-info\ndevice-info\n", true, "-storage", fresh, "-config", conf, "-output-format", "json")
+	if !strings.Contains(stderr, "No session pointer received") {
+		t.Fatalf("exit code %d\n%s%s", code, stdout, stderr)
+	}
+	info = eventsIn(stdout, "device-info")
+	if len(info) != 2 || info[0]["fingerprint"] == "" || info[0]["fingerprint"] != info[1]["fingerprint"] || info[0]["injected"] != false {
+		t.Errorf("device-info events %v on a fresh storage\n%s", info, stdout)
+	}
+	stdout, _, _ = runEmulator(t, "device-info\n", true, "-storage", fresh, "-config", conf, "-output-format", "json")
+	if later := eventsIn(stdout, "device-info"); len(info) == 2 && (len(later) != 1 || later[0]["fingerprint"] != info[0]["fingerprint"]) {
+		t.Errorf("device-info events %v in a later run on the same storage, want fingerprint %v", later, info[0]["fingerprint"])
+	}
+
+	missing := filepath.Join(storage, "nonexistent")
+	stdout, stderr, code = runEmulator(t, "", true, "-storage", missing, "-config", conf, "-device-secret", "12")
+	if code != exitStartup || !strings.Contains(stderr, "Cannot store the device secret in storage "+missing) {
+		t.Errorf("exit code %d with a missing storage\n%s%s", code, stdout, stderr)
+	}
+
+	stdout, stderr, code = runEmulator(t, "", true, append(args, "-no-developer-mode", "-device-secret", "12")...)
+	if code != exitStartup || !strings.Contains(stderr, "only available in developer mode") {
+		t.Errorf("exit code %d with -no-developer-mode\n%s%s", code, stdout, stderr)
+	}
+	stdout, _, _ = runEmulator(t, "device-info\n", true, append(args, "-pref", "DeveloperMode=false")...)
+	if failed := eventsIn(stdout, "device-info-failed"); len(failed) != 1 || len(eventsIn(stdout, "device-info")) != 0 {
+		t.Errorf("device-info outside developer mode emitted\n%s", stdout)
+	}
+}
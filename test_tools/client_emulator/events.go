@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+)
+
+// events receives all protocol output, i.e. everything but the disclosed attributes, so
+// that -events-stderr can separate the two.
+var events io.Writer = os.Stdout
+
+// emit prints a single line for the named event, followed by the given key/value
+// pairs, so that tests driving the emulator can match on stable fields instead of
+// on free-form messages. With -output-format json the line is a JSON object instead,
+// holding the event name under "event".
+func emit(event string, fields ...interface{}) {
+	if *outputFormat == "json" {
+		fmt.Fprintln(events, formatJSON(event, fields))
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(event)
+	for i := 0; i+1 < len(fields); i += 2 {
+		fmt.Fprintf(&b, " %v=%s", fields[i], formatValue(fields[i+1]))
+	}
+	fmt.Fprintln(events, b.String())
+}
+
+// emitFor emits the event for the session with the given identifier, adding it as the
+// "session" field. Sessions only have an identifier when running several in parallel.
+func emitFor(session int, event string, fields ...interface{}) {
+	if session != 0 {
+		fields = append([]interface{}{"session", session}, fields...)
+	}
+	emit(event, fields...)
+}
+
+// jsonField wraps a structured event field. In JSON output it is nested as is, in text
+// output it is given as its JSON encoding.
+type jsonField struct {
+	value interface{}
+}
+
+func (f jsonField) String() string {
+	bts, err := json.Marshal(f.value)
+	if err != nil {
+		panic(err)
+	}
+	return string(bts)
+}
+
+// PermissionDisjunction describes a disjunction of a request in the permission-request event:
+// its label, and the candidate attributes for each of the conjunctions that can be chosen.
+type PermissionDisjunction struct {
+	Label irma.TranslatedString   `json:"label,omitempty"`
+	Cons  []PermissionConjunction `json:"cons"`
+}
+
+type PermissionConjunction struct {
+	// Whether all attributes are present and usable, i.e. whether the conjunction can be chosen
+	Choosable  bool                  `json:"choosable"`
+	Candidates []PermissionCandidate `json:"candidates"`
+}
+
+type PermissionCandidate struct {
+	Type           string  `json:"type"`
+	CredentialHash string  `json:"credential_hash,omitempty"` // empty if the credential is not present
+	Value          *string `json:"value,omitempty"`
+	Expired        bool    `json:"expired"`
+	Revoked        bool    `json:"revoked"`
+	NotRevokable   bool    `json:"not_revokable"`
+}
+
+// permissionDisjunctions converts the candidates irmaclient offers for the request into the
+// payload of the permission-request event.
+func permissionDisjunctions(request irma.SessionRequest, candidates [][]irmaclient.DisclosureCandidates) []PermissionDisjunction {
+	labels := request.Disclosure().Labels
+	disjunctions := []PermissionDisjunction{}
+	for i, discon := range candidates {
+		disjunction := PermissionDisjunction{Label: labels[i], Cons: []PermissionConjunction{}}
+		for _, con := range discon {
+			_, err := con.Choose()
+			conjunction := PermissionConjunction{Choosable: err == nil, Candidates: []PermissionCandidate{}}
+			for _, candidate := range con {
+				c := PermissionCandidate{
+					Type:           candidate.Type.String(),
+					CredentialHash: candidate.CredentialHash,
+					Expired:        candidate.Expired,
+					Revoked:        candidate.Revoked,
+					NotRevokable:   candidate.NotRevokable,
+				}
+				if value, ok := candidate.Value[""]; ok {
+					c.Value = &value
+				}
+				conjunction.Candidates = append(conjunction.Candidates, c)
+			}
+			disjunction.Cons = append(disjunction.Cons, conjunction)
+		}
+		disjunctions = append(disjunctions, disjunction)
+	}
+	return disjunctions
+}
+
+func formatValue(value interface{}) string {
+	s := fmt.Sprint(value)
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
+
+// formatJSON formats the event as a JSON object, keeping the fields in the given order.
+func formatJSON(event string, fields []interface{}) string {
+	var b strings.Builder
+	b.WriteString(`{"event":`)
+	b.Write(jsonValue(event))
+	for i := 0; i+1 < len(fields); i += 2 {
+		b.WriteByte(',')
+		b.Write(jsonValue(fmt.Sprint(fields[i])))
+		b.WriteByte(':')
+		b.Write(jsonValue(fields[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// jsonValue encodes booleans and numbers as such, and everything else as its string form.
+func jsonValue(value interface{}) []byte {
+	switch v := value.(type) {
+	case bool, int, int64, uint, uint64, float64:
+	case jsonField:
+		value = v.value
+	default:
+		value = fmt.Sprint(value)
+	}
+	bts, err := json.Marshal(value)
+	if err != nil {
+		panic(err)
+	}
+	return bts
+}
+
+// offerPermissionRequest emits the request for permission with -output-format json or
+// -json-commands, giving the harness everything it needs to make the decision itself.
+func (s *SessionHandler) offerPermissionRequest(req *permissionRequest) bool {
+	if *outputFormat == "json" || *jsonCommands {
+		s.emit("permission-request",
+			"action", req.request.Action(),
+			"request", jsonField{req.request},
+			"satisfiable", req.satisfiable,
+			"requestor", jsonField{req.requestorInfo},
+			"disjunctions", jsonField{permissionDisjunctions(req.request, req.candidates)},
+		)
+	}
+	return true
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// stringList is a flag that can be given multiple times, collecting all values.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// stringMap is a flag that can be given multiple times as key=value, collecting all pairs.
+type stringMap map[string]string
+
+func (m stringMap) String() string {
+	pairs := []string{}
+	for key, value := range m {
+		pairs = append(pairs, key+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m stringMap) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	m[value[:i]] = value[i+1:]
+	return nil
+}
+
+// flagGiven reports whether the flag was set on the command line, as opposed to having its default.
+func flagGiven(name string) bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		given = given || f.Name == name
+	})
+	return given
+}
@@ -2,4 +2,8 @@ module github.com/tweedegolf/irmars/test_tools/client_emulator
 
 go 1.16
 
-require github.com/privacybydesign/irmago v0.8.0 // indirect
+require (
+	github.com/privacybydesign/gabi v0.0.0-20210714094051-ba80a6a8c5d8
+	github.com/privacybydesign/irmago v0.8.0
+	go.etcd.io/bbolt v1.3.6
+)
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+	"go.etcd.io/bbolt"
+)
+
+// The bucket of the storage database in which irmaclient keeps the session history
+const historyBucket = "logs"
+
+// clearHistory removes the session history that irmaclient keeps in its storage, which it
+// offers no way to disable. The client must be closed, as it keeps the database locked.
+func clearHistory(storage string) error {
+	db, err := bbolt.Open(filepath.Join(storage, storageDatabase), 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	entries := 0
+	err = db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(historyBucket))
+		if bucket == nil {
+			return nil
+		}
+		entries = bucket.Stats().KeyN
+		return tx.DeleteBucket([]byte(historyBucket))
+	})
+	if err != nil {
+		return err
+	}
+	emit("history-cleared", "entries", entries)
+	return nil
+}
+
+// The number of log entries printed by the logs command when no limit is given, and the number
+// that is loaded from storage at a time
+const (
+	defaultLogsLimit = 20
+	logsPageSize     = 100
+)
+
+// The log types accepted by the logs command, besides the session actions themselves
+var logTypes = map[string]irma.Action{
+	"issuance":   irma.ActionIssuing,
+	"disclosure": irma.ActionDisclosing,
+	"signature":  irma.ActionSigning,
+	"removal":    irmaclient.ActionRemoval,
+}
+
+// logsQuery holds the arguments of the logs command.
+type logsQuery struct {
+	export     string // path of the JSONL file to which all matching entries are written, if any
+	before     uint64 // only entries older than the entry with this ID, if non-zero
+	limit      int
+	action     irma.Action                   // only entries of this type, if non-empty
+	credential irma.CredentialTypeIdentifier // only entries involving this credential type, if non-empty
+}
+
+// parseLogsQuery parses "[export <path>] [before <id>] [limit <n>] [type <type>] [credential <type>]".
+func parseLogsQuery(args string) (*logsQuery, error) {
+	query := &logsQuery{limit: defaultLogsLimit}
+	words := strings.Fields(args)
+	for i := 0; i < len(words); i += 2 {
+		if i+1 == len(words) {
+			return nil, fmt.Errorf("missing value after %s", words[i])
+		}
+		value := words[i+1]
+		switch words[i] {
+		case "export":
+			query.export = value
+		case "before":
+			before, err := strconv.ParseUint(value, 10, 64)
+			if err != nil || before == 0 {
+				return nil, fmt.Errorf("invalid log entry ID %q", value)
+			}
+			query.before = before
+		case "limit":
+			limit, err := strconv.Atoi(value)
+			if err != nil || limit <= 0 {
+				return nil, fmt.Errorf("invalid limit %q", value)
+			}
+			query.limit = limit
+		case "type":
+			action, ok := logTypes[value]
+			if !ok {
+				for _, known := range logTypes {
+					if value == string(known) {
+						action, ok = known, true
+					}
+				}
+			}
+			if !ok {
+				return nil, fmt.Errorf("unknown log type %q, expected issuance, disclosure, signature or removal", value)
+			}
+			query.action = action
+		case "credential":
+			query.credential = irma.NewCredentialTypeIdentifier(value)
+		default:
+			return nil, fmt.Errorf("unknown argument %q", words[i])
+		}
+	}
+	return query, nil
+}
+
+// loggedSession is a log entry as written by "logs export", holding everything needed to
+// analyse it without the client's storage.
+type loggedSession struct {
+	ID          uint64                                                    `json:"id"`
+	Type        irma.Action                                               `json:"type"`
+	Time        time.Time                                                 `json:"time"`
+	Server      string                                                    `json:"server,omitempty"`
+	Credentials []string                                                  `json:"credentials"`
+	Disclosed   [][]*irma.DisclosedAttribute                              `json:"disclosed,omitempty"`
+	Issued      irma.CredentialInfoList                                   `json:"issued,omitempty"`
+	Removed     map[irma.CredentialTypeIdentifier][]irma.TranslatedString `json:"removed,omitempty"`
+	Message     string                                                    `json:"message,omitempty"`
+	Error       string                                                    `json:"error,omitempty"`
+}
+
+// newLoggedSession extracts the contents of the log entry. Parts that cannot be extracted,
+// e.g. because the schemes no longer contain the credential types involved, are left out and
+// described in Error.
+func newLoggedSession(conf *irma.Configuration, entry *irmaclient.LogEntry) *loggedSession {
+	logged := &loggedSession{ID: entry.ID, Type: entry.Type, Time: time.Time(entry.Time).UTC(), Removed: entry.Removed}
+	if entry.ServerName != nil {
+		logged.Server = localised(entry.ServerName.Name, "en")
+	}
+	var errs []string
+	var err error
+	if logged.Disclosed, err = entry.GetDisclosedCredentials(conf); err != nil {
+		errs = append(errs, fmt.Sprintf("disclosed attributes: %v", err))
+	}
+	if logged.Issued, err = entry.GetIssuedCredentials(conf); err != nil {
+		errs = append(errs, fmt.Sprintf("issued credentials: %v", err))
+	}
+	if signed, err := entry.GetSignedMessage(); err != nil {
+		errs = append(errs, fmt.Sprintf("signed message: %v", err))
+	} else if signed != nil {
+		logged.Message = signed.Message
+	}
+	logged.Error = strings.Join(errs, "; ")
+
+	credentials := map[string]struct{}{}
+	for _, con := range logged.Disclosed {
+		for _, attr := range con {
+			credentials[attr.Identifier.CredentialTypeIdentifier().String()] = struct{}{}
+		}
+	}
+	for _, info := range logged.Issued {
+		credentials[info.Identifier().String()] = struct{}{}
+	}
+	for credtype := range logged.Removed {
+		credentials[credtype.String()] = struct{}{}
+	}
+	logged.Credentials = sortedKeys(credentials)
+	return logged
+}
+
+func (query *logsQuery) matches(logged *loggedSession) bool {
+	if query.action != "" && logged.Type != query.action {
+		return false
+	}
+	if query.credential.String() == "" {
+		return true
+	}
+	i := sort.SearchStrings(logged.Credentials, query.credential.String())
+	return i < len(logged.Credentials) && logged.Credentials[i] == query.credential.String()
+}
+
+// eachLogEntry calls fn for every log entry matching the query, from new to old, loading them
+// from storage a page at a time, until fn returns false. It returns whether more entries
+// matching the query remain after the one at which fn stopped, looking ahead for one.
+func eachLogEntry(client *irmaclient.Client, query *logsQuery, fn func(logged *loggedSession) bool) (bool, error) {
+	before := query.before
+	stopped := false
+	for {
+		var entries []*irmaclient.LogEntry
+		var err error
+		if before == 0 {
+			entries, err = client.LoadNewestLogs(logsPageSize)
+		} else {
+			entries, err = client.LoadLogsBefore(before, logsPageSize)
+		}
+		if err != nil {
+			return false, err
+		}
+		for _, entry := range entries {
+			logged := newLoggedSession(client.Configuration, entry)
+			if !query.matches(logged) {
+				continue
+			}
+			if stopped {
+				return true, nil
+			}
+			stopped = !fn(logged)
+		}
+		if len(entries) < logsPageSize {
+			return false, nil
+		}
+		before = entries[len(entries)-1].ID
+	}
+}
+
+func printLogs(client *irmaclient.Client, args string) {
+	query, err := parseLogsQuery(args)
+	if err != nil {
+		emit("logs-failed", "error", err)
+		return
+	}
+	if query.export != "" {
+		exportLogs(client, query)
+		return
+	}
+
+	count, last := 0, uint64(0)
+	more, err := eachLogEntry(client, query, func(logged *loggedSession) bool {
+		count++
+		last = logged.ID
+		fields := []interface{}{"id", logged.ID, "type", logged.Type, "time", logged.Time.Format(time.RFC3339),
+			"server", logged.Server, "credentials", strings.Join(logged.Credentials, ",")}
+		if logged.Error != "" {
+			fields = append(fields, "error", logged.Error)
+		}
+		emit("log-entry", fields...)
+		return count < query.limit
+	})
+	if err != nil {
+		emit("logs-failed", "error", err)
+		return
+	}
+	fields := []interface{}{"count", count, "more", more}
+	if more {
+		fields = append(fields, "next_before", last)
+	}
+	emit("logs-done", fields...)
+}
+
+// exportLogs writes all log entries matching the query to the file as JSON, one per line.
+func exportLogs(client *irmaclient.Client, query *logsQuery) {
+	f, err := os.Create(query.export)
+	if err != nil {
+		emit("logs-failed", "error", err)
+		return
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+
+	count := 0
+	var writeErr error
+	_, err = eachLogEntry(client, query, func(logged *loggedSession) bool {
+		if writeErr = encoder.Encode(logged); writeErr != nil {
+			return false
+		}
+		count++
+		return true
+	})
+	if err == nil {
+		err = writeErr
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		emit("logs-failed", "path", query.export, "error", err)
+		return
+	}
+	emit("logs-exported", "path", query.export, "entries", count)
+}
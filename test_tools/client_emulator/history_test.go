@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+)
+
+// storedLogs returns the number of session log entries in the storage.
+func storedLogs(t *testing.T, storage string) int {
+	t.Helper()
+	contents, err := readStorage(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contents.logs
+}
+
+func TestDisableHistory(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		storage := testStorage(t)
+		before := storedLogs(t, storage)
+		args := []string{"-storage", storage, "-config", testConfiguration(t), "-output-format", "json"}
+		if disabled {
+			args = append(args, "-disable-history")
+		}
+		stdout, stderr, code := runEmulator(t, studentIDRequest+"\nyes\n", true, args...)
+		if code != exitSuccess {
+			t.Fatalf("exit code %d\n%s%s", code, stdout, stderr)
+		}
+
+		after := storedLogs(t, storage)
+		switch {
+		case !disabled && after != before+1:
+			t.Errorf("history grew from %d to %d entries, want one entry for the session", before, after)
+		case disabled && after != 0:
+			t.Errorf("history has %d entries with -disable-history", after)
+		case disabled && len(eventsIn(stdout, "history-cleared")) != 1:
+			t.Errorf("history-cleared not emitted:\n%s", stdout)
+		}
+	}
+}
+
+func TestParseLogsQuery(t *testing.T) {
+	query, err := parseLogsQuery("")
+	if err != nil || *query != (logsQuery{limit: defaultLogsLimit}) {
+		t.Errorf("parsed no arguments as %+v, %v", query, err)
+	}
+	query, err = parseLogsQuery("export out.jsonl before 12 limit 3 type disclosure credential irma-demo.RU.studentCard")
+	want := logsQuery{export: "out.jsonl", before: 12, limit: 3, action: irma.ActionDisclosing,
+		credential: irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")}
+	if err != nil || *query != want {
+		t.Errorf("parsed %+v, %v, want %+v", query, err, want)
+	}
+	if query, err := parseLogsQuery("type issuing"); err != nil || query.action != irma.ActionIssuing {
+		t.Errorf("parsed a session action as %+v, %v", query, err)
+	}
+
+	for _, args := range []string{"limit", "limit 0", "limit -1", "before 0", "before x", "type unknown", "page 2"} {
+		if _, err := parseLogsQuery(args); err == nil {
+			t.Errorf("parsed %q without error", args)
+		}
+	}
+}
+
+func TestLogs(t *testing.T) {
+	log := captureEvents(t)
+	client, _ := newTestClient(t)
+	if result := runTestSession(t, client, studentIDRequest, "yes\n"); result.kind != outcomeSuccess {
+		t.Fatalf("session ended with %v", result)
+	}
+
+	// The session just performed is the newest entry
+	printLogs(client, "limit 1")
+	entries, done := log.named("log-entry"), log.named("logs-done")
+	if len(entries) != 1 || entries[0]["type"] != "disclosing" || entries[0]["credentials"] != "irma-demo.RU.studentCard" {
+		t.Fatalf("log-entry events %v", entries)
+	}
+	if len(done) != 1 || done[0]["count"] != 1.0 {
+		t.Fatalf("logs-done events %v", done)
+	}
+
+	// Paging on from there lists the remaining entries, and filtering leaves out the others
+	total := 1
+	if done[0]["more"] == true {
+		printLogs(client, fmt.Sprintf("limit 1000 before %.0f", done[0]["next_before"]))
+		total += int(log.named("logs-done")[1]["count"].(float64))
+	}
+	printLogs(client, "limit 1000 type removal")
+	for _, entry := range log.named("log-entry")[total:] {
+		if entry["type"] != "removal" {
+			t.Errorf("listed %v when filtering on removals", entry)
+		}
+	}
+
+	// more only reports older entries that match the query
+	printLogs(client, "limit 1000 type disclosing")
+	done = log.named("logs-done")
+	disclosures := int(done[len(done)-1]["count"].(float64))
+	printLogs(client, fmt.Sprintf("limit %d type disclosing", disclosures))
+	if done = log.named("logs-done"); done[len(done)-1]["more"] != false || done[len(done)-1]["next_before"] != nil {
+		t.Errorf("logs-done after listing all %d disclosures: %v", disclosures, done[len(done)-1])
+	}
+	if disclosures > 1 {
+		printLogs(client, fmt.Sprintf("limit %d type disclosing", disclosures-1))
+		if done = log.named("logs-done"); done[len(done)-1]["more"] != true {
+			t.Errorf("logs-done before the last of %d disclosures: %v", disclosures, done[len(done)-1])
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "logs.jsonl")
+	printLogs(client, "export "+path)
+	if exported := log.named("logs-exported"); len(exported) != 1 || exported[0]["entries"] != float64(total) {
+		t.Errorf("logs-exported events %v, want %d entries", exported, total)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	lines := 0
+	for scanner := bufio.NewScanner(f); scanner.Scan(); lines++ {
+		logged := loggedSession{}
+		if err := json.Unmarshal(scanner.Bytes(), &logged); err != nil {
+			t.Fatalf("exported %q: %v", scanner.Text(), err)
+		}
+		if lines == 0 && (logged.Type != irma.ActionDisclosing || len(logged.Disclosed) != 1) {
+			t.Errorf("exported %+v as the newest entry", logged)
+		}
+	}
+	if lines != total {
+		t.Errorf("exported %d lines, want %d", lines, total)
+	}
+
+	printLogs(client, "limit")
+	if failed := log.named("logs-failed"); len(failed) != 1 {
+		t.Errorf("logs-failed events %v", failed)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+)
+
+// keyshareRemove removes the keyshare enrollment of the given scheme manager, or of all
+// scheme managers when none is given, so that sessions requiring it can be tested.
+func keyshareRemove(client *irmaclient.Client, manager string) {
+	var removed []irma.SchemeManagerIdentifier
+	var err error
+	if manager == "" {
+		removed = client.EnrolledSchemeManagers()
+		err = client.KeyshareRemoveAll()
+	} else {
+		id := irma.NewSchemeManagerIdentifier(manager)
+		removed = []irma.SchemeManagerIdentifier{id}
+		err = client.KeyshareRemove(id)
+	}
+	if err != nil {
+		emit("keyshare-remove-failed", "manager", manager, "error", err)
+		return
+	}
+	emit("keyshare-removed", "removed", identifiers(removed), "enrolled", identifiers(client.EnrolledSchemeManagers()))
+}
+
+// enrollment is the result of a keyshare enrollment, as reported to the ClientHandler.
+type enrollment struct {
+	manager irma.SchemeManagerIdentifier
+	err     error
+}
+
+// enrollKeyshare performs the given enrollments, each of the form manager:pin[:email], one
+// after the other, reporting the result of each. It returns whether all of them succeeded.
+func enrollKeyshare(client *irmaclient.Client, handler *ClientHandler, specs []string) bool {
+	ok := true
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, ":", 3)
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			emit("enrollment-failed", "manager", parts[0], "error", fmt.Sprintf("expected manager:pin[:email], got %q", spec))
+			ok = false
+			continue
+		}
+		id := irma.NewSchemeManagerIdentifier(parts[0])
+		var email *string
+		if len(parts) == 3 && parts[2] != "" {
+			email = &parts[2]
+		}
+
+		ok = enroll(client, handler, id, email, parts[1]) && ok
+	}
+	return ok
+}
+
+// The maximum duration of a keyshare enrollment, after which it is reported as failed
+const enrollmentTimeout = time.Minute
+
+// enroll enrolls with the keyshare server of the scheme manager and waits at most
+// enrollmentTimeout for the result, which it emits. It returns whether the enrollment succeeded.
+func enroll(client *irmaclient.Client, handler *ClientHandler, manager irma.SchemeManagerIdentifier,
+	email *string, pin string) bool {
+	client.KeyshareEnroll(manager, email, pin, "en")
+	timeout := time.After(enrollmentTimeout)
+	var result enrollment
+	// Results of other scheme managers are of earlier enrollments that timed out
+	for result.manager != manager {
+		select {
+		case result = <-handler.enrollments:
+		case <-timeout:
+			emit("enrollment-failed", "manager", manager, "error", fmt.Sprintf("no result within %s", enrollmentTimeout))
+			return false
+		}
+	}
+	if result.err != nil {
+		emit("enrollment-failed", "manager", result.manager, "error", result.err)
+		return false
+	}
+	emit("enrolled", "manager", result.manager)
+	return true
+}
+
+// enrollWithServer enrolls with the keyshare server at the URL, using the PIN given with -pin
+// for the scheme manager using that server, and returns the exit code reflecting the result.
+func enrollWithServer(client *irmaclient.Client, handler *ClientHandler, url string, email string, pins *pinSupplier) int {
+	var manager *irma.SchemeManager
+	for _, candidate := range client.Configuration.SchemeManagers {
+		if strings.TrimSuffix(candidate.KeyshareServer, "/") == strings.TrimSuffix(url, "/") {
+			manager = candidate
+		}
+	}
+	if manager == nil {
+		fmt.Fprintf(os.Stderr, "No scheme manager uses keyshare server %s\n", url)
+		return exitStartup
+	}
+	id := manager.Identifier()
+	pin := pins.pinFor([]irma.SchemeManagerIdentifier{id})
+	if pin == "" {
+		fmt.Fprintln(os.Stderr, "Enrolling requires a PIN, given with -pin")
+		return exitStartup
+	}
+
+	var emailAddress *string
+	if email != "" {
+		emailAddress = &email
+	}
+	if !enroll(client, handler, id, emailAddress, pin) {
+		return exitFailure
+	}
+	return exitSuccess
+}
+
+// printEnrollmentStatus emits for every scheme manager using a keyshare server whether the
+// client is enrolled with it.
+func printEnrollmentStatus(client *irmaclient.Client) {
+	enrolled := map[irma.SchemeManagerIdentifier]bool{}
+	for _, id := range client.EnrolledSchemeManagers() {
+		enrolled[id] = true
+	}
+	ids := []string{}
+	for id, manager := range client.Configuration.SchemeManagers {
+		if manager.Distributed() {
+			ids = append(ids, id.String())
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		emit("keyshare-status", "manager", id, "enrolled", enrolled[irma.NewSchemeManagerIdentifier(id)])
+	}
+}
+
+// pinChange is the result of a keyshare PIN change, as reported to the ClientHandler.
+type pinChange struct {
+	manager  irma.SchemeManagerIdentifier
+	result   string // success, failure, incorrect or blocked
+	err      error
+	attempts int // remaining attempts, when incorrect
+	timeout  int // seconds blocked, when blocked
+}
+
+// The maximum duration of a keyshare PIN change, after which it is reported as failed
+var pinChangeTimeout = time.Minute
+
+// awaitPinChange waits at most pinChangeTimeout for the result of a PIN change of the scheme
+// manager, returning whether it arrived. If not, it emits why.
+func awaitPinChange(handler *ClientHandler, manager irma.SchemeManagerIdentifier, interrupted <-chan struct{}) (pinChange, bool) {
+	select {
+	case change := <-handler.pinChanges:
+		return change, true
+	case <-time.After(pinChangeTimeout):
+		emit("pin-change-failed", "manager", manager, "error", fmt.Sprintf("no result within %s", pinChangeTimeout))
+	case <-interrupted:
+		emit("pin-change-interrupted", "manager", manager)
+	}
+	return pinChange{}, false
+}
+
+// changePin changes the keyshare PIN of the scheme manager, given as manager:old:new, and
+// returns the exit code reflecting the result. With -wait-blocked, a change that the keyshare
+// server blocks is tried again once the block has ended, reporting the outcome of the recovery.
+// Waiting for the block to end or for a result stops once interrupted is closed.
+func changePin(client *irmaclient.Client, handler *ClientHandler, spec string, interrupted <-chan struct{}) int {
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) != 3 || parts[0] == "" {
+		fmt.Fprintf(os.Stderr, "Expected manager:oldpin:newpin, got %q\n", spec)
+		return exitStartup
+	}
+
+	manager := irma.NewSchemeManagerIdentifier(parts[0])
+	client.KeyshareChangePin(manager, parts[1], parts[2])
+	change, ok := awaitPinChange(handler, manager, interrupted)
+	if !ok {
+		return exitFailure
+	}
+	for blocks := 1; change.result == "blocked" && *waitBlocked && change.timeout > 0; blocks++ {
+		emit("pin-change-blocked", "manager", change.manager, "duration", change.timeout, "waiting", true)
+		select {
+		case <-time.After(time.Duration(change.timeout) * time.Second):
+		case <-interrupted:
+			emit("pin-change-interrupted", "manager", change.manager)
+			return exitFailure
+		}
+		client.KeyshareChangePin(change.manager, parts[1], parts[2])
+		if change, ok = awaitPinChange(handler, manager, interrupted); !ok {
+			return exitFailure
+		}
+		emit("pin-change-recovery", "manager", change.manager, "result", change.result, "blocks", blocks)
+	}
+	switch change.result {
+	case "success":
+		emit("pin-changed", "manager", change.manager)
+		return exitSuccess
+	case "incorrect":
+		emit("pin-change-incorrect", "manager", change.manager, "remaining_attempts", change.attempts)
+	case "blocked":
+		emit("pin-change-blocked", "manager", change.manager, "duration", change.timeout)
+		return exitBlocked
+	default:
+		emit("pin-change-failed", "manager", change.manager, "error", change.err)
+	}
+	return exitFailure
+}
+
+// keyshareRekey would regenerate the client's share of the keyshare secret for the scheme
+// manager. The keyshare protocol binds the client's secret key to its enrollment and irmaclient
+// does not expose it, so this is not possible without enrolling again; this only reports so.
+func keyshareRekey(client *irmaclient.Client, manager string) {
+	if !client.Preferences.DeveloperMode {
+		emit("keyshare-rekey-unsupported", "manager", manager, "reason", "only available in developer mode")
+		return
+	}
+	emit("keyshare-rekey-unsupported", "manager", manager,
+		"reason", "irmaclient cannot regenerate keyshare secrets without enrolling again; use keyshare-remove and -enroll")
+}
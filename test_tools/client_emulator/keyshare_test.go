@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+)
+
+// The address of the keyshare server of the test scheme in irmago's testdata
+const testKeyshareAddr = "localhost:8080"
+
+// mockKeyshareServer serves the handler at the address of the keyshare server of the test
+// scheme for the duration of the test, skipping the test if that address is taken.
+func mockKeyshareServer(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+	listener, err := net.Listen("tcp", testKeyshareAddr)
+	if err != nil {
+		t.Skipf("cannot listen on %s for the test keyshare server: %v", testKeyshareAddr, err)
+	}
+	server := httptest.NewUnstartedServer(handler)
+	server.Listener.Close()
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+}
+
+// newDeveloperClient is like newTestClient, but enables developer mode so that the client
+// accepts the plain HTTP of the mock keyshare server.
+func newDeveloperClient(t *testing.T) (*irmaclient.Client, *ClientHandler) {
+	t.Helper()
+	client, handler := newTestClient(t)
+	client.SetPreferences(irmaclient.Preferences{DeveloperMode: true})
+	return client, handler
+}
+
+func TestChangePin(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   irma.KeysharePinStatus
+		code     int
+		event    string
+		field    string
+		expected interface{}
+	}{
+		{"success", irma.KeysharePinStatus{Status: "success"}, exitSuccess, "pin-changed", "manager", "test"},
+		{"incorrect", irma.KeysharePinStatus{Status: "failure", Message: "2"}, exitFailure, "pin-change-incorrect", "remaining_attempts", float64(2)},
+		{"blocked", irma.KeysharePinStatus{Status: "error", Message: "60"}, exitBlocked, "pin-change-blocked", "duration", float64(60)},
+		{"unknown response", irma.KeysharePinStatus{Status: "unknown"}, exitFailure, "pin-change-failed", "manager", "test"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			log := captureEvents(t)
+			var changes int32
+			mockKeyshareServer(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/irma_keyshare_server/api/v1/users/change/pin" {
+					http.NotFound(w, r)
+					return
+				}
+				atomic.AddInt32(&changes, 1)
+				_ = json.NewEncoder(w).Encode(test.status)
+			})
+			client, handler := newDeveloperClient(t)
+
+			if code := changePin(client, handler, "test:12345:54321", nil); code != test.code {
+				t.Errorf("exit code %d, want %d\n%s", code, test.code, log)
+			}
+			if changes := atomic.LoadInt32(&changes); changes != 1 {
+				t.Errorf("%d PIN changes sent", changes)
+			}
+			if events := log.named(test.event); len(events) != 1 || events[0][test.field] != test.expected {
+				t.Errorf("%s events %v\n%s", test.event, events, log)
+			}
+		})
+	}
+}
+
+func TestChangePinTimeout(t *testing.T) {
+	log := captureEvents(t)
+	old := pinChangeTimeout
+	pinChangeTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { pinChangeTimeout = old })
+	unblock := make(chan struct{})
+	mockKeyshareServer(t, func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	})
+	t.Cleanup(func() { close(unblock) })
+	client, handler := newDeveloperClient(t)
+
+	if code := changePin(client, handler, "test:12345:54321", nil); code != exitFailure {
+		t.Errorf("exit code %d, want %d\n%s", code, exitFailure, log)
+	}
+	if failed := log.named("pin-change-failed"); len(failed) != 1 || failed[0]["error"] != "no result within 100ms" {
+		t.Errorf("pin-change-failed events %v\n%s", failed, log)
+	}
+}
+
+func TestChangePinInterrupted(t *testing.T) {
+	setFlag(t, "wait-blocked", "true")
+	for name, blocked := range map[string]bool{"waiting for the block to end": true, "waiting for the result": false} {
+		t.Run(name, func(t *testing.T) {
+			log := captureEvents(t)
+			var changes int32
+			unblock := make(chan struct{})
+			mockKeyshareServer(t, func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&changes, 1)
+				if !blocked {
+					<-unblock
+				}
+				_ = json.NewEncoder(w).Encode(irma.KeysharePinStatus{Status: "error", Message: "60"})
+			})
+			t.Cleanup(func() { close(unblock) })
+			client, handler := newDeveloperClient(t)
+
+			interrupted := make(chan struct{})
+			time.AfterFunc(100*time.Millisecond, func() { close(interrupted) })
+			if code := changePin(client, handler, "test:12345:54321", interrupted); code != exitFailure {
+				t.Errorf("exit code %d, want %d\n%s", code, exitFailure, log)
+			}
+			if changes := atomic.LoadInt32(&changes); changes != 1 {
+				t.Errorf("%d PIN changes sent", changes)
+			}
+			waited := len(log.named("pin-change-blocked")) == 1
+			if len(log.named("pin-change-interrupted")) != 1 || waited != blocked {
+				t.Errorf("interrupted PIN change emitted\n%s", log)
+			}
+		})
+	}
+}
+
+func TestChangePinMalformed(t *testing.T) {
+	client, handler := newTestClient(t)
+	if code := changePin(client, handler, "test:12345", nil); code != exitStartup {
+		t.Errorf("exit code %d, want %d", code, exitStartup)
+	}
+}
+
+func TestEnrollFailure(t *testing.T) {
+	log := captureEvents(t)
+	mockKeyshareServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/irma_keyshare_server/api/v1/client/register" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(irma.RemoteError{Status: http.StatusInternalServerError, ErrorName: "EMAIL_TAKEN"})
+	})
+	client, handler := newDeveloperClient(t)
+	// A result for another scheme manager, as left by an earlier enrollment that timed out
+	handler.enrollments <- enrollment{manager: irma.NewSchemeManagerIdentifier("irma-demo")}
+
+	email := "test@example.com"
+	if enroll(client, handler, irma.NewSchemeManagerIdentifier("test"), &email, "12345") {
+		t.Fatalf("enrollment succeeded\n%s", log)
+	}
+	if failed := log.named("enrollment-failed"); len(failed) != 1 || failed[0]["manager"] != "test" {
+		t.Errorf("enrollment-failed events %v", failed)
+	}
+	if enrolled := log.named("enrolled"); len(enrolled) != 0 {
+		t.Errorf("the result of the other scheme manager was reported: %v", enrolled)
+	}
+}
+
+func TestEnrollWithServer(t *testing.T) {
+	client, handler := newTestClient(t)
+	pins, _ := newPinSupplier("", 0)
+	if code := enrollWithServer(client, handler, "https://example.com/keyshare", "", pins); code != exitStartup {
+		t.Errorf("unknown keyshare server gave exit code %d", code)
+	}
+	url := "http://localhost:8080/irma_keyshare_server/api/v1/"
+	if code := enrollWithServer(client, handler, url, "", pins); code != exitStartup {
+		t.Errorf("enrolling without a PIN gave exit code %d", code)
+	}
+}
+
+func TestEnrollKeyshareMalformed(t *testing.T) {
+	log := captureEvents(t)
+	client, handler := newTestClient(t)
+	if enrollKeyshare(client, handler, []string{"test"}) {
+		t.Error("enrollment without a PIN succeeded")
+	}
+	if failed := log.named("enrollment-failed"); len(failed) != 1 {
+		t.Errorf("enrollment-failed events %v", failed)
+	}
+}
+
+func TestKeyshareRemove(t *testing.T) {
+	log := captureEvents(t)
+	client, _ := newTestClient(t)
+
+	keyshareRemove(client, "test")
+	if removed := log.named("keyshare-removed"); len(removed) != 1 || removed[0]["removed"] != "test" || removed[0]["enrolled"] != "" {
+		t.Errorf("keyshare-removed events %v", removed)
+	}
+	if enrolled := client.EnrolledSchemeManagers(); len(enrolled) != 0 {
+		t.Errorf("still enrolled at %v", enrolled)
+	}
+}
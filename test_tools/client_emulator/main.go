@@ -1,136 +1,836 @@
 package main
 
 import (
-	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/privacybydesign/gabi/big"
 	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/irmaclient"
 )
 
+var (
+	storagePath = flag.String("storage", "temp_testing/client", "directory in which the client stores its state")
+	configPath  = flag.String("config", "temp_testing/irma_configuration", "irma_configuration directory containing the schemes")
+
+	rejectIfMissingCredentials = flag.Bool("reject-if-missing-credentials", false,
+		"cancel unsatisfiable sessions, printing which credential types are missing")
+	sessionTimeout = flag.Duration("timeout", 0,
+		"dismiss the session if it has not finished within this duration (0 disables the timeout)")
+	candidateTimeout = flag.Duration("candidate-timeout", 0,
+		"cancel the session if the permission prompt is not answered within this duration (0 disables the timeout)")
+	decisionTimeout = flag.Duration("decision-timeout", 0,
+		"cancel the session if a permission or PIN prompt is not answered within this duration (0 disables the timeout)")
+	serverStatus  = flag.Bool("server-status", false, "poll the status of the session at the server, emitting server-status when it changes")
+	waitForClient = flag.Bool("wait-for-client", false, "only prompt for permission once the session has reported the connected status")
+	resultURL     = flag.String("result-url", "", "URL serving the session result, polled after a successful session when -result-timeout is set")
+	resultTimeout = flag.Duration("result-timeout", 0,
+		"after a successful session, wait at most this long for -result-url to serve a non-empty result (0 disables waiting)")
+	statusPollInterval = flag.Duration("status-poll-interval", 500*time.Millisecond,
+		"interval at which the status of the session at the server is polled, with -server-status and after a cancellation")
+	clientLogFile   = flag.String("client-log-file", "", "file to which irmaclient's own log output is appended instead of stderr")
+	outputFormat    = flag.String("output-format", "text", "format of emitted events: text (event key=value ...) or json")
+	jsonCommands    = flag.Bool("json-commands", false, "read commands from stdin as JSON objects, one per line (e.g. {\"cmd\":\"pin\",\"value\":\"12345\"})")
+	eventsStderr    = flag.Bool("events-stderr", false, "write events to stderr, leaving only the session result of -print-result on stdout")
+	memoryProfile   = flag.String("memory-profile-output", "", "file to which a heap profile is written once all sessions have finished")
+	disableHistory  = flag.Bool("disable-history", false, "remove the session history from storage once all sessions have finished")
+	logRequestor    = flag.Bool("log-requestor-info", false, "log the requestor's name, logo URL and hostnames to stderr when asked for permission")
+	logCallbacks    = flag.Bool("log-callbacks", false, "log every session handler callback to stderr")
+	recordChoices   = flag.String("record-choices", "", "file to which every disclosure choice is appended as a JSON object, one per line")
+	showResult      = flag.Bool("print-result", false, "print the attributes disclosed during a successful session as a JSON object")
+	resultPretty    = flag.Bool("result-pretty", false, "print the session result as indented JSON, with -output-format text")
+	metrics         = flag.Bool("metrics", false, "emit session timing metrics once the session has finished")
+	assertCallbacks = flag.Bool("assert-callbacks", false, "emit an event when irmaclient violates the session handler contract")
+	// Developer mode is enabled unless explicitly disabled, for backwards compatibility
+	noDeveloperMode = flag.Bool("no-developer-mode", false,
+		"do not enable developer mode (which is otherwise enabled by default), keeping the stored preferences")
+	retries            = flag.Int("retries", 0, "number of times to restart a session that failed with one of the failures selected by -retry-on")
+	retryOn            = flag.String("retry-on", "transient", "failures after which -retries restarts a session: transient, or transport for network errors only")
+	retryBackoff       = flag.Duration("retry-backoff", time.Second, "time to wait before retrying a failed session")
+	autoUpdateInterval = flag.Duration("auto-update-interval", 0,
+		"update the schemes in the background at this interval (0 disables background updates)")
+	configReload = flag.Bool("irma-config-reload", false,
+		"update the schemes in the background whenever the emulator receives SIGHUP")
+	autoDemoScheme = flag.String("auto-demo-scheme", "",
+		"PEM file with the public key of the irma-demo scheme, which is installed and verified against it when the configuration contains no schemes")
+	autoPbdfScheme = flag.String("auto-pbdf-scheme", "",
+		"PEM file with the public key of the pbdf scheme, which is installed and verified against it when the configuration contains no schemes")
+	trustedSchemes = flag.String("trusted-schemes", "",
+		"JSON file listing schemes ({\"id\", \"url\", \"public_key\"}) to install or check using only the given public key")
+	preloadRevocation = flag.Bool("preload-revocation", false,
+		"before the first session, update the nonrevocation witnesses of all stored credentials that support revocation; "+
+			"-batch and -parallel sessions share the client, so this is done once for all of them")
+	updateAtStartup = flag.Bool("update-schemes", false, "update all schemes before reading the session pointer")
+	updateTimeout   = flag.Duration("update-schemes-timeout", 30*time.Second, "maximum duration of the -update-schemes update")
+	listManagers    = flag.Bool("scheme-manager-list", false, "only list the scheme managers in the -config directory, then exit")
+	listCredTypes   = flag.Bool("credential-type-list", false, "only list the credential types in the -config directory, then exit")
+	listAttrTypes   = flag.String("attribute-type-list", "", "only list the attribute types of this credential type, then exit")
+	attributeLocale = flag.String("attribute-locale", "en", "language (e.g. en, nl) in which attribute type names and descriptions are printed")
+	benchmarkRuns   = flag.Int("benchmark-startup", 0, "only time starting the client this many times, then exit")
+	benchmarkCopy   = flag.Bool("benchmark-copy-schemes", false,
+		"remove the client's copy of the schemes before every -benchmark-startup run, so that every run includes copying them from -config into the storage")
+
+	attributeSubset = flag.String("attribute-subset", "",
+		"comma-separated attribute types; only chosen attributes of these types are disclosed")
+	verifySignatures = flag.Bool("verify-signatures", false,
+		"after issuance, verify the issuer signature on each received credential by disclosing it to ourselves")
+	fakeNow = flag.String("fake-now", "",
+		"RFC 3339 time against which the emulator classifies credentials as expired; irmaclient's own checks, "+
+			"such as whether a credential can still be disclosed, keep using the real time")
+	fixedNow = flag.String("now", "",
+		"developer mode only: RFC 3339 time treated as now, like -fake-now; irmaclient's own checks keep using the real time")
+	deviceSecret = flag.String("device-secret", "",
+		"developer mode only: device secret (decimal, or hexadecimal prefixed with 0x) stored before the client starts, "+
+			"replacing the generated one; anyone knowing it can use the credentials issued to this storage, so never use it outside tests")
+	onRevoked = flag.String("on-revoked", "continue",
+		"continue: only report credentials found to be revoked; abort: then dismiss all sessions and exit with code 9")
+	pairing           = flag.String("pairing", "accept", "accept: wait while the frontend is paired when the server requires it; disabled: fail such sessions")
+	issueKeyCounter   = flag.Int("issue-key-counter", -1, "cancel issuance sessions whose credentials are not issued against this issuer public key counter")
+	requireVerified   = flag.Bool("require-verified", false, "cancel sessions from requestors that are not verified by a requestor scheme")
+	unsatisfiableWait = flag.Duration("unsatisfiable-wait", 0,
+		"wait at most this long for an unsatisfiable request to become satisfiable before cancelling it (0 disables waiting)")
+	maxDisclose     = flag.Int("max-disclose", 0, "cancel requests asking for more than this many attributes in total (0 means unlimited)")
+	discloseNothing = flag.Bool("disclose-nothing", false,
+		"when every disjunction of a request is optional, skip all of them and disclose nothing")
+
+	keyshareServerURL = flag.String("keyshare-server-url", "",
+		"only enroll with the keyshare server at this URL using the PIN given with -pin, then exit")
+	enrollEmail   = flag.String("email", "", "email address to register with -keyshare-server-url")
+	pinChangeSpec = flag.String("pin-change", "", "<manager>:<oldpin>:<newpin>; only change the keyshare PIN, then exit")
+	waitBlocked   = flag.Bool("wait-blocked", false, "when the keyshare server blocks the -pin-change, wait until the block ends and try again")
+	pin           = flag.String("pin", "",
+		"PIN to supply when the keyshare server asks for it, or manager=pin pairs separated by commas (read from stdin when not set)")
+	wrongPinAttempts = flag.Int("wrong-pin-attempts", 0, "number of deliberately incorrect PINs to supply before supplying -pin")
+
+	pointerFile    = flag.String("pointer-file", "", "file from which the first session pointer is read instead of stdin")
+	pointerURL     = flag.String("pointer-url", "", "URL from which the first session pointer is fetched instead of reading it from stdin")
+	batchFile      = flag.String("batch", "", "JSONL file of session pointers to perform one by one (or -parallel at a time), accepting all permission requests")
+	batchOut       = flag.String("batch-out", "", "JSONL file to which the result of every -batch line is written, followed by a summary")
+	requestorURL   = flag.String("requestor-url", "", "URL of an irma server at which the emulator starts the -request session itself, as requestor")
+	requestFile    = flag.String("request", "", "file with the session request to start with -requestor-url")
+	requestorToken = flag.String("requestor-token", "", "value of the Authorization header when starting the -requestor-url session")
+	printQR        = flag.Bool("print-qr", false, "print the session pointer and links of the -requestor-url session to stderr")
+	externalClient = flag.Bool("external-client", false,
+		"do not perform the -requestor-url session, but wait for another client to finish it")
+	externalTimeout = flag.Duration("external-timeout", 5*time.Minute, "maximum duration of the -external-client wait")
+	credentialCount = flag.Int("credential-count-assert", -1,
+		"once all sessions have finished, fail unless the storage holds exactly this many credentials")
+	maxSessionCount = flag.Int("max-session-count", 1,
+		"number of successful sessions after which the emulator exits; after each one the next session pointer is read from stdin")
+	parallel   = flag.Int("parallel", 1, "number of sessions to run concurrently; commands for a session are prefixed with its number")
+	bestEffort = flag.Bool("best-effort", false, "with -parallel, exit successfully even if some sessions did not succeed")
+	listenAddr = flag.String("listen", "", "address on which GET /sessions lists the sessions in progress as JSON, GET /events streams their status as server-sent events, and GET /metrics serves Prometheus metrics")
+	once       = flag.Bool("once", false, "handle exactly one session and exit, regardless of -max-session-count")
+
+	allowedTypes      stringList
+	attributeRenames  = stringMap{}
+	exportCredentials = stringMap{}
+	preferenceValues  = stringMap{}
+	importCredentials stringList
+	enrollments       stringList
+	installSchemes    stringList
+	tofuSchemes       stringList
+)
+
+// The number of sessions that finished successfully so far
+var completedSessions int64
+
+// The number of sessions that finished so far, and of those that were cancelled, for the exit event
+var finishedSessions, cancelledSessions int64
+
+// Set with -record-choices
+var choiceRecorder *DisclosureChoiceRecorder
+
+func init() {
+	flag.Var(&allowedTypes, "allow-type",
+		"credential type that may be disclosed (repeatable); disclosure and signature requests asking for any other type are cancelled")
+	flag.Var(attributeRenames, "attribute-rename",
+		"<irma.type>=<friendly-name> renaming an attribute in the printed result (repeatable)")
+	flag.Var(exportCredentials, "export-credential",
+		"<credType>=<file> to which the stored credential is exported as JSON after a successful session (repeatable)")
+	flag.Var(preferenceValues, "pref",
+		"<name>=<value> setting a field of the client's preferences, e.g. DeveloperMode=false (repeatable)")
+	flag.Var(&installSchemes, "install-scheme",
+		"<url>=<pubkeyfile> scheme to download and install before the session starts, verified against the PEM public key in the file (repeatable)")
+	flag.Var(&tofuSchemes, "install-scheme-tofu",
+		"URL of a scheme to download and install before the session starts, trusting whatever public key is found there (repeatable)")
+	flag.Var(&enrollments, "enroll",
+		"<manager>:<pin>[:<email>] keyshare enrollment to perform before the session starts (repeatable)")
+	flag.Var(&importCredentials, "import-credential",
+		"file with a credential exported by -export-credential to add to the storage before the client starts (repeatable); "+
+			"it can only be disclosed if the storage has the device secret it was issued against, see -device-secret")
+}
+
+const (
+	exitSuccess    = 0
+	exitFailure    = 1
+	exitDismissed  = 3
+	exitStartup    = 4
+	exitBlocked    = 5
+	exitUnenrolled = 6
+	exitScheme     = 7
+	exitUndecided  = 8
+	exitRevoked    = 9
+)
+
 type ClientHandler struct {
+	// Receives the result of keyshare enrollments started with -enroll
+	enrollments chan enrollment
+	// Receives the result of a PIN change started with -pin-change
+	pinChanges chan pinChange
+	// Closed when a credential is revoked with -on-revoked abort
+	aborted   chan struct{}
+	abortOnce sync.Once
+}
+
+func (h *ClientHandler) EnrollmentFailure(manager irma.SchemeManagerIdentifier, err error) {
+	if h.enrollments == nil {
+		panic("Unexpected call to EnrollmentFailure")
+	}
+	h.enrollments <- enrollment{manager, err}
 }
 
-func (_ *ClientHandler) EnrollmentFailure(manager irma.SchemeManagerIdentifier, err error) {
-	panic("Unexpected call to EnrollmentFailure")
+func (h *ClientHandler) EnrollmentSuccess(manager irma.SchemeManagerIdentifier) {
+	if h.enrollments == nil {
+		panic("Unexpected call to EnrollmentSuccess")
+	}
+	h.enrollments <- enrollment{manager, nil}
 }
 
-func (_ *ClientHandler) EnrollmentSuccess(manager irma.SchemeManagerIdentifier) {
-	panic("Unexpected call to EnrollmentSuccess")
+func (h *ClientHandler) changedPin(change pinChange) {
+	if h.pinChanges == nil {
+		panic("Unexpected call to ChangePin callback")
+	}
+	h.pinChanges <- change
 }
 
-func (_ *ClientHandler) ChangePinFailure(manager irma.SchemeManagerIdentifier, err error) {
-	panic("Unexpected call to ChangePinFailure")
+func (h *ClientHandler) ChangePinFailure(manager irma.SchemeManagerIdentifier, err error) {
+	h.changedPin(pinChange{manager: manager, result: "failure", err: err})
 }
 
-func (_ *ClientHandler) ChangePinSuccess(manager irma.SchemeManagerIdentifier) {
-	panic("Unexpected call to ChangePinSuccess")
+func (h *ClientHandler) ChangePinSuccess(manager irma.SchemeManagerIdentifier) {
+	h.changedPin(pinChange{manager: manager, result: "success"})
 }
 
-func (_ *ClientHandler) ChangePinIncorrect(manager irma.SchemeManagerIdentifier, attempts int) {
-	panic("Unexpected call to ChangePinIncorrect")
+func (h *ClientHandler) ChangePinIncorrect(manager irma.SchemeManagerIdentifier, attempts int) {
+	h.changedPin(pinChange{manager: manager, result: "incorrect", attempts: attempts})
 }
 
-func (_ *ClientHandler) ChangePinBlocked(manager irma.SchemeManagerIdentifier, timeout int) {
-	panic("Unexpected call to ChangePinBlocked")
+func (h *ClientHandler) ChangePinBlocked(manager irma.SchemeManagerIdentifier, timeout int) {
+	h.changedPin(pinChange{manager: manager, result: "blocked", timeout: timeout})
 }
 
 func (_ *ClientHandler) UpdateConfiguration(new *irma.IrmaIdentifierSet) {
-	panic("Unexpected call to UpdateConfiguration")
+	emit("config-updated",
+		"scheme_managers", identifiers(new.SchemeManagers),
+		"requestor_schemes", identifiers(new.RequestorSchemes),
+		"issuers", identifiers(new.Issuers),
+		"public_keys", identifiers(new.PublicKeys),
+		"credential_types", identifiers(new.CredentialTypes),
+		"attribute_types", identifiers(new.AttributeTypes),
+	)
 }
 
 func (_ *ClientHandler) UpdateAttributes() {
-	fmt.Println("Received new credential")
+	// The plain line predates the events, and does not fit in JSON output
+	if *outputFormat == "json" {
+		emit("credential-received")
+	} else {
+		fmt.Fprintln(events, "Received new credential")
+	}
+	wallet.notify()
+}
+
+// Revoked is called when updating the nonrevocation witness of a stored credential shows
+// that it was revoked, during a session or the revocation-status command. With -on-revoked
+// abort this stops all sessions, after which the emulator exits with exitRevoked.
+func (h *ClientHandler) Revoked(cred *irma.CredentialIdentifier) {
+	emit("credential-revoked", "type", cred.Type, "hash", cred.Hash, "at", time.Now().UTC().Format(time.RFC3339Nano))
+	if *onRevoked == "abort" {
+		h.abortOnce.Do(func() {
+			emit("revocation-abort", "type", cred.Type, "hash", cred.Hash)
+			close(h.aborted)
+		})
+	}
 }
 
-func (_ *ClientHandler) Revoked(cred *irma.CredentialIdentifier) {
-	panic("Unexpected call to Revoked")
+// exitCode returns exitRevoked if a revocation aborted the emulator, and code otherwise.
+func (h *ClientHandler) exitCode(code int) int {
+	select {
+	case <-h.aborted:
+		return exitRevoked
+	default:
+		return code
+	}
 }
 
+// ReportError is called with errors of irmaclient's background jobs, such as updating the
+// nonrevocation witnesses, which do not belong to any session.
 func (_ *ClientHandler) ReportError(err error) {
-	panic("Unexpected call to ReportError")
+	emit("client-error", "error", err)
+}
+
+type outcomeKind string
+
+const (
+	outcomeSuccess   outcomeKind = "success"
+	outcomeCancelled outcomeKind = "cancelled"
+	outcomeFailure   outcomeKind = "failure"
+	outcomeDismissed outcomeKind = "dismissed"
+	outcomeBlocked   outcomeKind = "blocked"
+	// The session requires a keyshare enrollment that the client does not have
+	outcomeEnrollmentMissing outcomeKind = "enrollment-missing"
+	// The keyshare server no longer knows the client's enrollment
+	outcomeEnrollmentDeleted outcomeKind = "enrollment-deleted"
+	// The client's registration at the keyshare server was never completed
+	outcomeEnrollmentIncomplete outcomeKind = "enrollment-incomplete"
+	// A prompt was not answered within -decision-timeout
+	outcomeDecisionTimeout outcomeKind = "decision-timeout"
+)
+
+// outcome describes how a session ended; exactly one is reported per session.
+type outcome struct {
+	kind   outcomeKind
+	result string
+	err    *irma.SessionError
+	// The attributes disclosed in a successful session, by attribute type
+	disclosed map[string]string
+	// The session ended because the PIN prompt was aborted, so it may be resumed
+	pinAborted bool
+	// From reading the session pointer until the session and everything following it finished
+	duration time.Duration
+}
+
+func (o outcome) exitCode() int {
+	switch o.kind {
+	case outcomeFailure:
+		return exitFailure
+	case outcomeDismissed:
+		return exitDismissed
+	case outcomeBlocked:
+		return exitBlocked
+	case outcomeEnrollmentMissing, outcomeEnrollmentDeleted, outcomeEnrollmentIncomplete:
+		return exitUnenrolled
+	case outcomeDecisionTimeout:
+		return exitUndecided
+	default:
+		return exitSuccess
+	}
 }
 
 type SessionHandler struct {
-	completion chan<- struct{}
-	reader     *bufio.Reader
+	// Identifies the session in events and commands when sessions run in parallel, otherwise 0
+	id int
+	// Unique for every session attempt, to correlate output with sessions; see runSession
+	correlationID string
+
+	completion chan outcome
+	once       sync.Once
+	commands   *dispatcher
+	pins       *pinSupplier
+	// Used to find out which keyshare servers a PIN is requested for
+	configuration *irma.Configuration
+	// Used to read the disclosed values from the stored credentials and to re-evaluate the
+	// candidates with -unsatisfiable-wait
+	client *irmaclient.Client
+
+	mutex     sync.Mutex
+	action    irma.Action
+	status    irma.ClientStatus
+	history   []irma.ClientStatus // all statuses reported so far, in order
+	changed   chan struct{}       // closed and replaced when the status changes or the session finishes
+	finished  bool
+	disclosed map[string]string
+	keyshare  []irma.SchemeManagerIdentifier
+	issued    []irma.CredentialTypeIdentifier
+	// Whether we cancelled the session ourselves, as opposed to the server or requestor
+	declined   bool
+	pinAborted bool
+	// Whether a prompt was not answered within -decision-timeout
+	undecided bool
+	// Whether reading stdin failed while waiting for the permission prompt
+	stdinFailed bool
+	// Whether the server required the frontend to be paired before continuing
+	pairingRequired bool
+
+	// When set, the session is only used to check whether the request can be satisfied,
+	// after which it is cancelled without disclosing anything
+	canSatisfy bool
+	// When set, the session is only used to list the issuer public keys it requires and
+	// which of them are missing, after which it is cancelled
+	checkKeys bool
+	// When set, the session must be a signature session over the contents of this file
+	signFile *signedFile
+	// The session pointer or manual session request the session was started from
+	pointer string
 }
 
-func (_ *SessionHandler) StatusUpdate(action irma.Action, status irma.ClientStatus) {
-	fmt.Println(status)
+func newSessionHandler(commands *dispatcher, pins *pinSupplier) *SessionHandler {
+	// Buffered, so that reporting the outcome never blocks irmaclient, even when it
+	// happens synchronously from within NewSession
+	s := &SessionHandler{
+		completion: make(chan outcome, 1),
+		commands:   commands,
+		pins:       pins,
+		disclosed:  map[string]string{},
+		changed:    make(chan struct{}),
+	}
+	commands.setStatus(func() []interface{} {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		return []interface{}{"session", s.status, "completed", atomic.LoadInt64(&completedSessions)}
+	})
+	return s
 }
 
-func (_ *SessionHandler) ClientReturnURLSet(clientReturnURL string) {
-	panic("Unexpected call to ClientReturnURLSet")
+// finish reports the outcome of the session. Only the first outcome is kept, later
+// ones (e.g. the Cancelled call following a dismissal) are ignored.
+func (s *SessionHandler) finish(o outcome) {
+	s.once.Do(func() {
+		s.mutex.Lock()
+		s.finished = true
+		s.notify()
+		s.mutex.Unlock()
+		s.completion <- o
+	})
 }
 
-func (_ *SessionHandler) PairingRequired(pairingCode string) {
-	panic("Unexpected call to PairingRequired")
+// notify wakes up everyone waiting for the status to change. The mutex must be held.
+func (s *SessionHandler) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// waitStatus blocks until the session has reported the given status, which may already
+// have happened. It fails when the timeout expires or the session finishes first.
+func (s *SessionHandler) waitStatus(status irma.ClientStatus, timeout <-chan time.Time) error {
+	for {
+		s.mutex.Lock()
+		for _, reported := range s.history {
+			if reported == status {
+				s.mutex.Unlock()
+				return nil
+			}
+		}
+		finished, changed := s.finished, s.changed
+		s.mutex.Unlock()
+		if finished {
+			return errors.New("session finished first")
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			return errors.New("timeout expired")
+		}
+	}
+}
+
+func (s *SessionHandler) StatusUpdate(action irma.Action, status irma.ClientStatus) {
+	s.mutex.Lock()
+	s.action = action
+	s.status = status
+	s.history = append(s.history, status)
+	s.notify()
+	event := s.sessionEvent()
+	event.Status = string(status)
+	s.mutex.Unlock()
+	sessionEvents.Publish("status", event)
+	if s.id == 0 && *outputFormat != "json" {
+		fmt.Fprintln(events, status)
+	} else {
+		s.emit("status-update", "status", status)
+	}
+}
+
+// emit emits the event for this session, identifying it by its correlation ID and, when
+// sessions run in parallel, its number.
+func (s *SessionHandler) emit(event string, fields ...interface{}) {
+	if s.correlationID != "" {
+		fields = append([]interface{}{"session_id", s.correlationID}, fields...)
+	}
+	emitFor(s.id, event, fields...)
+}
+
+// await waits for the next command meant for this session.
+func (s *SessionHandler) await(prompt string) (command, bool) {
+	var timeout <-chan time.Time
+	if *decisionTimeout > 0 {
+		timeout = time.After(*decisionTimeout)
+	}
+	cmd, ok, timedOut := s.commands.awaitWithin(s.id, prompt, timeout)
+	if timedOut {
+		s.emit("decision-timeout", "prompt", prompt, "waited", *decisionTimeout)
+		s.mutex.Lock()
+		s.undecided = true
+		s.mutex.Unlock()
+	}
+	return cmd, ok || timedOut
+}
+
+// ClientReturnURLSet is called when the request asks the client to open a URL once the
+// session is done, which the emulator does not do, but reports.
+func (s *SessionHandler) ClientReturnURLSet(clientReturnURL string) {
+	s.emit("client-return-url", "url", clientReturnURL)
+}
+
+// PairingRequired is called when the frontend must be paired before the session continues,
+// by having the user enter the pairing code in it. The server, not the client, decides whether
+// pairing is needed; with -pairing disabled such sessions fail instead of waiting.
+func (s *SessionHandler) PairingRequired(pairingCode string) {
+	s.mutex.Lock()
+	s.pairingRequired = true
+	s.mutex.Unlock()
+	if *pairing == "disabled" {
+		s.emit("pairing-disabled", "code", pairingCode)
+		s.Failure(&irma.SessionError{
+			ErrorType: irma.ErrorPairingRejected,
+			Info:      "server requires pairing with the frontend, but pairing is disabled with -pairing disabled",
+		})
+		return
+	}
+	s.emit("pairing-required", "code", pairingCode)
+}
+
+// sessionEvent returns the event to publish on GET /events for the session. Must be called
+// with s.mutex held.
+func (s *SessionHandler) sessionEvent() SessionEvent {
+	return SessionEvent{ID: s.id, SessionID: s.correlationID, Action: string(s.action)}
 }
 
 func (s *SessionHandler) Success(result string) {
-	s.completion <- struct{}{}
+	s.mutex.Lock()
+	if *showResult && s.id == 0 {
+		printResult(s.correlationID, s.disclosed)
+	} else if *showResult {
+		s.emit("result", "disclosed", formatResult(s.disclosed))
+	}
+	event := s.sessionEvent()
+	s.mutex.Unlock()
+	sessionEvents.Publish("success", event)
+	if s.signFile != nil {
+		s.emit("file-signature", "path", s.signFile.path, "signature", result)
+	}
+	s.mutex.Lock()
+	disclosed := map[string]string{}
+	for id, value := range s.disclosed {
+		disclosed[id] = value
+	}
+	s.mutex.Unlock()
+	s.finish(outcome{kind: outcomeSuccess, result: result, disclosed: disclosed})
 }
 
 func (s *SessionHandler) Cancelled() {
-	time.Sleep(1 * time.Second)
-	s.completion <- struct{}{}
+	s.mutex.Lock()
+	origin := "server"
+	if s.declined || s.undecided || s.stdinFailed {
+		origin = "client"
+	}
+	undecided, stdinFailed := s.undecided, s.stdinFailed
+	event := s.sessionEvent()
+	event.Origin = origin
+	s.mutex.Unlock()
+	s.emit("cancelled", "origin", origin)
+	sessionEvents.Publish("cancelled", event)
+	if stdinFailed {
+		s.finish(outcome{kind: outcomeFailure})
+		return
+	}
+	if undecided {
+		s.finish(outcome{kind: outcomeDecisionTimeout})
+		return
+	}
+	s.finish(outcome{kind: outcomeCancelled})
+}
+
+// decline cancels the session from the client side.
+func (s *SessionHandler) decline(callback irmaclient.PermissionHandler) {
+	s.mutex.Lock()
+	s.declined = true
+	s.mutex.Unlock()
+	callback(false, nil)
+}
+
+func (s *SessionHandler) Failure(err *irma.SessionError) {
+	fields := []interface{}{"category", failureCategory(err), "type", string(err.ErrorType)}
+	if err.RemoteStatus != 0 {
+		fields = append(fields, "remote_status", err.RemoteStatus)
+	}
+	fields = append(fields, "error", err.Error())
+	s.emit("failure", fields...)
+
+	s.finish(outcome{kind: outcomeFailure, err: err})
+}
+
+// failureCategory maps the error type of a session error onto a small, stable set of
+// categories, so that tests can assert on the kind of failure rather than its message.
+func failureCategory(err *irma.SessionError) string {
+	switch err.ErrorType {
+	case irma.ErrorTransport, irma.ErrorHTTPS:
+		return "transport"
+	case irma.ErrorApi:
+		if sessionUnknown(err) {
+			return "cancelled"
+		}
+		return "server"
+	case irma.ErrorServerResponse, irma.ErrorRejected:
+		return "server"
+	case irma.ErrorProtocolVersionNotSupported, irma.ErrorInvalidJWT, irma.ErrorUnknownAction,
+		irma.ErrorSerialization, irma.ErrorInvalidRequest, irma.ErrorPairingRejected:
+		return "protocol"
+	case irma.ErrorCrypto, irma.ErrorRevocation, irma.ErrorRandomBlind:
+		return "crypto"
+	case irma.ErrorKeyshare, irma.ErrorKeyshareUnenrolled:
+		return "keyshare"
+	case irma.ErrorUnknownIdentifier, irma.ErrorRequiredAttributeMissing, irma.ErrorConfigurationDownload,
+		irma.ErrorUnknownSchemeManager, irma.ErrorInvalidSchemeManager:
+		return "configuration"
+	case irma.ErrorPanic:
+		return "internal"
+	default:
+		return "unknown"
+	}
 }
 
-func (_ *SessionHandler) Failure(err *irma.SessionError) {
-	panic("Unexpected call to Failure")
+// sessionUnknown reports whether the server no longer knows the session, e.g. because it
+// expired or was cancelled.
+func sessionUnknown(err *irma.SessionError) bool {
+	return err != nil && err.RemoteError != nil && err.RemoteError.ErrorName == "SESSION_UNKNOWN"
 }
 
-func (_ *SessionHandler) KeyshareBlocked(manager irma.SchemeManagerIdentifier, duration int) {
-	panic("Unexpected call to KeyshareBlocked")
+func (s *SessionHandler) KeyshareBlocked(manager irma.SchemeManagerIdentifier, duration int) {
+	s.emit("keyshare-blocked", "manager", manager, "duration", duration)
+	s.finish(outcome{kind: outcomeBlocked})
 }
 
-func (_ *SessionHandler) KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIdentifier) {
-	panic("Unexpected call to KeyshareEnrollmentIncomplete")
+func (s *SessionHandler) KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIdentifier) {
+	s.emit("keyshare-enrollment-incomplete", "manager", manager)
+	s.finish(outcome{kind: outcomeEnrollmentIncomplete})
 }
 
-func (_ *SessionHandler) KeyshareEnrollmentMissing(manager irma.SchemeManagerIdentifier) {
-	panic("Unexpected call to KeyshareEnrollmentMissing")
+func (s *SessionHandler) KeyshareEnrollmentMissing(manager irma.SchemeManagerIdentifier) {
+	s.emit("keyshare-enrollment-missing", "manager", manager)
+	s.finish(outcome{kind: outcomeEnrollmentMissing})
 }
 
-func (_ *SessionHandler) KeyshareEnrollmentDeleted(manager irma.SchemeManagerIdentifier) {
-	panic("Unexpected calll to KeyshareEnrollmentDeleted")
+func (s *SessionHandler) KeyshareEnrollmentDeleted(manager irma.SchemeManagerIdentifier) {
+	s.emit("keyshare-enrollment-deleted", "manager", manager)
+	s.finish(outcome{kind: outcomeEnrollmentDeleted})
 }
 
-func makeFirstDisclosureChoice(candidates [][]irmaclient.DisclosureCandidates) *irma.DisclosureChoice {
+// makeFirstDisclosureChoice chooses the first candidate of every disjunction. It fails if a
+// disjunction has no candidates or its first candidate cannot be disclosed.
+func makeFirstDisclosureChoice(candidates [][]irmaclient.DisclosureCandidates) (*irma.DisclosureChoice, error) {
 	attributes := [][]*irma.AttributeIdentifier{}
 	for i := range candidates {
+		if len(candidates[i]) == 0 {
+			return nil, fmt.Errorf("disjunction %d has no candidates", i)
+		}
 		choice, err := candidates[i][0].Choose()
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("disjunction %d: %v", i, err)
 		}
 		attributes = append(attributes, choice)
 	}
 	return &irma.DisclosureChoice{
 		Attributes: attributes,
+	}, nil
+}
+
+// filterDisclosureChoice removes the attributes whose type is not in subset from the choice.
+// It returns an error if this leaves nothing to disclose for a disjunction that requires
+// attributes, naming the required types.
+func filterDisclosureChoice(choice *irma.DisclosureChoice, subset []string) error {
+	allowed := map[string]bool{}
+	for _, t := range subset {
+		allowed[t] = true
+	}
+	for i, chosen := range choice.Attributes {
+		filtered := []*irma.AttributeIdentifier{}
+		excluded := []string{}
+		for _, id := range chosen {
+			if allowed[id.Type.String()] {
+				filtered = append(filtered, id)
+			} else {
+				excluded = append(excluded, id.Type.String())
+			}
+		}
+		if len(filtered) == 0 && len(chosen) > 0 {
+			return fmt.Errorf("disjunction %d requires %s, which is not in the attribute subset", i, strings.Join(excluded, ", "))
+		}
+		choice.Attributes[i] = filtered
 	}
+	return nil
 }
 
-func (s *SessionHandler) shouldCancel() bool {
-	command, err := s.reader.ReadString('\n')
-	if err != nil {
-		panic(err)
+// chooseAttributes returns the choice disclosing, for each disjunction, the candidate
+// conjunction consisting of exactly the given attribute types.
+func chooseAttributes(candidates [][]irmaclient.DisclosureCandidates, types [][]string) (*irma.DisclosureChoice, error) {
+	if len(types) != len(candidates) {
+		return nil, fmt.Errorf("choice has %d disjunctions, request has %d", len(types), len(candidates))
+	}
+	attributes := [][]*irma.AttributeIdentifier{}
+	for i, discon := range candidates {
+		want := strings.Join(types[i], ",")
+		var chosen []*irma.AttributeIdentifier
+		var err error
+		found := false
+		for _, con := range discon {
+			have := []string{}
+			for _, candidate := range con {
+				have = append(have, candidate.Type.String())
+			}
+			if strings.Join(have, ",") != want {
+				continue
+			}
+			if chosen, err = con.Choose(); err == nil {
+				found = true
+				break
+			}
+		}
+		if !found {
+			if err != nil {
+				return nil, fmt.Errorf("disjunction %d: cannot choose %s: %v", i, want, err)
+			}
+			return nil, fmt.Errorf("disjunction %d has no candidate %s", i, want)
+		}
+		attributes = append(attributes, chosen)
 	}
-	return command == "cancel\n"
+	return &irma.DisclosureChoice{Attributes: attributes}, nil
 }
 
-func (s *SessionHandler) RequestIssuancePermission(request *irma.IssuanceRequest,
+// emptyDisclosureChoice returns a choice disclosing nothing, along with the indices of the
+// disjunctions it skips, if there is at least one disjunction and every disjunction is optional.
+func emptyDisclosureChoice(candidates [][]irmaclient.DisclosureCandidates) (*irma.DisclosureChoice, []int, bool) {
+	if len(candidates) == 0 {
+		return nil, nil, false
+	}
+	attributes := [][]*irma.AttributeIdentifier{}
+	skipped := []int{}
+	for i, discon := range candidates {
+		optional := false
+		for _, con := range discon {
+			if len(con) == 0 {
+				optional = true
+			}
+		}
+		if !optional {
+			return nil, nil, false
+		}
+		attributes = append(attributes, []*irma.AttributeIdentifier{})
+		skipped = append(skipped, i)
+	}
+	return &irma.DisclosureChoice{Attributes: attributes}, skipped, true
+}
+
+func joinInts(values []int) string {
+	strs := make([]string, len(values))
+	for i, value := range values {
+		strs[i] = strconv.Itoa(value)
+	}
+	return strings.Join(strs, ",")
+}
+
+// emitIssueURLs emits where each of the missing credential types can be obtained, for those
+// whose scheme says so.
+func (s *SessionHandler) emitIssueURLs(missing []irma.CredentialTypeIdentifier) {
+	for _, id := range missing {
+		if url := issueURL(s.configuration, id); url != "" {
+			s.emit("issue-url", "type", id, "url", url)
+		}
+	}
+}
+
+// awaitPermission waits for the permission decision, returning whether to cancel the session
+// and, if given by a JSON command, the attribute types to disclose. With -candidate-timeout
+// an unanswered prompt cancels the session, without counting as undecided like
+// -decision-timeout does.
+func (s *SessionHandler) awaitPermission() (bool, [][]string) {
+	if *batchFile != "" {
+		s.emit("permission-accepted", "reason", "batch")
+		return false, nil
+	}
+	var cmd command
+	var ok bool
+	if *candidateTimeout > 0 && (*decisionTimeout == 0 || *candidateTimeout < *decisionTimeout) {
+		var timedOut bool
+		cmd, ok, timedOut = s.commands.awaitWithin(s.id, "permission", time.After(*candidateTimeout))
+		if timedOut {
+			s.emit("candidate-timeout", "waited", *candidateTimeout)
+			return true, nil
+		}
+	} else {
+		cmd, ok = s.await("permission")
+	}
+	if !ok {
+		if err := s.commands.readErr(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read from stdin: %v\n", err)
+			s.mutex.Lock()
+			s.stdinFailed = true
+			s.mutex.Unlock()
+			return true, nil
+		}
+		s.emit("stdin-closed", "waiting", "permission")
+		return true, nil
+	}
+	s.mutex.Lock()
+	undecided := s.undecided
+	s.mutex.Unlock()
+	return cmd.name == "cancel" || undecided, cmd.choice
+}
+
+func (s *SessionHandler) requestPermission(request irma.SessionRequest,
 	satisfiable bool,
 	candidates [][]irmaclient.DisclosureCandidates,
 	requestorInfo *irma.RequestorInfo,
 	callback irmaclient.PermissionHandler) {
-	if s.shouldCancel() {
-		callback(false, nil)
-	} else {
-		callback(true, makeFirstDisclosureChoice(candidates))
+	req := &permissionRequest{request: request, satisfiable: satisfiable, candidates: candidates, requestorInfo: requestorInfo}
+	for _, policy := range permissionPolicies {
+		if !policy(s, req) {
+			s.decline(callback)
+			return
+		}
 	}
+
+	cancel, chosen := s.awaitPermission()
+	if cancel {
+		s.decline(callback)
+		return
+	}
+	choice, ok := s.choose(req, chosen)
+	if !ok {
+		s.decline(callback)
+		return
+	}
+	for _, policy := range choicePolicies {
+		if !policy(s, req, choice) {
+			s.decline(callback)
+			return
+		}
+	}
+	callback(true, choice)
+}
+
+func (s *SessionHandler) RequestIssuancePermission(request *irma.IssuanceRequest,
+	satisfiable bool,
+	candidates [][]irmaclient.DisclosureCandidates,
+	requestorInfo *irma.RequestorInfo,
+	callback irmaclient.PermissionHandler) {
+	s.requestPermission(request, satisfiable, candidates, requestorInfo, callback)
 }
 
 func (s *SessionHandler) RequestVerificationPermission(request *irma.DisclosureRequest,
@@ -138,11 +838,7 @@ func (s *SessionHandler) RequestVerificationPermission(request *irma.DisclosureR
 	candidates [][]irmaclient.DisclosureCandidates,
 	requestorInfo *irma.RequestorInfo,
 	callback irmaclient.PermissionHandler) {
-	if s.shouldCancel() {
-		callback(false, nil)
-	} else {
-		callback(true, makeFirstDisclosureChoice(candidates))
-	}
+	s.requestPermission(request, satisfiable, candidates, requestorInfo, callback)
 }
 
 func (s *SessionHandler) RequestSignaturePermission(request *irma.SignatureRequest,
@@ -150,46 +846,918 @@ func (s *SessionHandler) RequestSignaturePermission(request *irma.SignatureReque
 	candidates [][]irmaclient.DisclosureCandidates,
 	requestorInfo *irma.RequestorInfo,
 	callback irmaclient.PermissionHandler) {
-	if s.shouldCancel() {
-		callback(false, nil)
-	} else {
-		callback(true, makeFirstDisclosureChoice(candidates))
-	}
+	s.requestPermission(request, satisfiable, candidates, requestorInfo, callback)
 }
 
-func (_ *SessionHandler) RequestSchemeManagerPermission(manager *irma.SchemeManager,
+// RequestSchemeManagerPermission asks whether to install a scheme manager for the session,
+// which the emulator refuses: schemes are only installed by its flags.
+func (s *SessionHandler) RequestSchemeManagerPermission(manager *irma.SchemeManager,
 	callback func(proceed bool)) {
-	panic("Unexpected call to RequestSchemeManagerPermission")
+	s.emit("scheme-manager-permission", "manager", manager.ID, "proceed", false)
+	callback(false)
 }
 
-func (_ *SessionHandler) RequestPin(remainingAttempts int, callback irmaclient.PinHandler) {
-	panic("Unexpected call to RequestPin")
+func (s *SessionHandler) RequestPin(remainingAttempts int, callback irmaclient.PinHandler) {
+	s.mutex.Lock()
+	managers := s.keyshare
+	s.mutex.Unlock()
+
+	if s.pins.configured() {
+		pin, correct, attempt := s.pins.next(managers)
+		s.emit("pin-attempt", "manager", identifiers(managers), "attempt", attempt, "correct", correct,
+			"remaining_attempts", remainingAttempts)
+		callback(true, pin)
+		return
+	}
+
+	s.emit("pin-requested", "manager", identifiers(managers), "remaining_attempts", remainingAttempts)
+	cmd, ok := s.await("pin")
+	if !ok {
+		s.emit("stdin-closed", "waiting", "pin")
+		callback(false, "")
+		return
+	}
+	s.mutex.Lock()
+	undecided := s.undecided
+	s.mutex.Unlock()
+	if undecided {
+		callback(false, "")
+		return
+	}
+	switch cmd.name {
+	case "abort", "cancel":
+		s.mutex.Lock()
+		s.pinAborted = true
+		s.mutex.Unlock()
+		callback(false, "")
+	case "pin":
+		callback(true, cmd.args)
+	default:
+		callback(true, cmd.line)
+	}
 }
 
 func main() {
-	client, err := irmaclient.New(
-		"temp_testing/client",
-		"temp_testing/irma_configuration",
-		&ClientHandler{},
-	)
+	defer func() {
+		// Also report panics of the main goroutine, with the exit code with which Go exits then
+		if r := recover(); r != nil {
+			emitExit(2)
+			panic(r)
+		}
+	}()
+	flag.Parse()
+	if *outputFormat != "text" && *outputFormat != "json" {
+		fmt.Fprintf(os.Stderr, "Unsupported -output-format %q, expected text or json\n", *outputFormat)
+		exit(exitStartup)
+	}
+	if (*printQR || *externalClient || *requestFile != "") && *requestorURL == "" {
+		fmt.Fprintln(os.Stderr, "-request, -print-qr and -external-client require -requestor-url")
+		exit(exitStartup)
+	}
+	if *requestorURL != "" && *requestFile == "" {
+		fmt.Fprintln(os.Stderr, "-requestor-url requires -request")
+		exit(exitStartup)
+	}
+	if *resultTimeout > 0 && *resultURL == "" {
+		fmt.Fprintln(os.Stderr, "-result-timeout requires -result-url")
+		exit(exitStartup)
+	}
+	if *onRevoked != "continue" && *onRevoked != "abort" {
+		fmt.Fprintf(os.Stderr, "Unsupported -on-revoked %q, expected continue or abort\n", *onRevoked)
+		exit(exitStartup)
+	}
+	if *retryOn != "transient" && *retryOn != "transport" {
+		fmt.Fprintf(os.Stderr, "Unsupported -retry-on %q, expected transient or transport\n", *retryOn)
+		exit(exitStartup)
+	}
+	if *pairing != "accept" && *pairing != "disabled" {
+		fmt.Fprintf(os.Stderr, "Unsupported -pairing %q, expected accept or disabled\n", *pairing)
+		exit(exitStartup)
+	}
+	// The preferences to apply to the client; the stored ones are kept with -no-developer-mode
+	// and no -pref, so then developer mode is only known to be disabled
+	requestedPrefs := irmaclient.Preferences{DeveloperMode: !*noDeveloperMode}
+	if err := setPreferences(&requestedPrefs, preferenceValues); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -pref: %v\n", err)
+		exit(exitStartup)
+	}
+	if (*batchFile == "") != (*batchOut == "") {
+		fmt.Fprintln(os.Stderr, "-batch and -batch-out must be used together")
+		exit(exitStartup)
+	}
+	if *batchFile != "" && (*pointerFile != "" || *pointerURL != "" || *requestorURL != "") {
+		fmt.Fprintln(os.Stderr, "-batch cannot be combined with -pointer-file, -pointer-url or -requestor-url")
+		exit(exitStartup)
+	}
+	if *fixedNow != "" {
+		if !requestedPrefs.DeveloperMode {
+			fmt.Fprintln(os.Stderr, "-now is only available in developer mode, i.e. without -no-developer-mode or -pref DeveloperMode=false")
+			exit(exitStartup)
+		}
+		if *fakeNow != "" && *fakeNow != *fixedNow {
+			fmt.Fprintln(os.Stderr, "-now and -fake-now set different times")
+			exit(exitStartup)
+		}
+		*fakeNow = *fixedNow
+	}
+	var injectedSecret *big.Int
+	if *deviceSecret != "" {
+		if !requestedPrefs.DeveloperMode {
+			fmt.Fprintln(os.Stderr, "-device-secret is only available in developer mode, i.e. without -no-developer-mode or -pref DeveloperMode=false")
+			exit(exitStartup)
+		}
+		secret, err := parseDeviceSecret(*deviceSecret)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -device-secret: %v\n", err)
+			exit(exitStartup)
+		}
+		injectedSecret = secret
+	}
+	if *fakeNow != "" {
+		if err := setFakeNow(*fakeNow); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid time %q, expected an RFC 3339 time: %v\n", *fakeNow, err)
+			exit(exitStartup)
+		}
+	}
+	if *statusPollInterval <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -status-poll-interval %s, expected a positive duration\n", *statusPollInterval)
+		exit(exitStartup)
+	}
+	if *eventsStderr {
+		events = os.Stderr
+	}
+	if *recordChoices != "" {
+		choiceRecorder = &DisclosureChoiceRecorder{Path: *recordChoices}
+	}
+
+	if *clientLogFile != "" {
+		f, err := os.OpenFile(*clientLogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open client log file: %v\n", err)
+			exit(exitStartup)
+		}
+		// irmago shares this logger with gabi and its other dependencies
+		irma.Logger.SetOutput(f)
+	}
+
+	if flag.Arg(0) == "diff-storage" {
+		if flag.NArg() != 3 {
+			fmt.Fprintln(os.Stderr, "Usage: diff-storage <dirA> <dirB>")
+			exit(exitStartup)
+		}
+		exit(diffStorage(flag.Arg(1), flag.Arg(2)))
+	}
+	if flag.Arg(0) == "validate-store" {
+		if flag.NArg() > 3 {
+			fmt.Fprintln(os.Stderr, "Usage: validate-store [<storage> [<irma_configuration>]]")
+			exit(exitStartup)
+		}
+		dir := *storagePath
+		if flag.NArg() > 1 {
+			dir = flag.Arg(1)
+		}
+		// By default, check against the copy of the schemes that the client uses, if any
+		confPath := filepath.Join(dir, "irma_configuration")
+		if _, err := os.Stat(confPath); err != nil {
+			confPath = *configPath
+		}
+		if flag.NArg() > 2 {
+			confPath = flag.Arg(2)
+		}
+		exit(validateStore(dir, confPath))
+	}
+	if *benchmarkRuns > 0 {
+		exit(benchmarkStartup(*benchmarkRuns, *benchmarkCopy))
+	}
+	if *listManagers {
+		exit(listSchemeManagers(*configPath))
+	}
+	if *listCredTypes {
+		exit(listCredentialTypes(*configPath))
+	}
+	if *listAttrTypes != "" {
+		exit(listAttributeTypes(*configPath, irma.NewCredentialTypeIdentifier(*listAttrTypes)))
+	}
+
+	pins, err := newPinSupplier(*pin, *wrongPinAttempts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -pin: %v\n", err)
+		exit(exitStartup)
+	}
+
+	clientHandler := &ClientHandler{
+		enrollments: make(chan enrollment, 1),
+		pinChanges:  make(chan pinChange, 1),
+		aborted:     make(chan struct{}),
+	}
+	// Without -device-secret a missing storage directory is reported by irmaclient.New
+	_, err = os.Stat(*storagePath)
+	if err != nil && injectedSecret != nil {
+		fmt.Fprintf(os.Stderr, "Cannot store the device secret in storage %s: %v\n", *storagePath, err)
+		exit(exitStartup)
+	}
+	if injectedSecret != nil {
+		if err := injectDeviceSecret(*storagePath, injectedSecret); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to store the device secret in storage %s: %v\n", *storagePath, err)
+			exit(exitStartup)
+		}
+		emit("device-secret-injected", "fingerprint", deviceFingerprint(device.secret))
+	} else if err == nil {
+		// Only for device-info, which reports the secret as unknown if it cannot be read
+		_ = readDeviceSecret(*storagePath)
+	}
+	for _, path := range importCredentials {
+		if _, err := importCredential(*storagePath, path); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to import credential from %s: %v\n", path, err)
+			exit(exitStartup)
+		}
+	}
+	client, err := irmaclient.New(*storagePath, *configPath, clientHandler)
+	if err != nil {
+		code := exitStartup
+		if msg, ok := schemeFailure(err); ok {
+			fmt.Fprintln(os.Stderr, msg)
+			code = exitScheme
+		} else {
+			fmt.Fprintf(os.Stderr, "Failed to start client (storage %s, configuration %s): %v\n", *storagePath, *configPath, err)
+		}
+		if client != nil {
+			client.Close()
+		}
+		exit(code)
+	}
+	if device.secret == nil {
+		// irmaclient generated the secret, as the storage held none
+		_ = readGeneratedDeviceSecret(*storagePath)
+	}
+
+	if prefs, ok := preferencesToApply(client.Preferences); ok {
+		client.SetPreferences(prefs)
+		// SetPreferences does not report errors, so check whether the preferences were applied
+		if client.Preferences != prefs {
+			fmt.Fprintln(os.Stderr, "Failed to apply the client preferences")
+			client.Close()
+			exit(exitStartup)
+		}
+	}
+	emitPreferences(client.Preferences)
+
+	for _, spec := range installSchemes {
+		url, publicKey, err := parseSchemeInstall(spec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -install-scheme: %v\n", err)
+			client.Close()
+			exit(exitStartup)
+		}
+		if err := installScheme(client.Configuration, url, publicKey); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to install scheme from %s: %v\n", url, err)
+			client.Close()
+			exit(exitStartup)
+		}
+	}
+	for _, url := range tofuSchemes {
+		if err := installScheme(client.Configuration, url, nil); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to install scheme from %s: %v\n", url, err)
+			client.Close()
+			exit(exitStartup)
+		}
+	}
+
+	if *trustedSchemes != "" {
+		if err := trustSchemes(client.Configuration, *trustedSchemes); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -trusted-schemes: %v\n", err)
+			client.Close()
+			exit(exitStartup)
+		}
+	}
+
+	if *updateAtStartup {
+		if err := updateSchemesAtStartup(client, clientHandler, *updateTimeout); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to update schemes: %v\n", err)
+			client.Close()
+			exit(exitStartup)
+		}
+	}
+
+	if noSchemes(client.Configuration) {
+		if *autoDemoScheme == "" && *autoPbdfScheme == "" {
+			fmt.Fprintf(os.Stderr, "Warning: the configuration (%s) contains no schemes, so sessions will fail; "+
+				"use --auto-demo-scheme <pubkeyfile> or --install-scheme <url>=<pubkeyfile> to install one\n", *configPath)
+		}
+		autoSchemes := []struct{ url, keyFile string }{{demoSchemeURL, *autoDemoScheme}, {pbdfSchemeURL, *autoPbdfScheme}}
+		for _, scheme := range autoSchemes {
+			if scheme.keyFile == "" {
+				continue
+			}
+			publicKey, err := ioutil.ReadFile(scheme.keyFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Cannot read the public key of the scheme at %s: %v\n", scheme.url, err)
+				client.Close()
+				exit(exitStartup)
+			}
+			emit("scheme-installing", "url", scheme.url)
+			if err := installScheme(client.Configuration, scheme.url, publicKey); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to install scheme from %s: %v\n", scheme.url, err)
+				client.Close()
+				exit(exitStartup)
+			}
+		}
+	}
+
+	if !enrollKeyshare(client, clientHandler, enrollments) {
+		client.Close()
+		exit(exitStartup)
+	}
+	printEnrollmentStatus(client)
+
+	if *keyshareServerURL != "" {
+		code := enrollWithServer(client, clientHandler, *keyshareServerURL, *enrollEmail, pins)
+		client.Close()
+		exit(code)
+	}
+
+	if *pinChangeSpec != "" {
+		code := changePin(client, clientHandler, *pinChangeSpec, interruptions(clientHandler))
+		client.Close()
+		exit(code)
+	}
+
+	commands := newDispatcher()
+	commands.handle("force-update", func(command) {
+		forceUpdate(client, clientHandler)
+	})
+	commands.handle("keyshare-remove", func(cmd command) {
+		keyshareRemove(client, cmd.args)
+	})
+	commands.handle("credential-attributes", func(cmd command) {
+		printCredentialAttributes(client, cmd.args)
+	})
+	commands.handle("keyshare-rekey", func(cmd command) {
+		keyshareRekey(client, cmd.args)
+	})
+	commands.handle("delete-credential", func(cmd command) {
+		deleteCredential(client, cmd.args)
+	})
+	commands.handle("update-revocation", func(cmd command) {
+		updateRevocation(client, cmd.args)
+	})
+	commands.handle("revocation-status", func(cmd command) {
+		revocationStatus(client, cmd.args)
+	})
+	commands.handle("logs", func(cmd command) {
+		printLogs(client, cmd.args)
+	})
+	commands.handle("prefs", func(cmd command) {
+		changePreferences(client, cmd.args)
+	})
+	commands.handle("dedupe-report", func(command) {
+		dedupeCredentials(client, false)
+	})
+	commands.handle("dedupe", func(cmd command) {
+		if cmd.args != "" && cmd.args != "--apply" {
+			emit("dedupe-failed", "error", "expected dedupe [--apply]")
+			return
+		}
+		dedupeCredentials(client, cmd.args == "--apply")
+	})
+	commands.handle("device-info", func(command) {
+		deviceInfo(client)
+	})
+	commands.handle("find", func(cmd command) {
+		findCredentials(client, cmd.args)
+	})
+	commands.handle("expiry", func(cmd command) {
+		printExpiry(client, cmd.args)
+	})
+	commands.handle("benchmark-proof", func(cmd command) {
+		benchmarkProof(client, cmd.args)
+	})
+	commands.handle("pending-sessions", func(command) {
+		printPendingSessions(activeSessions)
+	})
+	commands.handle("wait-status", func(cmd command) {
+		waitStatus(activeSessions, cmd.args)
+	})
+	commands.handle("request-structure", func(cmd command) {
+		printRequestStructure(cmd.args)
+	})
+	if *preloadRevocation {
+		updateRevocation(client, "")
+	}
+	// Every exit from here on closes the client through closeClient, so that a periodic update
+	// or a SIGHUP reload never runs against a closed client
+	stopAutoUpdate := func() {}
+	if *autoUpdateInterval > 0 {
+		stopAutoUpdate = autoUpdateSchemes(client, clientHandler, *autoUpdateInterval)
+	}
+	stopReload := func() {}
+	if *configReload {
+		stopReload = updateSchemesOnHangup(client, clientHandler)
+	}
+	closeClient := func() {
+		stopAutoUpdate()
+		stopReload()
+		client.Close()
+	}
+	if *listenAddr != "" {
+		if err := serveSessions(*listenAddr, activeSessions, sessionEvents, sessionMetrics); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot listen on %s: %v\n", *listenAddr, err)
+			closeClient()
+			exit(exitStartup)
+		}
+	}
+	commands.routeSessions = *parallel > 1
+	commands.jsonCommands = *jsonCommands
+	commands.start(os.Stdin)
+
+	interrupted := interruptions(clientHandler)
+
+	var initial *command
+	if *requestorURL != "" {
+		if *pointerFile != "" || *pointerURL != "" {
+			fmt.Fprintln(os.Stderr, "-requestor-url cannot be combined with -pointer-file or -pointer-url")
+			closeClient()
+			exit(exitStartup)
+		}
+		pkg, err := startRequestorSession(*requestorURL, *requestFile, *requestorToken)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to start session: %v\n", err)
+			closeClient()
+			exit(exitFailure)
+		}
+		if *printQR {
+			printSessionPointer(pkg)
+		}
+		if *externalClient {
+			code := awaitExternalClient(*requestorURL, pkg.Token, *requestorToken, *externalTimeout)
+			closeClient()
+			exit(afterClose(code))
+		}
+		cmd := parseCommand(string(pkg.SessionPtr))
+		initial = &cmd
+	}
+	if *pointerFile != "" || *pointerURL != "" {
+		if *pointerFile != "" && *pointerURL != "" {
+			fmt.Fprintln(os.Stderr, "Only one of -pointer-file and -pointer-url can be used")
+			closeClient()
+			exit(exitStartup)
+		}
+		pointer, err := readSessionPointer(*pointerFile, *pointerURL, client.Preferences.DeveloperMode)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read session pointer: %v\n", err)
+			closeClient()
+			exit(exitFailure)
+		}
+		cmd := parseCommand(pointer)
+		initial = &cmd
+	}
+
+	if *batchFile != "" {
+		code := runBatch(client, commands, pins, interrupted)
+		closeClient()
+		exit(afterClose(clientHandler.exitCode(code)))
+	}
+	if *parallel > 1 {
+		code := runParallel(client, commands, initial, pins, interrupted)
+		closeClient()
+		exit(afterClose(clientHandler.exitCode(code)))
+	}
+
+	var result outcome
+	var last string // the pointer of the previous session, which "resume" defaults to
+	for {
+		var cmd command
+		var ok bool
+		if initial != nil {
+			cmd, ok, initial = *initial, true, nil
+		} else {
+			cmd, ok = commands.await("session")
+		}
+		if !ok {
+			if err := commands.readErr(); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to read from stdin: %v\n", err)
+				closeClient()
+				exit(exitStartup)
+			}
+			if last == "" {
+				fmt.Fprintln(os.Stderr, "No session pointer received")
+				closeClient()
+				exit(exitStartup)
+			}
+			emit("stdin-closed", "waiting", "session")
+			break
+		}
+		switch cmd.name {
+		case "resume":
+			if cmd.args == "" {
+				cmd.args = last
+			}
+			last = cmd.args
+		case "can-satisfy", "check-keys":
+			last = cmd.args
+		default:
+			last = cmd.line
+		}
+
+		var stop bool
+		result, stop = handleSession(client, commands, 0, cmd, pins, interrupted)
+		countOutcome(result)
+		if result.pinAborted && !stop && !*once {
+			// Wait for "resume", or the next session
+			continue
+		}
+		if stop || *once || result.kind != outcomeSuccess || atomic.LoadInt64(&completedSessions) >= int64(*maxSessionCount) {
+			break
+		}
+	}
+
+	closeClient()
+	exit(afterClose(clientHandler.exitCode(result.exitCode())))
+}
+
+// interruptions returns a channel that is closed once SIGINT or SIGTERM is received or a
+// revocation aborts the emulator, stopping all sessions.
+func interruptions(handler *ClientHandler) <-chan struct{} {
+	interrupted := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+		case <-handler.aborted:
+		}
+		close(interrupted)
+	}()
+	return interrupted
+}
+
+// countOutcome counts the finished session for the exit event and GET /metrics.
+func countOutcome(result outcome) {
+	sessionMetrics.Observe(result.kind, result.duration)
+	atomic.AddInt64(&finishedSessions, 1)
+	switch result.kind {
+	case outcomeSuccess:
+		atomic.AddInt64(&completedSessions, 1)
+	case outcomeCancelled:
+		atomic.AddInt64(&cancelledSessions, 1)
+	}
+}
+
+// exit emits the exit event and exits with the given code. All exits of the emulator go
+// through it, so that the exit event is always the last line of its output.
+func exit(code int) {
+	emitExit(code)
+	sessionEvents.Close()
+	os.Exit(code)
+}
+
+// emitExit emits the number of sessions that were handled and how they finished, where every
+// session that neither succeeded nor was cancelled counts as a failure, and the exit code.
+func emitExit(code int) {
+	sessions, successes, cancelled := atomic.LoadInt64(&finishedSessions),
+		atomic.LoadInt64(&completedSessions), atomic.LoadInt64(&cancelledSessions)
+	emit("exit", "sessions", sessions, "successes", successes, "failures", sessions-successes-cancelled,
+		"cancelled", cancelled, "code", code)
+}
 
-	client.SetPreferences(irmaclient.Preferences{DeveloperMode: true})
+// afterClose performs what needs the client to be closed once all sessions have finished:
+// cleaning up the storage, checking the number of stored credentials and writing the heap
+// profile. It returns the exit code, which is changed if any of this fails.
+func afterClose(code int) int {
+	if *credentialCount >= 0 {
+		contents, err := readStorage(*storagePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read the storage: %v\n", err)
+			return exitFailure
+		}
+		count := 0
+		for _, instances := range contents.credentials {
+			count += len(instances)
+		}
+		emit("credential-count", "expected", *credentialCount, "actual", count)
+		if count != *credentialCount {
+			code = exitFailure
+		}
+	}
+	if *disableHistory {
+		if err := clearHistory(*storagePath); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to clear the session history: %v\n", err)
+			return exitFailure
+		}
+	}
+	if *memoryProfile != "" {
+		if err := writeHeapProfile(*memoryProfile); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write the heap profile: %v\n", err)
+			return exitFailure
+		}
+	}
+	return code
+}
 
+// writeHeapProfile writes a pprof heap profile to the file at path, after a garbage
+// collection so that it shows the memory that is still in use.
+func writeHeapProfile(path string) error {
+	f, err := os.Create(path)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// handleSession performs the session for the given session command, retrying it when
+// requested, and returns its outcome and whether the emulator should stop. The id
+// identifies the session when sessions run in parallel, and is 0 otherwise.
+func handleSession(client *irmaclient.Client, commands *dispatcher, id int, cmd command, pins *pinSupplier,
+	interrupted <-chan struct{}) (outcome, bool) {
+	start := time.Now()
+	sessionptr := cmd.line
+	canSatisfy := cmd.name == "can-satisfy"
+	checkKeys := cmd.name == "check-keys"
+	// Resuming retries a session whose PIN prompt was aborted, which works as long as the
+	// server still knows it
+	resume := cmd.name == "resume"
+	if canSatisfy || checkKeys || resume {
+		sessionptr = cmd.args
+	}
+	var signFile *signedFile
+	if cmd.name == "sign-file" {
+		var err error
+		if sessionptr, signFile, err = parseSignFile(cmd.args); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid sign-file command: %v\n", err)
+			return outcome{kind: outcomeFailure}, true
+		}
 	}
 
-	reader := bufio.NewReader(os.Stdin)
-	sessionptr, err := reader.ReadString('\n')
+	sessionptr, err := resolveSessionPointer(sessionptr)
 	if err != nil {
-		panic(err)
+		fmt.Fprintf(os.Stderr, "Invalid session pointer %q: %v\n", excerpt(cmd.line), err)
+		return outcome{kind: outcomeFailure}, true
+	}
+	if u := sessionPointerURL(sessionptr); strings.HasPrefix(u, "http://") && !client.Preferences.DeveloperMode {
+		fmt.Fprintf(os.Stderr, "Warning: session URL %s uses http://, which is refused unless developer mode is enabled; "+
+			"run without --no-developer-mode to enable it\n", u)
 	}
 
-	c := make(chan struct{})
+	var timeout <-chan time.Time
+	if *sessionTimeout > 0 {
+		timeout = time.After(*sessionTimeout)
+	}
 
-	client.NewSession(sessionptr, &SessionHandler{completion: c, reader: reader})
+	var result outcome
+	var stop bool
+	var handler *SessionHandler
+	attempts := 0
+	for {
+		attempts++
+		handler = newSessionHandler(commands, pins)
+		handler.id = id
+		handler.canSatisfy = canSatisfy
+		handler.checkKeys = checkKeys
+		handler.signFile = signFile
+		handler.pointer = sessionptr
+		handler.configuration = client.Configuration
+		handler.client = client
+		registered := activeSessions.Register(handler)
+		result, stop = runSession(client, sessionptr, handler, timeout, interrupted)
+		activeSessions.Unregister(registered)
+		if stop || result.kind != outcomeFailure || !retryable(result.err) || attempts > *retries {
+			break
+		}
 
-	<-c
+		handler.emit("retry", "attempt", attempts, "category", failureCategory(result.err), "backoff", *retryBackoff)
+		select {
+		case <-time.After(*retryBackoff):
+			continue
+		case <-timeout:
+		case <-interrupted:
+		}
+		stop = true
+		break
+	}
+	if *retries > 0 {
+		handler.emit("summary", "outcome", result.kind, "attempts", attempts)
+	}
+	if resume && result.kind == outcomeFailure && sessionUnknown(result.err) {
+		handler.emit("session-expired")
+	}
+	handler.mutex.Lock()
+	result.pinAborted = handler.pinAborted
+	handler.mutex.Unlock()
+
+	if result.kind == outcomeSuccess && *resultTimeout > 0 {
+		if body, err := awaitResult(*resultURL, *resultTimeout); err != nil {
+			handler.emit("result-timeout", "error", err)
+			result = outcome{kind: outcomeFailure}
+		} else {
+			handler.emit("delayed-result", "result", body)
+		}
+	}
 
-	client.Close()
+	if result.kind == outcomeSuccess && *verifySignatures {
+		handler.mutex.Lock()
+		issued := handler.issued
+		handler.mutex.Unlock()
+		verifyIssuedCredentials(client, handler, issued)
+	}
+
+	if result.kind == outcomeSuccess {
+		for credtype, path := range exportCredentials {
+			if err := exportCredential(client, *storagePath, irma.NewCredentialTypeIdentifier(credtype), path); err != nil {
+				handler.emit("export-failed", "type", credtype, "error", err)
+				result = outcome{kind: outcomeFailure}
+				continue
+			}
+			handler.emit("credential-exported", "type", credtype, "path", path)
+		}
+	}
+	result.duration = time.Since(start)
+	return result, stop
+}
+
+// runSession performs a single session, returning its outcome and whether the emulator
+// was asked to stop (because of the timeout or a signal) before it finished.
+func runSession(client *irmaclient.Client, sessionptr string, handler *SessionHandler,
+	timeout <-chan time.Time, interrupted <-chan struct{}) (outcome, bool) {
+	handler.correlationID = newCorrelationID()
+	if *serverStatus {
+		ticker := time.NewTicker(*statusPollInterval)
+		stop := make(chan struct{})
+		watching := watchServerStatus(handler, sessionptr, client.Preferences.DeveloperMode, ticker.C, stop)
+		defer func() {
+			close(stop)
+			<-watching
+			ticker.Stop()
+		}()
+	}
+	dismisser := client.NewSession(sessionptr, Chain(handler, sessionMiddleware()...))
+
+	var result outcome
+	stopped := false
+	select {
+	case result = <-handler.completion:
+	case <-timeout:
+		result, stopped = dismiss(handler, dismisser), true
+	case <-interrupted:
+		result, stopped = dismiss(handler, dismisser), true
+	}
+
+	switch result.kind {
+	case outcomeFailure:
+		// The session is already finished, dismissing it just makes sure nothing lingers
+		if dismisser != nil {
+			dismisser.Dismiss()
+		}
+	case outcomeCancelled, outcomeDismissed:
+		awaitServerFinished(sessionptr, client.Preferences.DeveloperMode)
+	}
+	return result, stopped
+}
+
+// retryable reports whether a session that failed with err may be restarted: after any
+// transient failure, or with -retry-on transport only after a transport failure.
+func retryable(err *irma.SessionError) bool {
+	if *retryOn == "transport" {
+		return failureCategory(err) == "transport"
+	}
+	return transientFailure(err)
+}
+
+// transientFailure reports whether the failure may well not occur again when retrying,
+// i.e. it is a network problem or the server (or a proxy in front of it) is unavailable.
+func transientFailure(err *irma.SessionError) bool {
+	if err.ErrorType == irma.ErrorTransport {
+		return true
+	}
+	return err.RemoteStatus == http.StatusBadGateway || err.RemoteStatus == http.StatusServiceUnavailable
+}
+
+func sessionMiddleware() []SessionMiddleware {
+	middleware := []SessionMiddleware{}
+	if *logCallbacks {
+		middleware = append(middleware, LoggingMiddleware)
+	}
+	if *metrics {
+		middleware = append(middleware, MetricsMiddleware)
+	}
+	if *assertCallbacks {
+		middleware = append(middleware, AssertionMiddleware)
+	}
+	return middleware
+}
+
+func dismiss(handler *SessionHandler, dismisser irmaclient.SessionDismisser) outcome {
+	handler.finish(outcome{kind: outcomeDismissed})
+	handler.mutex.Lock()
+	handler.declined = true
+	handler.mutex.Unlock()
+	if dismisser != nil {
+		dismisser.Dismiss()
+	}
+	return <-handler.completion
+}
+
+// The intervals at which a session result is polled, by -result-url and -external-client, and
+// at which the wallet is checked for new credentials during -unsatisfiable-wait
+const (
+	resultPollInterval = 100 * time.Millisecond
+	walletPollInterval = 100 * time.Millisecond
+)
+
+// awaitResult polls the result URL until it serves a non-empty result or the timeout
+// expires, for flows in which the result only becomes available some time after the
+// session finished at the client.
+func awaitResult(url string, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		res, err := http.Get(url)
+		if err == nil {
+			bts, readErr := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			body := strings.TrimSpace(string(bts))
+			if readErr == nil && res.StatusCode == http.StatusOK && body != "" && body != "null" && body != "{}" {
+				return body, nil
+			}
+		}
+		if time.Now().Add(resultPollInterval).After(deadline) {
+			return "", fmt.Errorf("no result at %s within %s", url, timeout)
+		}
+		time.Sleep(resultPollInterval)
+	}
+}
+
+// serverStatusNames maps the statuses of the session at the server onto the names used in
+// server-status events.
+var serverStatusNames = map[irma.ServerStatus]string{
+	irma.ServerStatusInitialized: "initialized",
+	irma.ServerStatusPairing:     "pairing",
+	irma.ServerStatusConnected:   "connected",
+	irma.ServerStatusCancelled:   "cancelled",
+	irma.ServerStatusDone:        "done",
+	irma.ServerStatusTimeout:     "timeout",
+}
+
+// watchServerStatus polls the status of the session at the server at the start and on every tick,
+// emitting server-status whenever it changes, until the status is final or stop is closed,
+// after which it polls once more. The returned channel is closed once it has stopped.
+func watchServerStatus(handler *SessionHandler, sessionptr string, developerMode bool,
+	ticks <-chan time.Time, stop <-chan struct{}) <-chan struct{} {
+	done := make(chan struct{})
+	qr := &irma.Qr{}
+	if err := json.Unmarshal([]byte(sessionptr), qr); err != nil || !qr.IsQr() || qr.Type == irma.ActionRedirect {
+		close(done)
+		return done
+	}
+
+	transport := irma.NewHTTPTransport(qr.URL, !developerMode)
+	go func() {
+		defer close(done)
+		var last irma.ServerStatus
+		stopped := false
+		for {
+			var status irma.ServerStatus
+			if err := transport.Get("status", &status); err == nil && status != last {
+				name, ok := serverStatusNames[status]
+				if !ok {
+					name = strings.ToLower(string(status))
+				}
+				handler.emit("server-status", "status", name)
+				last = status
+			}
+			if stopped || last.Finished() {
+				return
+			}
+			select {
+			case <-stop:
+				stopped = true
+			case <-ticks:
+			}
+		}
+	}()
+	return done
+}
+
+// awaitServerFinished waits until the server reports the session as finished. irmaclient
+// informs the server of a cancellation in the background, so exiting directly after the
+// Cancelled callback could otherwise leave the session open on the server. The status is
+// polled every -status-poll-interval.
+func awaitServerFinished(sessionptr string, developerMode bool) {
+	qr := &irma.Qr{}
+	if err := json.Unmarshal([]byte(sessionptr), qr); err != nil || !qr.IsQr() || qr.Type == irma.ActionRedirect {
+		return
+	}
+
+	transport := irma.NewHTTPTransport(qr.URL, !developerMode)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var status irma.ServerStatus
+		if err := transport.Get("status", &status); err != nil || status.Finished() {
+			return
+		}
+		time.Sleep(*statusPollInterval)
+	}
 }
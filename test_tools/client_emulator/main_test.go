@@ -0,0 +1,985 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+)
+
+// A disclosure request that the credentials in irmago's test client storage satisfy, which
+// irmaclient performs as a manual session without any server
+const studentIDRequest = `{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.RU.studentCard.studentID"]]]}`
+
+// The environment variable that makes the test binary run the emulator instead of the tests
+const runMainEnv = "CLIENT_EMULATOR_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) != "" {
+		main()
+		os.Exit(exitSuccess)
+	}
+	os.Exit(m.Run())
+}
+
+// runEmulator runs the emulator with the given arguments and input in a separate process,
+// returning its output and exit code. Unless closeInput is set, stdin stays open after the
+// input, so the emulator must exit by itself.
+func runEmulator(t *testing.T, input string, closeInput bool, args ...string) (string, string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), runMainEnv+"=1")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(stdin, input); err != nil {
+		t.Fatal(err)
+	}
+	if closeInput {
+		_ = stdin.Close()
+	}
+	timeout := time.AfterFunc(emulatorTimeout, func() { _ = cmd.Process.Kill() })
+	defer timeout.Stop()
+
+	err = cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if !timeout.Stop() {
+			t.Fatalf("emulator did not exit within %s\n%s%s", emulatorTimeout, stdout.String(), stderr.String())
+		}
+		return stdout.String(), stderr.String(), exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stdout.String(), stderr.String(), exitSuccess
+}
+
+// The time an emulator run by runEmulator gets to exit
+const emulatorTimeout = 30 * time.Second
+
+// emulatorArgs returns the arguments that run the emulator on a copy of the test storage,
+// emitting JSON events, followed by args.
+func emulatorArgs(t *testing.T, args ...string) []string {
+	return append([]string{"-storage", testStorage(t), "-config", testConfiguration(t), "-output-format", "json"}, args...)
+}
+
+// eventsIn returns the fields of the JSON events with the given name in the output, in order.
+func eventsIn(output, name string) []map[string]interface{} {
+	log := &eventLog{}
+	log.buf.WriteString(output)
+	return log.named(name)
+}
+
+// testdataDir returns irmago's testdata directory, which holds a client storage with
+// credentials and the schemes they were issued under.
+func testdataDir(t *testing.T) string {
+	t.Helper()
+	out, err := exec.Command("go", "list", "-m", "-f", "{{.Dir}}", "github.com/privacybydesign/irmago").Output()
+	if err != nil {
+		t.Skipf("irmago module not available: %v", err)
+	}
+	return filepath.Join(strings.TrimSpace(string(out)), "testdata")
+}
+
+// testConfiguration returns the irma_configuration directory of irmago's testdata.
+func testConfiguration(t *testing.T) string {
+	return filepath.Join(testdataDir(t), "irma_configuration")
+}
+
+// copyDir copies the directory tree at src to dst, making the copy writable.
+func copyDir(t *testing.T, src, dst string) {
+	t.Helper()
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0700)
+		}
+		bts, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, bts, 0600)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testStorage returns a copy of the client storage in irmago's testdata, which holds among
+// others an irma-demo.RU.studentCard credential and a keyshare enrollment at the test scheme.
+func testStorage(t *testing.T) string {
+	t.Helper()
+	storage := t.TempDir()
+	copyDir(t, filepath.Join(testdataDir(t), "client"), storage)
+	return storage
+}
+
+func newClientHandler() *ClientHandler {
+	return &ClientHandler{
+		enrollments: make(chan enrollment, 1),
+		pinChanges:  make(chan pinChange, 1),
+		aborted:     make(chan struct{}),
+	}
+}
+
+// newTestClient starts a client on a copy of the test storage, which is closed when the
+// test finishes.
+func newTestClient(t *testing.T) (*irmaclient.Client, *ClientHandler) {
+	t.Helper()
+	handler := newClientHandler()
+	client, err := irmaclient.New(testStorage(t), testConfiguration(t), handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	return client, handler
+}
+
+// setFlag sets the flag for the duration of the test.
+func setFlag(t *testing.T, name, value string) {
+	t.Helper()
+	f := flag.Lookup(name)
+	if f == nil {
+		t.Fatalf("no flag -%s", name)
+	}
+	old := f.Value.String()
+	if err := flag.Set(name, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = flag.Set(name, old) })
+}
+
+// eventLog collects the events emitted during a test.
+type eventLog struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (l *eventLog) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.buf.Write(p)
+}
+
+// String returns everything emitted so far.
+func (l *eventLog) String() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.buf.String()
+}
+
+// named returns the fields of the emitted events with the given name, in order.
+func (l *eventLog) named(name string) []map[string]interface{} {
+	found := []map[string]interface{}{}
+	scanner := bufio.NewScanner(strings.NewReader(l.String()))
+	for scanner.Scan() {
+		fields := map[string]interface{}{}
+		if json.Unmarshal(scanner.Bytes(), &fields) == nil && fields["event"] == name {
+			found = append(found, fields)
+		}
+	}
+	return found
+}
+
+// captureEvents collects the events emitted during the test, in JSON.
+func captureEvents(t *testing.T) *eventLog {
+	t.Helper()
+	log := &eventLog{}
+	previous := events
+	events = log
+	setFlag(t, "output-format", "json")
+	t.Cleanup(func() { events = previous })
+	return log
+}
+
+// newCommands returns a dispatcher reading the given input as if it were typed on stdin.
+func newCommands(input string) *dispatcher {
+	commands := newDispatcher()
+	commands.start(strings.NewReader(input))
+	return commands
+}
+
+// runTestSession performs the session as the main loop does, answering its prompts with
+// the input.
+func runTestSession(t *testing.T, client *irmaclient.Client, pointer, input string) outcome {
+	t.Helper()
+	commands := newCommands(input)
+	result, _ := handleSession(client, commands, 0, parseCommand(pointer), nil, nil)
+	return result
+}
+
+func TestFindMissingCredentials(t *testing.T) {
+	present := func(id string) *irmaclient.DisclosureCandidate {
+		return &irmaclient.DisclosureCandidate{AttributeIdentifier: &irma.AttributeIdentifier{
+			Type: irma.NewAttributeTypeIdentifier(id), CredentialHash: "hash",
+		}}
+	}
+	absent := func(id string) *irmaclient.DisclosureCandidate {
+		return &irmaclient.DisclosureCandidate{AttributeIdentifier: &irma.AttributeIdentifier{
+			Type: irma.NewAttributeTypeIdentifier(id),
+		}}
+	}
+	candidates := [][]irmaclient.DisclosureCandidates{
+		// Satisfied, so nothing of it is missing
+		{{present("irma-demo.RU.studentCard.studentID")}, {absent("irma-demo.MijnOverheid.root.BSN")}},
+		{{absent("irma-demo.MijnOverheid.fullName.firstname"), absent("irma-demo.MijnOverheid.fullName.familyname")}},
+		{{absent("pbdf.gemeente.personalData.fullname")}, {absent("irma-demo.MijnOverheid.fullName.firstname")}},
+	}
+
+	missing := FindMissingCredentials(candidates)
+	want := []irma.CredentialTypeIdentifier{
+		irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.fullName"),
+		irma.NewCredentialTypeIdentifier("pbdf.gemeente.personalData"),
+	}
+	if !reflect.DeepEqual(missing, want) {
+		t.Errorf("missing credentials %v, want %v", missing, want)
+	}
+	if missing := FindMissingCredentials(candidates[:1]); len(missing) != 0 {
+		t.Errorf("satisfiable request is missing %v", missing)
+	}
+}
+
+func TestRejectIfMissingCredentials(t *testing.T) {
+	log := captureEvents(t)
+	setFlag(t, "reject-if-missing-credentials", "true")
+	client, _ := newTestClient(t)
+
+	request := `{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.MijnOverheid.fullName.firstname"]]]}`
+	// Nothing is typed, as the permission prompt must not be reached
+	result := runTestSession(t, client, request, "")
+	if result.kind != outcomeCancelled {
+		t.Fatalf("session finished with %s, want cancelled\n%s", result.kind, log)
+	}
+	missing := log.named("missing-credentials")
+	if len(missing) != 1 || missing[0]["types"] != "irma-demo.MijnOverheid.fullName" {
+		t.Errorf("missing-credentials events %v", missing)
+	}
+}
+
+func TestMakeFirstDisclosureChoice(t *testing.T) {
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	choice, err := makeFirstDisclosureChoice([][]irmaclient.DisclosureCandidates{{{
+		{AttributeIdentifier: &irma.AttributeIdentifier{Type: id, CredentialHash: "hash"}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(choice.Attributes) != 1 || len(choice.Attributes[0]) != 1 || choice.Attributes[0][0].CredentialHash != "hash" {
+		t.Errorf("unexpected choice %v", choice.Attributes)
+	}
+
+	if _, err := makeFirstDisclosureChoice([][]irmaclient.DisclosureCandidates{{}}); err == nil {
+		t.Error("choosing from a disjunction without candidates succeeded")
+	}
+	if _, err := makeFirstDisclosureChoice([][]irmaclient.DisclosureCandidates{{{
+		{AttributeIdentifier: &irma.AttributeIdentifier{Type: id}},
+	}}}); err == nil {
+		t.Error("choosing a credential that is not stored succeeded")
+	}
+}
+
+func TestEmptyDisclosureChoice(t *testing.T) {
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	present := irmaclient.DisclosureCandidates{{AttributeIdentifier: &irma.AttributeIdentifier{Type: id, CredentialHash: "hash"}}}
+	optional := []irmaclient.DisclosureCandidates{present, {}}
+
+	choice, skipped, ok := emptyDisclosureChoice([][]irmaclient.DisclosureCandidates{optional, optional})
+	if !ok {
+		t.Fatal("request of only optional disjunctions not recognised")
+	}
+	if len(choice.Attributes) != 2 || len(choice.Attributes[0]) != 0 || len(choice.Attributes[1]) != 0 {
+		t.Errorf("unexpected choice %v", choice.Attributes)
+	}
+	if joinInts(skipped) != "0,1" {
+		t.Errorf("skipped %v, want 0,1", skipped)
+	}
+
+	if _, _, ok := emptyDisclosureChoice([][]irmaclient.DisclosureCandidates{optional, {present}}); ok {
+		t.Error("request with a required disjunction treated as optional")
+	}
+	// Issuance without disclosure has no disjunctions, so there is nothing to skip
+	if _, _, ok := emptyDisclosureChoice(nil); ok {
+		t.Error("request without disjunctions treated as optional")
+	}
+}
+
+func TestUnusedCallbacksDoNotPanic(t *testing.T) {
+	log := captureEvents(t)
+	handler := newSessionHandler(newCommands(""), nil)
+
+	handler.ClientReturnURLSet("https://example.com/done")
+	if urls := log.named("client-return-url"); len(urls) != 1 || urls[0]["url"] != "https://example.com/done" {
+		t.Errorf("client-return-url events %v", urls)
+	}
+
+	proceeded := true
+	handler.RequestSchemeManagerPermission(&irma.SchemeManager{ID: "irma-demo"}, func(proceed bool) { proceeded = proceed })
+	if proceeded {
+		t.Error("scheme manager permission was granted")
+	}
+
+	handler.KeyshareEnrollmentIncomplete(irma.NewSchemeManagerIdentifier("test"))
+	if result := <-handler.completion; result.kind != outcomeEnrollmentIncomplete || result.exitCode() != exitUnenrolled {
+		t.Errorf("incomplete enrollment finished with %s, exit code %d", result.kind, result.exitCode())
+	}
+
+	newClientHandler().ReportError(errors.New("background job failed"))
+	if reported := log.named("client-error"); len(reported) != 1 || reported[0]["error"] != "background job failed" {
+		t.Errorf("client-error events %v", reported)
+	}
+}
+
+func TestCanSatisfy(t *testing.T) {
+	log := captureEvents(t)
+	candidate := func(id, hash string) *irmaclient.DisclosureCandidate {
+		return &irmaclient.DisclosureCandidate{AttributeIdentifier: &irma.AttributeIdentifier{
+			Type: irma.NewAttributeTypeIdentifier(id), CredentialHash: hash,
+		}}
+	}
+	req := &permissionRequest{candidates: [][]irmaclient.DisclosureCandidates{
+		{{candidate("irma-demo.RU.studentCard.studentID", "hash")}},
+		{{candidate("irma-demo.MijnOverheid.fullName.firstname", "")}},
+	}}
+
+	if !(&SessionHandler{}).reportSatisfiable(req) {
+		t.Error("a session that is not a can-satisfy check was declined")
+	}
+	if (&SessionHandler{canSatisfy: true}).reportSatisfiable(req) {
+		t.Error("a can-satisfy check was not declined")
+	}
+	if reported := log.named("can-satisfy"); len(reported) != 1 || reported[0]["satisfiable"] != false || reported[0]["unsatisfiable"] != "1" {
+		t.Errorf("can-satisfy events %v", reported)
+	}
+}
+
+func TestAllowTypes(t *testing.T) {
+	log := captureEvents(t)
+	allowedTypes = stringList{"irma-demo.RU.studentCard"}
+	t.Cleanup(func() { allowedTypes = nil })
+	attrs := []irma.AttributeTypeIdentifier{
+		irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+		irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN"),
+	}
+
+	if (&SessionHandler{}).allowTypes(&permissionRequest{request: irma.NewDisclosureRequest(attrs...)}) {
+		t.Error("disclosing a type that is not allowed was not declined")
+	}
+	if disallowed := log.named("type-not-allowed"); len(disallowed) != 1 || disallowed[0]["type"] != "irma-demo.MijnOverheid.root" {
+		t.Errorf("type-not-allowed events %v", disallowed)
+	}
+	if !(&SessionHandler{}).allowTypes(&permissionRequest{request: irma.NewIssuanceRequest(nil, attrs...)}) {
+		t.Error("issuance was declined")
+	}
+}
+
+func TestTransientFailure(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       *irma.SessionError
+		transient bool
+	}{
+		{"transport failure", &irma.SessionError{ErrorType: irma.ErrorTransport}, true},
+		{"unavailable server", &irma.SessionError{ErrorType: irma.ErrorServerResponse, RemoteStatus: 503}, true},
+		{"bad gateway", &irma.SessionError{ErrorType: irma.ErrorServerResponse, RemoteStatus: 502}, true},
+		{"bad request", &irma.SessionError{ErrorType: irma.ErrorServerResponse, RemoteStatus: 400}, false},
+		{"crypto failure", &irma.SessionError{ErrorType: irma.ErrorCrypto}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if transient := transientFailure(test.err); transient != test.transient {
+				t.Errorf("transient %t, want %t", transient, test.transient)
+			}
+		})
+	}
+}
+
+func TestStartupWithMissingConfiguration(t *testing.T) {
+	configuration := filepath.Join(t.TempDir(), "nonexistent")
+	_, stderr, code := runEmulator(t, "", true, "-storage", t.TempDir(), "-config", configuration)
+	if code != exitStartup {
+		t.Errorf("exit code %d, want %d", code, exitStartup)
+	}
+	if !strings.Contains(stderr, "Failed to start client") || !strings.Contains(stderr, configuration) {
+		t.Errorf("error does not mention the configuration path:\n%s", stderr)
+	}
+	if strings.Contains(stderr, "nil pointer") || strings.Contains(stderr, "panic") {
+		t.Errorf("emulator panicked:\n%s", stderr)
+	}
+}
+
+func TestNoSessionPointer(t *testing.T) {
+	_, stderr, code := runEmulator(t, "", true, emulatorArgs(t)...)
+	if code != exitStartup || !strings.Contains(stderr, "No session pointer received") {
+		t.Errorf("exit code %d when stdin closed without a session\n%s", code, stderr)
+	}
+	if strings.Contains(stderr, "panic") {
+		t.Errorf("emulator panicked:\n%s", stderr)
+	}
+}
+
+func TestCancelledOrigin(t *testing.T) {
+	log := captureEvents(t)
+	newSessionHandler(newCommands(""), nil).Cancelled()
+	declined := newSessionHandler(newCommands(""), nil)
+	declined.decline(func(proceed bool, choice *irma.DisclosureChoice) {})
+	declined.Cancelled()
+
+	cancelled := log.named("cancelled")
+	if len(cancelled) != 2 || cancelled[0]["origin"] != "server" || cancelled[1]["origin"] != "client" {
+		t.Errorf("cancelled events %v", cancelled)
+	}
+}
+
+// A disclosure request for three attributes of the studentCard credential in the test storage
+const studentCardRequest = `{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[[` +
+	`"irma-demo.RU.studentCard.university","irma-demo.RU.studentCard.studentID","irma-demo.RU.studentCard.level"]]]}`
+
+func TestFilterDisclosureChoice(t *testing.T) {
+	chosen := func(types ...string) []*irma.AttributeIdentifier {
+		ids := []*irma.AttributeIdentifier{}
+		for _, id := range types {
+			ids = append(ids, &irma.AttributeIdentifier{Type: irma.NewAttributeTypeIdentifier(id), CredentialHash: "hash"})
+		}
+		return ids
+	}
+	choice := &irma.DisclosureChoice{Attributes: [][]*irma.AttributeIdentifier{chosen(
+		"irma-demo.RU.studentCard.university", "irma-demo.RU.studentCard.studentID", "irma-demo.RU.studentCard.level",
+	)}}
+
+	subset := []string{"irma-demo.RU.studentCard.studentID", "irma-demo.RU.studentCard.level"}
+	if err := filterDisclosureChoice(choice, subset); err != nil {
+		t.Fatal(err)
+	}
+	filtered := []string{}
+	for _, id := range choice.Attributes[0] {
+		filtered = append(filtered, id.Type.String())
+	}
+	if !reflect.DeepEqual(filtered, subset) {
+		t.Errorf("filtered to %v", filtered)
+	}
+
+	choice.Attributes = append(choice.Attributes, chosen("irma-demo.MijnOverheid.root.BSN"))
+	if err := filterDisclosureChoice(choice, subset); err == nil || !strings.Contains(err.Error(), "irma-demo.MijnOverheid.root.BSN") {
+		t.Errorf("required type outside the subset gave %v", err)
+	}
+}
+
+func TestOverDisclosed(t *testing.T) {
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	attribute := func(id string) *irma.AttributeIdentifier {
+		return &irma.AttributeIdentifier{Type: irma.NewAttributeTypeIdentifier(id), CredentialHash: "hash"}
+	}
+	choice := &irma.DisclosureChoice{Attributes: [][]*irma.AttributeIdentifier{{
+		attribute("irma-demo.RU.studentCard.studentID"), attribute("irma-demo.RU.studentCard.level"),
+	}}}
+	if extra := overDisclosed(request.Disclose, choice); !reflect.DeepEqual(extra, []string{"irma-demo.RU.studentCard.level"}) {
+		t.Errorf("over-disclosed %v", extra)
+	}
+
+	choice.Attributes[0] = choice.Attributes[0][:1]
+	if extra := overDisclosed(request.Disclose, choice); len(extra) != 0 {
+		t.Errorf("requested attribute over-disclosed: %v", extra)
+	}
+}
+
+func TestAttributeSubset(t *testing.T) {
+	log := captureEvents(t)
+	setFlag(t, "attribute-subset", "irma-demo.RU.studentCard.studentID,irma-demo.RU.studentCard.level")
+	client, _ := newTestClient(t)
+
+	result := runTestSession(t, client, studentCardRequest, "yes\n")
+	if result.kind != outcomeSuccess {
+		t.Fatalf("session finished with %s\n%s", result.kind, log)
+	}
+	want := map[string]string{"irma-demo.RU.studentCard.studentID": "456", "irma-demo.RU.studentCard.level": "42"}
+	if !reflect.DeepEqual(result.disclosed, want) {
+		t.Errorf("disclosed %v, want %v", result.disclosed, want)
+	}
+
+	setFlag(t, "attribute-subset", "irma-demo.RU.studentCard.university")
+	if result := runTestSession(t, client, studentIDRequest, "yes\n"); result.kind != outcomeCancelled {
+		t.Errorf("session with a required type outside the subset finished with %s", result.kind)
+	}
+	if violations := log.named("subset-violation"); len(violations) != 1 {
+		t.Errorf("subset-violation events %v\n%s", violations, log)
+	}
+}
+
+func TestPermissionRequestEvent(t *testing.T) {
+	log := captureEvents(t)
+	client, _ := newTestClient(t)
+
+	if result := runTestSession(t, client, studentIDRequest, "yes\n"); result.kind != outcomeSuccess {
+		t.Fatalf("session finished with %s\n%s", result.kind, log)
+	}
+	requests := log.named("permission-request")
+	if len(requests) != 1 || requests[0]["action"] != "disclosing" || requests[0]["satisfiable"] != true {
+		t.Fatalf("permission-request events %v", requests)
+	}
+	var disjunctions []PermissionDisjunction
+	bts, _ := json.Marshal(requests[0]["disjunctions"])
+	if err := json.Unmarshal(bts, &disjunctions); err != nil {
+		t.Fatal(err)
+	}
+	if len(disjunctions) != 1 || len(disjunctions[0].Cons) == 0 || !disjunctions[0].Cons[0].Choosable {
+		t.Fatalf("disjunctions %+v", disjunctions)
+	}
+	candidate := disjunctions[0].Cons[0].Candidates[0]
+	if candidate.Type != "irma-demo.RU.studentCard.studentID" || candidate.CredentialHash == "" {
+		t.Errorf("candidate %+v", candidate)
+	}
+}
+
+func TestOutputFormatJSON(t *testing.T) {
+	stdout, stderr, code := runEmulator(t, studentIDRequest+"\nyes\n", true, emulatorArgs(t)...)
+	if code != exitSuccess {
+		t.Fatalf("exit code %d\n%s%s", code, stdout, stderr)
+	}
+	// Every line is an event, including those that are plain lines in text output
+	for _, line := range strings.Split(strings.TrimSpace(stdout), "\n") {
+		if !json.Valid([]byte(line)) {
+			t.Errorf("stdout line is not JSON: %s", line)
+		}
+	}
+	if len(eventsIn(stdout, "status-update")) == 0 {
+		t.Errorf("no status-update events\n%s", stdout)
+	}
+}
+
+func TestClientLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client.log")
+	stdout, stderr, code := runEmulator(t, studentIDRequest+"\nyes\n", true, emulatorArgs(t, "-client-log-file", path)...)
+	if code != exitSuccess {
+		t.Fatalf("exit code %d\n%s%s", code, stdout, stderr)
+	}
+	bts, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Logged by irmaclient when the emulator enables developer mode
+	if !strings.Contains(string(bts), "developer mode enabled") {
+		t.Errorf("irmaclient output missing from the log file:\n%s", bts)
+	}
+	if strings.Contains(stderr, "developer mode enabled") {
+		t.Errorf("irmaclient output still written to stderr:\n%s", stderr)
+	}
+}
+
+// countingStatusServer serves the given session status at GET /status and counts the requests.
+func countingStatusServer(t *testing.T, status irma.ServerStatus) (*httptest.Server, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/status" {
+			http.NotFound(w, r)
+			return
+		}
+		atomic.AddInt32(&requests, 1)
+		_ = json.NewEncoder(w).Encode(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+// pairingServer serves a disclosure session for studentID that requires the frontend to be
+// paired with pairing code 1234. The session stays in the pairing status until paired is
+// closed, and ends once the client cancels it.
+func pairingServer(t *testing.T, paired <-chan struct{}) *httptest.Server {
+	request := `{"@context":"https://irma.app/ld/request/disclosure/v2","protocolVersion":"2.8",` +
+		`"disclose":[[["irma-demo.RU.studentCard.studentID"]]]}`
+	var cancelled int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodDelete && r.URL.Path == "/session/":
+			atomic.StoreInt32(&cancelled, 1)
+			w.WriteHeader(http.StatusNoContent)
+		case r.URL.Path == "/session/":
+			_, _ = io.WriteString(w, `{"@context":"https://irma.app/ld/request/client/v1","protocolVersion":"2.8",`+
+				`"options":{"@context":"https://irma.app/ld/options/v1","pairingMethod":"pin","pairingCode":"1234"},`+
+				`"request":`+request+`}`)
+		case r.URL.Path == "/session/request":
+			_, _ = io.WriteString(w, request)
+		case r.URL.Path == "/session/status":
+			status := irma.ServerStatusPairing
+			select {
+			case <-paired:
+				status = irma.ServerStatusConnected
+			default:
+			}
+			if atomic.LoadInt32(&cancelled) == 1 {
+				status = irma.ServerStatusCancelled
+			}
+			// Without the trailing newline of json.Encoder, which irmaclient does not expect
+			_, _ = io.WriteString(w, `"`+string(status)+`"`)
+		default:
+			// Including the server-sent events, so that the client polls the status instead
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestPairingAccept(t *testing.T) {
+	paired := make(chan struct{})
+	close(paired)
+	server := pairingServer(t, paired)
+	pointer := fmt.Sprintf(`{"u":%q,"irmaqr":"disclosing"}`, server.URL+"/session")
+
+	stdout, stderr, code := runEmulator(t, pointer+"\ncancel\n", true, emulatorArgs(t, "-pairing", "accept")...)
+	if code != exitSuccess || len(eventsIn(stdout, "cancelled")) != 1 {
+		t.Fatalf("exit code %d\n%s%s", code, stdout, stderr)
+	}
+	if required := eventsIn(stdout, "pairing-required"); len(required) != 1 || required[0]["code"] != "1234" {
+		t.Errorf("pairing-required events %v", required)
+	}
+	protocol := eventsIn(stdout, "frontend-protocol")
+	if len(protocol) != 1 || protocol[0]["version"] != "2.8" || protocol[0]["pairing_required"] != true || protocol[0]["paired"] != true {
+		t.Errorf("frontend-protocol events %v", protocol)
+	}
+}
+
+func TestPairingDisabled(t *testing.T) {
+	// The frontend is never paired, so the client would wait forever if the emulator did not fail
+	server := pairingServer(t, make(chan struct{}))
+	pointer := fmt.Sprintf(`{"u":%q,"irmaqr":"disclosing"}`, server.URL+"/session")
+
+	stdout, stderr, code := runEmulator(t, pointer+"\n", true, emulatorArgs(t, "-pairing", "disabled")...)
+	if code != exitFailure {
+		t.Fatalf("exit code %d, want %d\n%s%s", code, exitFailure, stdout, stderr)
+	}
+	if disabled := eventsIn(stdout, "pairing-disabled"); len(disabled) != 1 || disabled[0]["code"] != "1234" {
+		t.Errorf("pairing-disabled events %v", disabled)
+	}
+	failure := eventsIn(stdout, "failure")
+	if len(failure) != 1 || failure[0]["type"] != string(irma.ErrorPairingRejected) || failure[0]["category"] != "protocol" {
+		t.Errorf("failure events %v", failure)
+	}
+	if protocol := eventsIn(stdout, "frontend-protocol"); len(protocol) != 0 {
+		t.Errorf("frontend-protocol events %v without pairing", protocol)
+	}
+}
+
+func TestFrontendProtocolWithoutPairing(t *testing.T) {
+	stdout, stderr, code := runEmulator(t, studentIDRequest+"\nyes\n", true, emulatorArgs(t)...)
+	if code != exitSuccess {
+		t.Fatalf("exit code %d\n%s%s", code, stdout, stderr)
+	}
+	protocol := eventsIn(stdout, "frontend-protocol")
+	if len(protocol) != 1 || protocol[0]["pairing_required"] != false || protocol[0]["paired"] != false {
+		t.Errorf("frontend-protocol events %v", protocol)
+	}
+}
+
+func TestStatusPollingPerTick(t *testing.T) {
+	log := captureEvents(t)
+	server, requests := countingStatusServer(t, irma.ServerStatusConnected)
+	pointer := fmt.Sprintf(`{"u":%q,"irmaqr":"disclosing"}`, server.URL)
+
+	ticks := make(chan time.Time)
+	stop := make(chan struct{})
+	done := watchServerStatus(newSessionHandler(newCommands(""), nil), pointer, true, ticks, stop)
+	for i := 0; i < 3; i++ {
+		ticks <- time.Now()
+	}
+	close(stop)
+	<-done
+
+	// Polled once at the start, once per tick and once more after stopping
+	if n := atomic.LoadInt32(requests); n != 5 {
+		t.Errorf("%d status requests for 3 ticks, want 5", n)
+	}
+	if statuses := log.named("server-status"); len(statuses) != 1 || statuses[0]["status"] != "connected" {
+		t.Errorf("server-status events %v", statuses)
+	}
+}
+
+func TestStatusPollingStopsWhenFinished(t *testing.T) {
+	captureEvents(t)
+	server, requests := countingStatusServer(t, irma.ServerStatusDone)
+	pointer := fmt.Sprintf(`{"u":%q,"irmaqr":"disclosing"}`, server.URL)
+	select {
+	case <-watchServerStatus(newSessionHandler(newCommands(""), nil), pointer, true, nil, make(chan struct{})):
+	case <-time.After(5 * time.Second):
+		t.Fatal("polling did not stop once the session was done")
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Errorf("%d status requests for a finished session", n)
+	}
+}
+
+// delayedResultServer serves an empty result until the delay has passed since it started,
+// and the given result after that.
+func delayedResultServer(t *testing.T, delay time.Duration, result string) *httptest.Server {
+	available := time.Now().Add(delay)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if time.Now().Before(available) {
+			_, _ = io.WriteString(w, "{}")
+			return
+		}
+		_, _ = io.WriteString(w, result)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestAwaitResult(t *testing.T) {
+	server := delayedResultServer(t, 100*time.Millisecond, `{"status":"DONE"}`)
+	start := time.Now()
+	body, err := awaitResult(server.URL+"/result", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != `{"status":"DONE"}` {
+		t.Errorf("result %s", body)
+	}
+	if waited := time.Since(start); waited < 100*time.Millisecond {
+		t.Errorf("result returned after %s, before it was available", waited)
+	}
+
+	never := delayedResultServer(t, time.Hour, "")
+	if _, err := awaitResult(never.URL+"/result", 300*time.Millisecond); err == nil {
+		t.Error("waiting for a result that never comes succeeded")
+	}
+}
+
+func TestResultTimeout(t *testing.T) {
+	log := captureEvents(t)
+	server := delayedResultServer(t, 100*time.Millisecond, `{"status":"DONE"}`)
+	setFlag(t, "result-url", server.URL+"/result")
+	setFlag(t, "result-timeout", "250ms")
+	client, _ := newTestClient(t)
+
+	if result := runTestSession(t, client, studentIDRequest, "yes\n"); result.kind != outcomeSuccess {
+		t.Fatalf("session finished with %s\n%s", result.kind, log)
+	}
+	if delayed := log.named("delayed-result"); len(delayed) != 1 || delayed[0]["result"] != `{"status":"DONE"}` {
+		t.Errorf("delayed-result events %v", delayed)
+	}
+
+	setFlag(t, "result-url", delayedResultServer(t, time.Hour, "").URL+"/result")
+	if result := runTestSession(t, client, studentIDRequest, "yes\n"); result.kind != outcomeFailure {
+		t.Errorf("session without a result finished with %s", result.kind)
+	}
+	if timeouts := log.named("result-timeout"); len(timeouts) != 1 {
+		t.Errorf("result-timeout events %v", timeouts)
+	}
+}
+
+func TestMemoryProfileOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "heap.pprof")
+	stdout, stderr, code := runEmulator(t, studentIDRequest+"\nyes\n", true, emulatorArgs(t, "-memory-profile-output", path)...)
+	if code != exitSuccess {
+		t.Fatalf("exit code %d\n%s%s", code, stdout, stderr)
+	}
+	bts, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pprof profiles are gzip-compressed protocol buffers
+	if !bytes.HasPrefix(bts, []byte{0x1f, 0x8b}) {
+		t.Errorf("profile of %d bytes does not start with the gzip magic bytes", len(bts))
+	}
+}
+
+func TestCandidateTimeout(t *testing.T) {
+	log := captureEvents(t)
+	setFlag(t, "candidate-timeout", "200ms")
+	client, _ := newTestClient(t)
+
+	// A pipe that sends nothing until the prompt has timed out
+	input, typed := io.Pipe()
+	defer typed.Close()
+	commands := newDispatcher()
+	commands.start(input)
+
+	start := time.Now()
+	result, _ := handleSession(client, commands, 0, parseCommand(studentIDRequest), nil, nil)
+	if result.kind != outcomeCancelled {
+		t.Fatalf("unanswered session finished with %s\n%s", result.kind, log)
+	}
+	if waited := time.Since(start); waited < 200*time.Millisecond || waited > 5*time.Second {
+		t.Errorf("session cancelled after %s", waited)
+	}
+	if timeouts := log.named("candidate-timeout"); len(timeouts) != 1 {
+		t.Errorf("candidate-timeout events %v", timeouts)
+	}
+
+	// The late answer belongs to the prompt that timed out, not to a later one
+	if _, err := io.WriteString(typed, "yes\n"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(log.named("command-discarded")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if discarded := log.named("command-discarded"); len(discarded) != 1 || discarded[0]["prompt"] != "permission" {
+		t.Errorf("command-discarded events %v", discarded)
+	}
+}
+
+func TestLogRequestorInfo(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	conf, err := readConfiguration(testConfiguration(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := newSessionHandler(newCommands(""), nil)
+	handler.correlationID = "test-session"
+
+	// Without a configuration the logo cannot be located, but the rest is still logged
+	info := conf.Requestors["localhost"]
+	handler.logRequestorInfo(info)
+	handler.configuration = conf
+	handler.logRequestorInfo(info)
+	handler.logRequestorInfo(nil)
+
+	lines := strings.Split(strings.TrimSpace(logged.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("logged %q", logged.String())
+	}
+	for _, line := range lines[:2] {
+		if !strings.Contains(line, `INFO session_id=test-session requestor name="Local IRMA server"`) ||
+			!strings.Contains(line, "hostnames=localhost verified=true") {
+			t.Errorf("logged %q", line)
+		}
+	}
+	logo := "http://localhost:48681/irma_configuration/test-requestors/assets/" + *info.Logo + ".png"
+	if !strings.Contains(lines[0], `logo=""`) || !strings.Contains(lines[1], "logo=\""+logo+"\"") {
+		t.Errorf("logged logos in %q", lines[:2])
+	}
+	if !strings.Contains(lines[2], "requestor unknown") {
+		t.Errorf("logged %q for an unknown requestor", lines[2])
+	}
+}
+
+func TestWaitForClient(t *testing.T) {
+	setFlag(t, "wait-for-client", "true")
+	log := captureEvents(t)
+	client, _ := newTestClient(t)
+	if result := runTestSession(t, client, studentIDRequest, "yes\n"); result.kind != outcomeSuccess {
+		t.Fatalf("session ended with %v", result)
+	}
+	emitted := log.String()
+	connected := strings.Index(emitted, `"status":"connected"`)
+	if connected < 0 || strings.Index(emitted, `"event":"client-connected"`) < connected ||
+		strings.Index(emitted, `"event":"permission-request"`) < connected {
+		t.Errorf("did not wait for the connected status before asking for permission:\n%s", emitted)
+	}
+}
+
+func TestWaitStatus(t *testing.T) {
+	handler := newSessionHandler(newCommands(""), nil)
+	waited := make(chan error, 1)
+	go func() { waited <- handler.waitStatus(irma.ClientStatusConnected, nil) }()
+
+	handler.StatusUpdate(irma.ActionDisclosing, irma.ClientStatusCommunicating)
+	select {
+	case err := <-waited:
+		t.Fatalf("returned %v before the connected status", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	handler.StatusUpdate(irma.ActionDisclosing, irma.ClientStatusConnected)
+	select {
+	case err := <-waited:
+		if err != nil {
+			t.Errorf("returned %v after the connected status", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("still waiting after the connected status")
+	}
+
+	// A status reported earlier counts, and a session that finishes first ends the wait
+	if err := handler.waitStatus(irma.ClientStatusConnected, nil); err != nil {
+		t.Errorf("returned %v for an earlier status", err)
+	}
+	handler.finish(outcome{kind: outcomeCancelled})
+	if err := handler.waitStatus(irma.ClientStatusManualStarted, nil); err == nil || err.Error() != "session finished first" {
+		t.Errorf("returned %v for a finished session", err)
+	}
+	timeout := make(chan time.Time)
+	close(timeout)
+	if err := newSessionHandler(newCommands(""), nil).waitStatus(irma.ClientStatusConnected, timeout); err == nil {
+		t.Error("returned no error once the timeout expired")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	setFlag(t, "retries", "2")
+	setFlag(t, "retry-backoff", "10ms")
+	client, _ := newDeveloperClient(t)
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer failing.Close()
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+
+	tests := []struct {
+		name    string
+		retryOn string
+		url     string
+		retries int
+	}{
+		{"transport failure", "transport", closed.URL, 2},
+		{"server failure", "transport", failing.URL, 0},
+		{"unavailable server, transport only", "transport", unavailable.URL, 0},
+		{"transient transport failure", "transient", closed.URL, 2},
+		{"transient server failure", "transient", unavailable.URL, 2},
+		{"permanent server failure", "transient", failing.URL, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setFlag(t, "retry-on", test.retryOn)
+			log := captureEvents(t)
+			pointer := fmt.Sprintf(`{"u":"%s/irma/session/abc","irmaqr":"disclosing"}`, test.url)
+			if result := runTestSession(t, client, pointer, ""); result.kind != outcomeFailure {
+				t.Errorf("session outcome %s, want %s", result.kind, outcomeFailure)
+			}
+			if retries := log.named("retry"); len(retries) != test.retries {
+				t.Errorf("%d retry events, want %d\n%s", len(retries), test.retries, log)
+			}
+			if summary := log.named("summary"); len(summary) != 1 || summary[0]["attempts"] != float64(test.retries+1) {
+				t.Errorf("summary events %v", summary)
+			}
+		})
+	}
+}
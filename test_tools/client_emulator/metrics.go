@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The upper bounds in seconds of the buckets of irma_session_duration_seconds; sessions that
+// wait for a (scripted) user take seconds rather than milliseconds
+var sessionDurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type durationHistogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// PrometheusExporter counts the finished sessions and their durations by outcome, and serves
+// them by GET /metrics on the -listen address in the Prometheus text format, as
+// irma_session_total and irma_session_duration_seconds.
+type PrometheusExporter struct {
+	mutex     sync.Mutex
+	buckets   []float64
+	sessions  map[outcomeKind]uint64
+	durations map[outcomeKind]*durationHistogram
+}
+
+func NewPrometheusExporter(buckets []float64) *PrometheusExporter {
+	return &PrometheusExporter{
+		buckets:   buckets,
+		sessions:  map[outcomeKind]uint64{},
+		durations: map[outcomeKind]*durationHistogram{},
+	}
+}
+
+// The metrics of all sessions
+var sessionMetrics = NewPrometheusExporter(sessionDurationBuckets)
+
+// Observe counts a finished session with the given outcome and duration.
+func (e *PrometheusExporter) Observe(kind outcomeKind, duration time.Duration) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.sessions[kind]++
+	h, ok := e.durations[kind]
+	if !ok {
+		h = &durationHistogram{counts: make([]uint64, len(e.buckets))}
+		e.durations[kind] = h
+	}
+	seconds := duration.Seconds()
+	for i, bound := range e.buckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// write writes the metrics in the Prometheus text exposition format, ordered by outcome.
+func (e *PrometheusExporter) write(buf *bytes.Buffer) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	kinds := make([]string, 0, len(e.sessions))
+	for kind := range e.sessions {
+		kinds = append(kinds, string(kind))
+	}
+	sort.Strings(kinds)
+
+	fmt.Fprintln(buf, "# HELP irma_session_total Number of sessions that finished, by outcome.")
+	fmt.Fprintln(buf, "# TYPE irma_session_total counter")
+	for _, kind := range kinds {
+		fmt.Fprintf(buf, "irma_session_total{outcome=%q} %d\n", kind, e.sessions[outcomeKind(kind)])
+	}
+
+	fmt.Fprintln(buf, "# HELP irma_session_duration_seconds Duration of the sessions that finished, by outcome.")
+	fmt.Fprintln(buf, "# TYPE irma_session_duration_seconds histogram")
+	for _, kind := range kinds {
+		h := e.durations[outcomeKind(kind)]
+		cumulative := uint64(0)
+		for i, bound := range e.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(buf, "irma_session_duration_seconds_bucket{outcome=%q,le=%q} %d\n",
+				kind, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(buf, "irma_session_duration_seconds_bucket{outcome=%q,le=\"+Inf\"} %d\n", kind, h.count)
+		fmt.Fprintf(buf, "irma_session_duration_seconds_sum{outcome=%q} %s\n", kind, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(buf, "irma_session_duration_seconds_count{outcome=%q} %d\n", kind, h.count)
+	}
+}
+
+func (e *PrometheusExporter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var buf bytes.Buffer
+	e.write(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write(buf.Bytes())
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// getMetrics returns the body of GET /metrics on the server.
+func getMetrics(t *testing.T, server *httptest.Server) string {
+	t.Helper()
+	res, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK || !strings.HasPrefix(res.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("GET /metrics gave %s, %s", res.Status, res.Header.Get("Content-Type"))
+	}
+	bts, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(bts)
+}
+
+func TestPrometheusExporter(t *testing.T) {
+	exporter := NewPrometheusExporter([]float64{0.1, 1})
+	server := httptest.NewServer(exporter)
+	defer server.Close()
+
+	if metrics := getMetrics(t, server); strings.Contains(metrics, "{outcome=") {
+		t.Errorf("exported %q before any session finished", metrics)
+	}
+
+	exporter.Observe(outcomeSuccess, 50*time.Millisecond)
+	exporter.Observe(outcomeSuccess, 2*time.Second)
+	exporter.Observe(outcomeCancelled, 500*time.Millisecond)
+	want := `# HELP irma_session_total Number of sessions that finished, by outcome.
+# TYPE irma_session_total counter
+irma_session_total{outcome="cancelled"} 1
+irma_session_total{outcome="success"} 2
+# HELP irma_session_duration_seconds Duration of the sessions that finished, by outcome.
+# TYPE irma_session_duration_seconds histogram
+irma_session_duration_seconds_bucket{outcome="cancelled",le="0.1"} 0
+irma_session_duration_seconds_bucket{outcome="cancelled",le="1"} 1
+irma_session_duration_seconds_bucket{outcome="cancelled",le="+Inf"} 1
+irma_session_duration_seconds_sum{outcome="cancelled"} 0.5
+irma_session_duration_seconds_count{outcome="cancelled"} 1
+irma_session_duration_seconds_bucket{outcome="success",le="0.1"} 1
+irma_session_duration_seconds_bucket{outcome="success",le="1"} 1
+irma_session_duration_seconds_bucket{outcome="success",le="+Inf"} 2
+irma_session_duration_seconds_sum{outcome="success"} 2.05
+irma_session_duration_seconds_count{outcome="success"} 2
+`
+	if metrics := getMetrics(t, server); metrics != want {
+		t.Errorf("exported\n%s\nwant\n%s", metrics, want)
+	}
+
+	exporter.Observe(outcomeSuccess, time.Second)
+	metrics := getMetrics(t, server)
+	if !strings.Contains(metrics, "irma_session_total{outcome=\"success\"} 3\n") ||
+		!strings.Contains(metrics, "irma_session_duration_seconds_bucket{outcome=\"success\",le=\"1\"} 2\n") {
+		t.Errorf("exported\n%s\nafter another session succeeded", metrics)
+	}
+
+	res, err := http.Post(server.URL+"/metrics", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST /metrics gave %s", res.Status)
+	}
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+)
+
+// SessionMiddleware wraps a session handler, so that behaviour can be added around the
+// callbacks irmaclient makes without touching the handler itself.
+type SessionMiddleware func(next irmaclient.Handler) irmaclient.Handler
+
+// Chain wraps handler in the given middleware. The first middleware is the outermost one,
+// i.e. it sees every callback first. The chain needs a handler to end in, as a middleware only
+// adds behaviour around the callbacks and someone has to answer them.
+func Chain(handler irmaclient.Handler, middleware ...SessionMiddleware) irmaclient.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// unwrapSessionHandler returns the session handler, looking through any middleware wrapping
+// it, or nil if there is none.
+func unwrapSessionHandler(handler irmaclient.Handler) *SessionHandler {
+	for {
+		switch h := handler.(type) {
+		case *SessionHandler:
+			return h
+		case *loggingHandler:
+			handler = h.Handler
+		case *metricsHandler:
+			handler = h.Handler
+		case *assertionHandler:
+			handler = h.Handler
+		default:
+			return nil
+		}
+	}
+}
+
+// emitFrom emits the event on behalf of the session handler wrapped by handler, so that it
+// identifies the session like the handler's own events do.
+func emitFrom(handler irmaclient.Handler, event string, fields ...interface{}) {
+	if s := unwrapSessionHandler(handler); s != nil {
+		s.emit(event, fields...)
+		return
+	}
+	emit(event, fields...)
+}
+
+// LoggingMiddleware logs every callback to stderr before passing it on.
+func LoggingMiddleware(next irmaclient.Handler) irmaclient.Handler {
+	return &loggingHandler{next}
+}
+
+type loggingHandler struct {
+	irmaclient.Handler
+}
+
+func (h *loggingHandler) printf(format string, args ...interface{}) {
+	if s := unwrapSessionHandler(h.Handler); s != nil {
+		format = "session_id=%s " + format
+		args = append([]interface{}{s.correlationID}, args...)
+		if s.id != 0 {
+			format = "[session %d] " + format
+			args = append([]interface{}{s.id}, args...)
+		}
+	}
+	log.Printf(format, args...)
+}
+
+func (h *loggingHandler) StatusUpdate(action irma.Action, status irma.ClientStatus) {
+	h.printf("StatusUpdate(%s, %s)", action, status)
+	h.Handler.StatusUpdate(action, status)
+}
+
+func (h *loggingHandler) ClientReturnURLSet(clientReturnURL string) {
+	h.printf("ClientReturnURLSet(%s)", clientReturnURL)
+	h.Handler.ClientReturnURLSet(clientReturnURL)
+}
+
+func (h *loggingHandler) PairingRequired(pairingCode string) {
+	h.printf("PairingRequired(%s)", pairingCode)
+	h.Handler.PairingRequired(pairingCode)
+}
+
+func (h *loggingHandler) Success(result string) {
+	h.printf("Success(%s)", result)
+	h.Handler.Success(result)
+}
+
+func (h *loggingHandler) Cancelled() {
+	h.printf("Cancelled()")
+	h.Handler.Cancelled()
+}
+
+func (h *loggingHandler) Failure(err *irma.SessionError) {
+	h.printf("Failure(%s)", err.ErrorType)
+	h.Handler.Failure(err)
+}
+
+func (h *loggingHandler) KeyshareBlocked(manager irma.SchemeManagerIdentifier, duration int) {
+	h.printf("KeyshareBlocked(%s, %d)", manager, duration)
+	h.Handler.KeyshareBlocked(manager, duration)
+}
+
+func (h *loggingHandler) KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIdentifier) {
+	h.printf("KeyshareEnrollmentIncomplete(%s)", manager)
+	h.Handler.KeyshareEnrollmentIncomplete(manager)
+}
+
+func (h *loggingHandler) KeyshareEnrollmentMissing(manager irma.SchemeManagerIdentifier) {
+	h.printf("KeyshareEnrollmentMissing(%s)", manager)
+	h.Handler.KeyshareEnrollmentMissing(manager)
+}
+
+func (h *loggingHandler) KeyshareEnrollmentDeleted(manager irma.SchemeManagerIdentifier) {
+	h.printf("KeyshareEnrollmentDeleted(%s)", manager)
+	h.Handler.KeyshareEnrollmentDeleted(manager)
+}
+
+func (h *loggingHandler) RequestIssuancePermission(request *irma.IssuanceRequest,
+	satisfiable bool,
+	candidates [][]irmaclient.DisclosureCandidates,
+	requestorInfo *irma.RequestorInfo,
+	callback irmaclient.PermissionHandler) {
+	h.printf("RequestIssuancePermission(satisfiable=%t)", satisfiable)
+	h.Handler.RequestIssuancePermission(request, satisfiable, candidates, requestorInfo, callback)
+}
+
+func (h *loggingHandler) RequestVerificationPermission(request *irma.DisclosureRequest,
+	satisfiable bool,
+	candidates [][]irmaclient.DisclosureCandidates,
+	requestorInfo *irma.RequestorInfo,
+	callback irmaclient.PermissionHandler) {
+	h.printf("RequestVerificationPermission(satisfiable=%t)", satisfiable)
+	h.Handler.RequestVerificationPermission(request, satisfiable, candidates, requestorInfo, callback)
+}
+
+func (h *loggingHandler) RequestSignaturePermission(request *irma.SignatureRequest,
+	satisfiable bool,
+	candidates [][]irmaclient.DisclosureCandidates,
+	requestorInfo *irma.RequestorInfo,
+	callback irmaclient.PermissionHandler) {
+	h.printf("RequestSignaturePermission(satisfiable=%t)", satisfiable)
+	h.Handler.RequestSignaturePermission(request, satisfiable, candidates, requestorInfo, callback)
+}
+
+func (h *loggingHandler) RequestSchemeManagerPermission(manager *irma.SchemeManager,
+	callback func(proceed bool)) {
+	h.printf("RequestSchemeManagerPermission(%s)", manager.ID)
+	h.Handler.RequestSchemeManagerPermission(manager, callback)
+}
+
+func (h *loggingHandler) RequestPin(remainingAttempts int, callback irmaclient.PinHandler) {
+	h.printf("RequestPin(%d)", remainingAttempts)
+	h.Handler.RequestPin(remainingAttempts, callback)
+}
+
+// MetricsMiddleware measures how long the session took, how much of that was spent waiting
+// for permission decisions, and how many status updates occurred, and emits these once the
+// session has finished. For successful disclosure and signature sessions it also emits the
+// size of the proof, and the number of credentials and attributes involved.
+func MetricsMiddleware(next irmaclient.Handler) irmaclient.Handler {
+	return &metricsHandler{Handler: next, start: time.Now()}
+}
+
+type metricsHandler struct {
+	irmaclient.Handler
+
+	mutex          sync.Mutex
+	start          time.Time
+	statusUpdates  int
+	permissionWait time.Duration
+}
+
+func (h *metricsHandler) emit(kind outcomeKind) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	emitFrom(h.Handler, "metrics",
+		"outcome", kind,
+		"duration", time.Since(h.start),
+		"permission_wait", h.permissionWait,
+		"status_updates", h.statusUpdates,
+	)
+}
+
+func (h *metricsHandler) timed(callback irmaclient.PermissionHandler) irmaclient.PermissionHandler {
+	asked := time.Now()
+	return func(proceed bool, choice *irma.DisclosureChoice) {
+		h.mutex.Lock()
+		h.permissionWait += time.Since(asked)
+		h.mutex.Unlock()
+		callback(proceed, choice)
+	}
+}
+
+func (h *metricsHandler) StatusUpdate(action irma.Action, status irma.ClientStatus) {
+	h.mutex.Lock()
+	h.statusUpdates++
+	h.mutex.Unlock()
+	h.Handler.StatusUpdate(action, status)
+}
+
+func (h *metricsHandler) Success(result string) {
+	h.emit(outcomeSuccess)
+	if proofBytes, credentials, attributes, ok := proofContents(result); ok {
+		emitFrom(h.Handler, "proof-metrics",
+			"proof_bytes", proofBytes,
+			"credentials", credentials,
+			"attributes", attributes,
+		)
+	}
+	h.Handler.Success(result)
+}
+
+// proofContents returns the size in bytes of the marshalled proofs, and the number of
+// credentials and disclosed attributes, in the result of a disclosure or signature session,
+// which is the serialized disclosure or signed message. The size covers only the proofs, not
+// the indices, message or timestamp alongside them.
+func proofContents(result string) (int, int, int, bool) {
+	var proof struct {
+		Proofs    []json.RawMessage   `json:"proofs"`    // disclosures
+		Signature []json.RawMessage   `json:"signature"` // signed messages
+		Indices   [][]json.RawMessage `json:"indices"`
+	}
+	if err := json.Unmarshal([]byte(result), &proof); err != nil {
+		return 0, 0, 0, false
+	}
+	proofs := proof.Proofs
+	if proofs == nil {
+		proofs = proof.Signature
+	}
+	if proofs == nil {
+		return 0, 0, 0, false
+	}
+	bts, err := json.Marshal(proofs)
+	if err != nil {
+		return 0, 0, 0, false
+	}
+	attributes := 0
+	for _, indices := range proof.Indices {
+		attributes += len(indices)
+	}
+	return len(bts), len(proofs), attributes, true
+}
+
+func (h *metricsHandler) Cancelled() {
+	h.emit(outcomeCancelled)
+	h.Handler.Cancelled()
+}
+
+func (h *metricsHandler) Failure(err *irma.SessionError) {
+	h.emit(outcomeFailure)
+	h.Handler.Failure(err)
+}
+
+func (h *metricsHandler) KeyshareBlocked(manager irma.SchemeManagerIdentifier, duration int) {
+	h.emit(outcomeBlocked)
+	h.Handler.KeyshareBlocked(manager, duration)
+}
+
+func (h *metricsHandler) KeyshareEnrollmentMissing(manager irma.SchemeManagerIdentifier) {
+	h.emit(outcomeEnrollmentMissing)
+	h.Handler.KeyshareEnrollmentMissing(manager)
+}
+
+func (h *metricsHandler) KeyshareEnrollmentDeleted(manager irma.SchemeManagerIdentifier) {
+	h.emit(outcomeEnrollmentDeleted)
+	h.Handler.KeyshareEnrollmentDeleted(manager)
+}
+
+func (h *metricsHandler) KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIdentifier) {
+	h.emit(outcomeEnrollmentIncomplete)
+	h.Handler.KeyshareEnrollmentIncomplete(manager)
+}
+
+func (h *metricsHandler) RequestIssuancePermission(request *irma.IssuanceRequest,
+	satisfiable bool,
+	candidates [][]irmaclient.DisclosureCandidates,
+	requestorInfo *irma.RequestorInfo,
+	callback irmaclient.PermissionHandler) {
+	h.Handler.RequestIssuancePermission(request, satisfiable, candidates, requestorInfo, h.timed(callback))
+}
+
+func (h *metricsHandler) RequestVerificationPermission(request *irma.DisclosureRequest,
+	satisfiable bool,
+	candidates [][]irmaclient.DisclosureCandidates,
+	requestorInfo *irma.RequestorInfo,
+	callback irmaclient.PermissionHandler) {
+	h.Handler.RequestVerificationPermission(request, satisfiable, candidates, requestorInfo, h.timed(callback))
+}
+
+func (h *metricsHandler) RequestSignaturePermission(request *irma.SignatureRequest,
+	satisfiable bool,
+	candidates [][]irmaclient.DisclosureCandidates,
+	requestorInfo *irma.RequestorInfo,
+	callback irmaclient.PermissionHandler) {
+	h.Handler.RequestSignaturePermission(request, satisfiable, candidates, requestorInfo, h.timed(callback))
+}
+
+// AssertionMiddleware checks that irmaclient keeps to the handler contract: a session finishes
+// exactly once, nothing but status updates follow after that, and every permission callback is
+// answered at most once. Violations are emitted as assertion-failed events.
+func AssertionMiddleware(next irmaclient.Handler) irmaclient.Handler {
+	return &assertionHandler{Handler: next}
+}
+
+type assertionHandler struct {
+	irmaclient.Handler
+
+	mutex    sync.Mutex
+	finished string
+}
+
+func (h *assertionHandler) finish(callback string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.finished != "" {
+		emitFrom(h.Handler, "assertion-failed", "reason", "session finished twice", "first", h.finished, "second", callback)
+		return
+	}
+	h.finished = callback
+}
+
+func (h *assertionHandler) requireActive(callback string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.finished != "" {
+		emitFrom(h.Handler, "assertion-failed", "reason", "callback after session finished", "callback", callback, "finished", h.finished)
+	}
+}
+
+func (h *assertionHandler) once(callback irmaclient.PermissionHandler) irmaclient.PermissionHandler {
+	var mutex sync.Mutex
+	answered := false
+	return func(proceed bool, choice *irma.DisclosureChoice) {
+		mutex.Lock()
+		twice := answered
+		answered = true
+		mutex.Unlock()
+		if twice {
+			emitFrom(h.Handler, "assertion-failed", "reason", "permission answered twice")
+			return
+		}
+		callback(proceed, choice)
+	}
+}
+
+func (h *assertionHandler) Success(result string) {
+	h.finish("Success")
+	h.Handler.Success(result)
+}
+
+func (h *assertionHandler) Cancelled() {
+	h.finish("Cancelled")
+	h.Handler.Cancelled()
+}
+
+func (h *assertionHandler) Failure(err *irma.SessionError) {
+	h.finish("Failure")
+	h.Handler.Failure(err)
+}
+
+func (h *assertionHandler) KeyshareBlocked(manager irma.SchemeManagerIdentifier, duration int) {
+	h.finish("KeyshareBlocked")
+	h.Handler.KeyshareBlocked(manager, duration)
+}
+
+func (h *assertionHandler) KeyshareEnrollmentMissing(manager irma.SchemeManagerIdentifier) {
+	h.finish("KeyshareEnrollmentMissing")
+	h.Handler.KeyshareEnrollmentMissing(manager)
+}
+
+func (h *assertionHandler) KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIdentifier) {
+	h.finish("KeyshareEnrollmentIncomplete")
+	h.Handler.KeyshareEnrollmentIncomplete(manager)
+}
+
+func (h *assertionHandler) KeyshareEnrollmentDeleted(manager irma.SchemeManagerIdentifier) {
+	h.finish("KeyshareEnrollmentDeleted")
+	h.Handler.KeyshareEnrollmentDeleted(manager)
+}
+
+func (h *assertionHandler) RequestIssuancePermission(request *irma.IssuanceRequest,
+	satisfiable bool,
+	candidates [][]irmaclient.DisclosureCandidates,
+	requestorInfo *irma.RequestorInfo,
+	callback irmaclient.PermissionHandler) {
+	h.requireActive("RequestIssuancePermission")
+	h.Handler.RequestIssuancePermission(request, satisfiable, candidates, requestorInfo, h.once(callback))
+}
+
+func (h *assertionHandler) RequestVerificationPermission(request *irma.DisclosureRequest,
+	satisfiable bool,
+	candidates [][]irmaclient.DisclosureCandidates,
+	requestorInfo *irma.RequestorInfo,
+	callback irmaclient.PermissionHandler) {
+	h.requireActive("RequestVerificationPermission")
+	h.Handler.RequestVerificationPermission(request, satisfiable, candidates, requestorInfo, h.once(callback))
+}
+
+func (h *assertionHandler) RequestSignaturePermission(request *irma.SignatureRequest,
+	satisfiable bool,
+	candidates [][]irmaclient.DisclosureCandidates,
+	requestorInfo *irma.RequestorInfo,
+	callback irmaclient.PermissionHandler) {
+	h.requireActive("RequestSignaturePermission")
+	h.Handler.RequestSignaturePermission(request, satisfiable, candidates, requestorInfo, h.once(callback))
+}
+
+func (h *assertionHandler) RequestPin(remainingAttempts int, callback irmaclient.PinHandler) {
+	h.requireActive("RequestPin")
+	h.Handler.RequestPin(remainingAttempts, callback)
+}
+
+// SessionHandlerAdapter implements irmaclient.Handler without doing anything, so that a
+// handler can embed it and implement only the callbacks it cares about. Requests for
+// permission or a PIN are refused, as ignoring them would leave the session waiting forever.
+type SessionHandlerAdapter struct{}
+
+var _ irmaclient.Handler = SessionHandlerAdapter{}
+
+func (SessionHandlerAdapter) StatusUpdate(action irma.Action, status irma.ClientStatus) {}
+func (SessionHandlerAdapter) ClientReturnURLSet(clientReturnURL string)                 {}
+func (SessionHandlerAdapter) PairingRequired(pairingCode string)                        {}
+func (SessionHandlerAdapter) Success(result string)                                     {}
+func (SessionHandlerAdapter) Cancelled()                                                {}
+func (SessionHandlerAdapter) Failure(err *irma.SessionError)                            {}
+
+func (SessionHandlerAdapter) KeyshareBlocked(manager irma.SchemeManagerIdentifier, duration int) {}
+func (SessionHandlerAdapter) KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIdentifier)  {}
+func (SessionHandlerAdapter) KeyshareEnrollmentMissing(manager irma.SchemeManagerIdentifier)     {}
+func (SessionHandlerAdapter) KeyshareEnrollmentDeleted(manager irma.SchemeManagerIdentifier)     {}
+
+func (SessionHandlerAdapter) RequestIssuancePermission(request *irma.IssuanceRequest,
+	satisfiable bool,
+	candidates [][]irmaclient.DisclosureCandidates,
+	requestorInfo *irma.RequestorInfo,
+	callback irmaclient.PermissionHandler) {
+	callback(false, nil)
+}
+
+func (SessionHandlerAdapter) RequestVerificationPermission(request *irma.DisclosureRequest,
+	satisfiable bool,
+	candidates [][]irmaclient.DisclosureCandidates,
+	requestorInfo *irma.RequestorInfo,
+	callback irmaclient.PermissionHandler) {
+	callback(false, nil)
+}
+
+func (SessionHandlerAdapter) RequestSignaturePermission(request *irma.SignatureRequest,
+	satisfiable bool,
+	candidates [][]irmaclient.DisclosureCandidates,
+	requestorInfo *irma.RequestorInfo,
+	callback irmaclient.PermissionHandler) {
+	callback(false, nil)
+}
+
+func (SessionHandlerAdapter) RequestSchemeManagerPermission(manager *irma.SchemeManager,
+	callback func(proceed bool)) {
+	callback(false)
+}
+
+func (SessionHandlerAdapter) RequestPin(remainingAttempts int, callback irmaclient.PinHandler) {
+	callback(false, "")
+}
+
+// ClientHandlerAdapter implements irmaclient.ClientHandler without doing anything, so that a
+// handler can embed it and implement only the callbacks it cares about.
+type ClientHandlerAdapter struct{}
+
+var _ irmaclient.ClientHandler = ClientHandlerAdapter{}
+
+func (ClientHandlerAdapter) UpdateConfiguration(new *irma.IrmaIdentifierSet) {}
+func (ClientHandlerAdapter) UpdateAttributes()                               {}
+func (ClientHandlerAdapter) Revoked(cred *irma.CredentialIdentifier)         {}
+func (ClientHandlerAdapter) ReportError(err error)                           {}
+
+func (ClientHandlerAdapter) EnrollmentFailure(manager irma.SchemeManagerIdentifier, err error) {}
+func (ClientHandlerAdapter) EnrollmentSuccess(manager irma.SchemeManagerIdentifier)            {}
+
+func (ClientHandlerAdapter) ChangePinFailure(manager irma.SchemeManagerIdentifier, err error)      {}
+func (ClientHandlerAdapter) ChangePinSuccess(manager irma.SchemeManagerIdentifier)                 {}
+func (ClientHandlerAdapter) ChangePinIncorrect(manager irma.SchemeManagerIdentifier, attempts int) {}
+func (ClientHandlerAdapter) ChangePinBlocked(manager irma.SchemeManagerIdentifier, timeout int)    {}
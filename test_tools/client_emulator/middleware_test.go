@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+)
+
+func recordingMiddleware(name string, calls *[]string) SessionMiddleware {
+	return func(next irmaclient.Handler) irmaclient.Handler {
+		return &chainedRecorder{Handler: next, name: name, calls: calls}
+	}
+}
+
+// chainedRecorder records the Success callbacks passing through it.
+type chainedRecorder struct {
+	irmaclient.Handler
+	name  string
+	calls *[]string
+}
+
+func (r *chainedRecorder) Success(result string) {
+	*r.calls = append(*r.calls, r.name)
+	r.Handler.Success(result)
+}
+
+func TestChainOrder(t *testing.T) {
+	calls := []string{}
+	handler := Chain(&chainedRecorder{Handler: SessionHandlerAdapter{}, name: "handler", calls: &calls},
+		recordingMiddleware("outer", &calls), recordingMiddleware("inner", &calls))
+	handler.Success("")
+	if strings.Join(calls, ",") != "outer,inner,handler" {
+		t.Errorf("callbacks seen in order %v", calls)
+	}
+}
+
+func TestMiddlewareChain(t *testing.T) {
+	events := captureEvents(t)
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	setFlag(t, "log-callbacks", "true")
+	setFlag(t, "metrics", "true")
+	setFlag(t, "assert-callbacks", "true")
+
+	handler := Chain(SessionHandlerAdapter{}, sessionMiddleware()...)
+	handler.RequestVerificationPermission(nil, true, nil, nil, func(proceed bool, choice *irma.DisclosureChoice) {})
+	handler.Success("")
+	for _, callback := range []string{"RequestVerificationPermission(satisfiable=true)", "Success("} {
+		if !strings.Contains(logged.String(), callback) {
+			t.Errorf("%s not logged:\n%s", callback, logged.String())
+		}
+	}
+	metrics := events.named("metrics")
+	if len(metrics) != 1 || metrics[0]["outcome"] != string(outcomeSuccess) {
+		t.Errorf("metrics events %v", metrics)
+	}
+	if failed := events.named("assertion-failed"); len(failed) != 0 {
+		t.Errorf("assertions failed: %v", failed)
+	}
+}
+
+func TestProofMetrics(t *testing.T) {
+	events := captureEvents(t)
+	setFlag(t, "metrics", "true")
+	client, _ := newTestClient(t)
+
+	result := runTestSession(t, client, studentIDRequest, "yes\n")
+	if result.kind != outcomeSuccess {
+		t.Fatalf("session finished with %s\n%s", result.kind, events)
+	}
+	proof := events.named("proof-metrics")
+	if len(proof) != 1 || proof[0]["credentials"] != float64(1) || proof[0]["attributes"] != float64(1) {
+		t.Errorf("proof-metrics events %v", proof)
+	}
+}
+
+func TestAssertionMiddleware(t *testing.T) {
+	events := captureEvents(t)
+	handler := AssertionMiddleware(SessionHandlerAdapter{})
+
+	handler.Success("")
+	handler.Cancelled()
+	handler.RequestPin(3, func(proceed bool, pin string) {})
+	answered := 0
+	handler.RequestVerificationPermission(nil, true, nil, nil, func(proceed bool, choice *irma.DisclosureChoice) { answered++ })
+
+	failed := events.named("assertion-failed")
+	reasons := []string{}
+	for _, event := range failed {
+		reasons = append(reasons, event["reason"].(string))
+	}
+	want := "session finished twice,callback after session finished,callback after session finished"
+	if strings.Join(reasons, ",") != want {
+		t.Errorf("assertions failed for %v, want %s", reasons, want)
+	}
+	if answered != 1 {
+		t.Errorf("permission answered %d times", answered)
+	}
+}
+
+func TestAssertionMiddlewareKeyshareFinishes(t *testing.T) {
+	manager := irma.NewSchemeManagerIdentifier("test")
+	finishers := map[string]func(irmaclient.Handler){
+		"KeyshareBlocked":              func(h irmaclient.Handler) { h.KeyshareBlocked(manager, 10) },
+		"KeyshareEnrollmentMissing":    func(h irmaclient.Handler) { h.KeyshareEnrollmentMissing(manager) },
+		"KeyshareEnrollmentIncomplete": func(h irmaclient.Handler) { h.KeyshareEnrollmentIncomplete(manager) },
+		"KeyshareEnrollmentDeleted":    func(h irmaclient.Handler) { h.KeyshareEnrollmentDeleted(manager) },
+	}
+	for name, finish := range finishers {
+		t.Run(name, func(t *testing.T) {
+			events := captureEvents(t)
+			handler := AssertionMiddleware(SessionHandlerAdapter{})
+			finish(handler)
+			handler.Success("")
+			failed := events.named("assertion-failed")
+			if len(failed) != 1 || failed[0]["first"] != name {
+				t.Errorf("assertion-failed events %v, want one for Success after %s", failed, name)
+			}
+		})
+	}
+}
+
+// successCounter only implements the Success callback, leaving the others to the adapter.
+type successCounter struct {
+	SessionHandlerAdapter
+	results []string
+}
+
+func (h *successCounter) Success(result string) {
+	h.results = append(h.results, result)
+}
+
+func TestSessionHandlerAdapter(t *testing.T) {
+	client, _ := newTestClient(t)
+	handler := &successCounter{}
+
+	// The adapter refuses permission, so the session is cancelled without Success
+	done := make(chan struct{})
+	cancelled := &cancelNotifier{successCounter: handler, done: done}
+	client.NewSession(studentIDRequest, cancelled)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session refused by the adapter was not cancelled")
+	}
+	if len(handler.results) != 0 {
+		t.Errorf("session succeeded although the adapter refuses permission: %v", handler.results)
+	}
+
+	var h irmaclient.Handler = handler
+	h.Success("result")
+	h.StatusUpdate(irma.ActionDisclosing, irma.ClientStatusConnected)
+	h.Failure(&irma.SessionError{})
+	h.KeyshareEnrollmentMissing(irma.NewSchemeManagerIdentifier("test"))
+	pinRefused := false
+	h.RequestPin(3, func(proceed bool, pin string) { pinRefused = !proceed })
+	if !pinRefused {
+		t.Error("the adapter supplied a PIN")
+	}
+	if len(handler.results) != 1 || handler.results[0] != "result" {
+		t.Errorf("Success override received %v", handler.results)
+	}
+}
+
+// cancelNotifier closes done once the session is cancelled.
+type cancelNotifier struct {
+	*successCounter
+	done chan struct{}
+}
+
+func (h *cancelNotifier) Cancelled() {
+	close(h.done)
+}
+
+// attributeUpdates only implements the UpdateAttributes callback, leaving the others to the
+// adapter.
+type attributeUpdates struct {
+	ClientHandlerAdapter
+	updates int
+}
+
+func (h *attributeUpdates) UpdateAttributes() {
+	h.updates++
+}
+
+func TestClientHandlerAdapter(t *testing.T) {
+	handler := &attributeUpdates{}
+	client, err := irmaclient.New(testStorage(t), testConfiguration(t), handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var h irmaclient.ClientHandler = handler
+	manager := irma.NewSchemeManagerIdentifier("test")
+	h.UpdateConfiguration(&irma.IrmaIdentifierSet{})
+	h.UpdateAttributes()
+	h.Revoked(&irma.CredentialIdentifier{})
+	h.ReportError(errors.New("error"))
+	h.EnrollmentFailure(manager, errors.New("error"))
+	h.EnrollmentSuccess(manager)
+	h.ChangePinFailure(manager, errors.New("error"))
+	h.ChangePinSuccess(manager)
+	h.ChangePinIncorrect(manager, 2)
+	h.ChangePinBlocked(manager, 60)
+	if handler.updates != 1 {
+		t.Errorf("UpdateAttributes override called %d times", handler.updates)
+	}
+}
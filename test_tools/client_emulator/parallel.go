@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/privacybydesign/irmago/irmaclient"
+)
+
+// runParallel performs the sessions whose pointers are read from stdin, running up to
+// -parallel of them at the same time. Each session is numbered in the order its pointer was
+// read; all its output carries this number, and commands for it must be prefixed with it.
+// Once stdin is closed and all sessions have finished, the outcome of each session is
+// emitted and the exit code of the first session that did not succeed is returned. With
+// -max-session-count, no more sessions are started once that many have succeeded.
+func runParallel(client *irmaclient.Client, commands *dispatcher, initial *command, pins *pinSupplier,
+	interrupted <-chan struct{}) int {
+	// Read pointers in a separate goroutine, so that a signal is noticed while waiting. It
+	// stops once done is closed, when no more sessions are started.
+	pointers := make(chan command)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(pointers)
+		if initial != nil {
+			select {
+			case pointers <- *initial:
+			case <-done:
+				return
+			}
+		}
+		for {
+			cmd, ok := commands.await("session")
+			if !ok {
+				return
+			}
+			select {
+			case pointers <- cmd:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var (
+		wg       sync.WaitGroup
+		mutex    sync.Mutex
+		outcomes = map[int]outcome{}
+		running  = make(chan struct{}, *parallel)
+		reached  = make(chan struct{}) // closed once -max-session-count sessions have succeeded
+		started  int
+	)
+	limited := flagGiven("max-session-count")
+	var reachedOnce sync.Once
+loop:
+	for {
+		select {
+		case <-reached:
+			break loop
+		default:
+		}
+		var cmd command
+		var ok bool
+		select {
+		case cmd, ok = <-pointers:
+		case <-interrupted:
+		case <-reached:
+		}
+		if !ok {
+			break
+		}
+		select {
+		case running <- struct{}{}:
+		case <-interrupted:
+			break loop
+		case <-reached:
+			break loop
+		}
+
+		started++
+		wg.Add(1)
+		go func(id int, cmd command) {
+			defer wg.Done()
+			result, _ := handleSession(client, commands, id, cmd, pins, interrupted)
+			countOutcome(result)
+			if limited && atomic.LoadInt64(&completedSessions) >= int64(*maxSessionCount) {
+				reachedOnce.Do(func() { close(reached) })
+			}
+			mutex.Lock()
+			outcomes[id] = result
+			mutex.Unlock()
+			<-running
+		}(started, cmd)
+	}
+	wg.Wait()
+
+	if err := commands.readErr(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read from stdin: %v\n", err)
+		return exitStartup
+	}
+	if started == 0 {
+		fmt.Fprintln(os.Stderr, "No session pointer received")
+		return exitStartup
+	}
+
+	ids := make([]int, 0, len(outcomes))
+	for id := range outcomes {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	code := exitSuccess
+	for _, id := range ids {
+		result := outcomes[id]
+		emitFor(id, "session-summary", "outcome", result.kind)
+		if c := result.exitCode(); code == exitSuccess && c != exitSuccess && !*bestEffort {
+			code = c
+		}
+	}
+	return code
+}
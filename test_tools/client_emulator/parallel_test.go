@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMaxSessionCount(t *testing.T) {
+	// The third session is never answered, so the emulator must not start it
+	input := strings.Repeat(studentIDRequest+"\nyes\n", 2) + studentIDRequest + "\n"
+	stdout, stderr, code := runEmulator(t, input, false, emulatorArgs(t, "-max-session-count", "2")...)
+	if code != exitSuccess {
+		t.Fatalf("exit code %d\n%s%s", code, stdout, stderr)
+	}
+	exit := eventsIn(stdout, "exit")
+	if len(exit) != 1 || exit[0]["sessions"] != float64(2) || exit[0]["successes"] != float64(2) {
+		t.Errorf("exit events %v", exit)
+	}
+}
+
+func TestMaxSessionCountParallel(t *testing.T) {
+	// The cancelled session does not count, so the third one is needed as well
+	input := strings.Repeat(studentIDRequest+"\n", 3) + "1 yes\n2 cancel\n3 yes\n"
+	stdout, stderr, code := runEmulator(t, input, false,
+		emulatorArgs(t, "-max-session-count", "2", "-parallel", "3", "-best-effort")...)
+	if code != exitSuccess {
+		t.Fatalf("exit code %d\n%s%s", code, stdout, stderr)
+	}
+	exit := eventsIn(stdout, "exit")
+	if len(exit) != 1 || exit[0]["successes"] != float64(2) || exit[0]["cancelled"] != float64(1) {
+		t.Errorf("exit events %v", exit)
+	}
+}
+
+func TestParallelWithoutSessions(t *testing.T) {
+	stdout, stderr, code := runEmulator(t, "", true, emulatorArgs(t, "-parallel", "2")...)
+	if code != exitStartup || !strings.Contains(stderr, "No session pointer received") || strings.Contains(stderr, "panic") {
+		t.Errorf("exit code %d without session pointers\n%s%s", code, stdout, stderr)
+	}
+}
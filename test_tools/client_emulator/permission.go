@@ -0,0 +1,397 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+)
+
+// permissionRequest is a request for permission as irmaclient passes it to the session handler.
+// The permission policies may update it, e.g. when the candidates are re-evaluated.
+type permissionRequest struct {
+	request       irma.SessionRequest
+	satisfiable   bool
+	candidates    [][]irmaclient.DisclosureCandidates
+	requestorInfo *irma.RequestorInfo
+}
+
+// A permissionPolicy is applied to every request for permission before the permission is
+// asked for. It returns false if the session must be declined, having emitted why.
+type permissionPolicy func(s *SessionHandler, req *permissionRequest) bool
+
+// permissionPolicies are the policies requestPermission applies, in order.
+var permissionPolicies = []permissionPolicy{
+	(*SessionHandler).awaitClientConnected,
+	(*SessionHandler).reportFrontendProtocol,
+	(*SessionHandler).applyFakeNow,
+	(*SessionHandler).reportRequestor,
+	(*SessionHandler).rememberKeyshareManagers,
+	(*SessionHandler).rememberIssued,
+	(*SessionHandler).reportMissingKeys,
+	(*SessionHandler).reportSatisfiable,
+	(*SessionHandler).checkSignFile,
+	(*SessionHandler).checkIssueKeyCounter,
+	(*SessionHandler).requireVerifiedRequestor,
+	(*SessionHandler).allowTypes,
+	(*SessionHandler).limitDisclosure,
+	(*SessionHandler).waitUntilSatisfiable,
+	(*SessionHandler).rejectIfMissingCredentials,
+	(*SessionHandler).offerPermissionRequest,
+}
+
+// A choicePolicy is applied to the disclosure choice before it is sent, and may change it. It
+// returns false if the session must be declined instead, having emitted why.
+type choicePolicy func(s *SessionHandler, req *permissionRequest, choice *irma.DisclosureChoice) bool
+
+// choicePolicies are the policies requestPermission applies to the choice, in order.
+var choicePolicies = []choicePolicy{
+	(*SessionHandler).restrictToSubset,
+	(*SessionHandler).reportOverDisclosure,
+	(*SessionHandler).recordChoice,
+	(*SessionHandler).rememberDisclosed,
+}
+
+// choose makes the disclosure choice once permission is given: nothing with -disclose-nothing if
+// every disjunction is optional, the attribute types of a JSON command, or else the first
+// candidate of every disjunction. It returns false if no choice can be made, having emitted why.
+func (s *SessionHandler) choose(req *permissionRequest, chosen [][]string) (*irma.DisclosureChoice, bool) {
+	if empty, skipped, ok := emptyDisclosureChoice(req.candidates); ok && *discloseNothing {
+		s.emit("disclose-nothing", "skipped", joinInts(skipped))
+		return empty, true
+	}
+	if chosen != nil {
+		choice, err := chooseAttributes(req.candidates, chosen)
+		if err != nil {
+			s.emit("invalid-choice", "error", err)
+			return nil, false
+		}
+		return choice, true
+	}
+	choice, err := makeFirstDisclosureChoice(req.candidates)
+	if err != nil {
+		s.emit("choice-failed", "error", err)
+		return nil, false
+	}
+	return choice, true
+}
+
+// rejectIfMissingCredentials declines unsatisfiable requests with -reject-if-missing-credentials,
+// printing which credential types are missing.
+func (s *SessionHandler) rejectIfMissingCredentials(req *permissionRequest) bool {
+	if req.satisfiable || !*rejectIfMissingCredentials {
+		return true
+	}
+	missing := []string{}
+	credtypes := FindMissingCredentials(req.candidates)
+	for _, id := range credtypes {
+		missing = append(missing, id.String())
+	}
+	if s.id == 0 && *outputFormat != "json" {
+		fmt.Fprintf(events, "Missing credentials: %s\n", strings.Join(missing, ", "))
+	} else {
+		s.emit("missing-credentials", "types", strings.Join(missing, ","))
+	}
+	if s.configuration != nil {
+		s.emitIssueURLs(credtypes)
+	}
+	return false
+}
+
+// reportSatisfiable emits whether the request of a can-satisfy session can be satisfied, and
+// then declines it, as such a session only checks the request.
+func (s *SessionHandler) reportSatisfiable(req *permissionRequest) bool {
+	if !s.canSatisfy {
+		return true
+	}
+	s.emit("can-satisfy", "satisfiable", req.satisfiable, "unsatisfiable", joinInts(unsatisfiableDisjunctions(req.candidates)))
+	if !req.satisfiable && s.configuration != nil {
+		s.emitIssueURLs(FindMissingCredentials(req.candidates))
+	}
+	return false
+}
+
+// requireVerifiedRequestor declines sessions from requestors that are not verified by a
+// requestor scheme, with -require-verified.
+func (s *SessionHandler) requireVerifiedRequestor(req *permissionRequest) bool {
+	info := req.requestorInfo
+	if !*requireVerified || (info != nil && !info.Unverified) {
+		return true
+	}
+	requestor := ""
+	if info != nil {
+		requestor = strings.Join(info.Hostnames, ",")
+	}
+	s.emit("unverified-requestor", "requestor", requestor)
+	return false
+}
+
+// checkIssueKeyCounter declines issuance sessions whose credentials are not issued against the
+// issuer public key counter given with -issue-key-counter.
+func (s *SessionHandler) checkIssueKeyCounter(req *permissionRequest) bool {
+	issuance, ok := req.request.(*irma.IssuanceRequest)
+	if !ok || *issueKeyCounter < 0 {
+		return true
+	}
+	matches := true
+	for _, cred := range issuance.Credentials {
+		if cred.KeyCounter != uint(*issueKeyCounter) {
+			s.emit("key-counter-mismatch", "credential", cred.CredentialTypeID, "expected", *issueKeyCounter, "actual", cred.KeyCounter)
+			matches = false
+		}
+	}
+	return matches
+}
+
+// unsatisfiableDisjunctions returns the indices of the disjunctions for which none of the
+// candidates can be chosen.
+func unsatisfiableDisjunctions(candidates [][]irmaclient.DisclosureCandidates) []int {
+	indices := []int{}
+	for i, discon := range candidates {
+		if !disjunctionSatisfiable(discon) {
+			indices = append(indices, i)
+		}
+	}
+	return indices
+}
+
+// limitDisclosure declines requests asking for more than -max-disclose attributes in total.
+func (s *SessionHandler) limitDisclosure(req *permissionRequest) bool {
+	if count := requestedAttributeCount(req.request); *maxDisclose > 0 && count > *maxDisclose {
+		s.emit("too-many-attributes", "requested", count, "max", *maxDisclose)
+		return false
+	}
+	return true
+}
+
+// requestedAttributeCount returns the number of attributes in all conjunctions of all
+// disjunctions of the request.
+func requestedAttributeCount(request irma.SessionRequest) int {
+	count := 0
+	for _, discon := range request.Disclosure().Disclose {
+		for _, con := range discon {
+			count += len(con)
+		}
+	}
+	return count
+}
+
+// allowTypes declines disclosure and signature requests asking for a credential type that is
+// not on the -allow-type allowlist.
+func (s *SessionHandler) allowTypes(req *permissionRequest) bool {
+	if req.request.Action() == irma.ActionIssuing {
+		return true
+	}
+	disallowed := disallowedTypes(req.request)
+	for _, id := range disallowed {
+		s.emit("type-not-allowed", "type", id)
+	}
+	return len(disallowed) == 0
+}
+
+// disallowedTypes returns the credential types requested by the request that are not on the
+// allowlist; when the allowlist is empty all types are allowed.
+func disallowedTypes(request irma.SessionRequest) []irma.CredentialTypeIdentifier {
+	disallowed := []irma.CredentialTypeIdentifier{}
+	if len(allowedTypes) == 0 {
+		return disallowed
+	}
+
+	allowed := map[irma.CredentialTypeIdentifier]bool{}
+	for _, t := range allowedTypes {
+		allowed[irma.NewCredentialTypeIdentifier(t)] = true
+	}
+	seen := map[irma.CredentialTypeIdentifier]bool{}
+	for _, discon := range request.Disclosure().Disclose {
+		for _, con := range discon {
+			for _, attr := range con {
+				id := attr.Type.CredentialTypeIdentifier()
+				if !allowed[id] && !seen[id] {
+					seen[id] = true
+					disallowed = append(disallowed, id)
+				}
+			}
+		}
+	}
+	return disallowed
+}
+
+// FindMissingCredentials returns the credential types that would have to be obtained
+// to satisfy the disjunctions for which none of the candidates can be chosen.
+func FindMissingCredentials(candidates [][]irmaclient.DisclosureCandidates) []irma.CredentialTypeIdentifier {
+	missing := []irma.CredentialTypeIdentifier{}
+	seen := map[irma.CredentialTypeIdentifier]bool{}
+	for _, discon := range candidates {
+		if disjunctionSatisfiable(discon) {
+			continue
+		}
+		for _, con := range discon {
+			for _, attr := range con {
+				if attr.Present() {
+					continue
+				}
+				id := attr.Type.CredentialTypeIdentifier()
+				if !seen[id] {
+					seen[id] = true
+					missing = append(missing, id)
+				}
+			}
+		}
+	}
+	return missing
+}
+
+func disjunctionSatisfiable(discon []irmaclient.DisclosureCandidates) bool {
+	for _, con := range discon {
+		if _, err := con.Choose(); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// waitUntilSatisfiable gives an unsatisfiable request up to -unsatisfiable-wait to become
+// satisfiable, declining it if it does not.
+func (s *SessionHandler) waitUntilSatisfiable(req *permissionRequest) bool {
+	if req.satisfiable || *unsatisfiableWait <= 0 || s.client == nil {
+		return true
+	}
+	req.candidates, req.satisfiable = s.awaitSatisfiable(req.request)
+	return req.satisfiable
+}
+
+// awaitSatisfiable waits at most -unsatisfiable-wait for the request to become satisfiable,
+// e.g. because the missing credential is issued in a parallel session, re-evaluating the
+// candidates whenever a credential is received and otherwise every walletPollInterval, which is
+// fixed: -status-poll-interval only applies to polling the session status.
+func (s *SessionHandler) awaitSatisfiable(request irma.SessionRequest) ([][]irmaclient.DisclosureCandidates, bool) {
+	before := map[string]bool{}
+	for _, info := range s.client.CredentialInfoList() {
+		before[info.Hash] = true
+	}
+	start := time.Now()
+	deadline := time.After(*unsatisfiableWait)
+	s.emit("unsatisfiable-waiting", "timeout", *unsatisfiableWait)
+	for {
+		select {
+		case <-wallet.changes():
+		case <-time.After(walletPollInterval):
+		case <-deadline:
+			s.emit("unsatisfiable-timeout", "waited", time.Since(start))
+			return nil, false
+		}
+
+		candidates, satisfiable, err := s.client.Candidates(request)
+		if err == nil && *fakeNow != "" {
+			satisfiable = reclassifyExpiry(s.client, candidates)
+		}
+		if err != nil || !satisfiable {
+			continue
+		}
+		unblocked := []string{}
+		for _, info := range s.client.CredentialInfoList() {
+			if !before[info.Hash] {
+				unblocked = append(unblocked, info.Identifier().String())
+			}
+		}
+		s.emit("satisfiable-after-wait", "waited", time.Since(start), "unblocked_by", strings.Join(unblocked, ","))
+		return candidates, true
+	}
+}
+
+// reportRequestor logs who the requestor is with -log-requestor-info.
+func (s *SessionHandler) reportRequestor(req *permissionRequest) bool {
+	if *logRequestor {
+		s.logRequestorInfo(req.requestorInfo)
+	}
+	return true
+}
+
+// logRequestorInfo logs the name, logo URL and hostnames of the requestor to stderr.
+func (s *SessionHandler) logRequestorInfo(info *irma.RequestorInfo) {
+	if info == nil {
+		log.Printf("INFO session_id=%s requestor unknown", s.correlationID)
+		return
+	}
+	logo := ""
+	if info.Logo != nil && s.configuration != nil {
+		if scheme, ok := s.configuration.RequestorSchemes[info.Scheme]; ok {
+			logo = strings.TrimSuffix(scheme.URL, "/") + "/assets/" + *info.Logo + ".png"
+		}
+	}
+	log.Printf("INFO session_id=%s requestor name=%q logo=%q hostnames=%s verified=%t",
+		s.correlationID, localised(info.Name, "en"), logo, strings.Join(info.Hostnames, ","), !info.Unverified)
+}
+
+// reportFrontendProtocol emits the protocol version of the session, whether the frontend had
+// to be paired, and whether it was. irmaclient only asks for permission once a required pairing
+// has completed, but with -pairing disabled the session has already failed by then.
+func (s *SessionHandler) reportFrontendProtocol(req *permissionRequest) bool {
+	s.mutex.Lock()
+	required := s.pairingRequired
+	s.mutex.Unlock()
+	s.emit("frontend-protocol", "version", req.request.Base().ProtocolVersion,
+		"pairing_required", required, "paired", required && *pairing == "accept")
+	return true
+}
+
+// awaitClientConnected waits for the client to report that it is connected with
+// -wait-for-client. irmaclient reports the connected status just before asking for permission,
+// so this only waits if it ever stops doing so.
+func (s *SessionHandler) awaitClientConnected(req *permissionRequest) bool {
+	if !*waitForClient {
+		return true
+	}
+	if err := s.waitStatus(irma.ClientStatusConnected, nil); err != nil {
+		s.emit("client-wait-failed", "error", err)
+		return false
+	}
+	s.emit("client-connected")
+	return true
+}
+
+// reportOverDisclosure emits the chosen attributes that the request does not ask for.
+func (s *SessionHandler) reportOverDisclosure(req *permissionRequest, choice *irma.DisclosureChoice) bool {
+	if extra := overDisclosed(req.request.Disclosure().Disclose, choice); len(extra) > 0 {
+		s.emit("over-disclosure", "attributes", strings.Join(extra, ","))
+	}
+	return true
+}
+
+// overDisclosed returns the chosen attribute types that none of the conjunctions of their
+// disjunction asks for, in the order in which they were chosen.
+func overDisclosed(disclose irma.AttributeConDisCon, choice *irma.DisclosureChoice) []string {
+	extra := []string{}
+	for i, chosen := range choice.Attributes {
+		requested := map[irma.AttributeTypeIdentifier]bool{}
+		if i < len(disclose) {
+			for _, con := range disclose[i] {
+				for _, attr := range con {
+					requested[attr.Type] = true
+				}
+			}
+		}
+		for _, id := range chosen {
+			if !requested[id.Type] {
+				extra = append(extra, id.Type.String())
+			}
+		}
+	}
+	return extra
+}
+
+// restrictToSubset removes the attributes that are not in the -attribute-subset from the
+// choice, declining the session if that leaves a disjunction without attributes.
+func (s *SessionHandler) restrictToSubset(req *permissionRequest, choice *irma.DisclosureChoice) bool {
+	if *attributeSubset == "" {
+		return true
+	}
+	if err := filterDisclosureChoice(choice, strings.Split(*attributeSubset, ",")); err != nil {
+		s.emit("subset-violation", "error", err)
+		return false
+	}
+	return true
+}
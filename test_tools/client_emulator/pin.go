@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	irma "github.com/privacybydesign/irmago"
+)
+
+// pinSupplier provides the PIN for RequestPin callbacks, first supplying a number of
+// deliberately incorrect PINs when requested, so that the attempt counter of the keyshare
+// server can be tested.
+type pinSupplier struct {
+	mutex         sync.Mutex
+	pin           string // used for scheme managers without a PIN of their own
+	pins          map[irma.SchemeManagerIdentifier]string
+	wrongAttempts int
+	attempts      int
+}
+
+// newPinSupplier parses the value of -pin, which is either a single PIN used for all scheme
+// managers, or a comma-separated list of manager=PIN pairs.
+func newPinSupplier(value string, wrongAttempts int) (*pinSupplier, error) {
+	p := &pinSupplier{pins: map[irma.SchemeManagerIdentifier]string{}, wrongAttempts: wrongAttempts}
+	if !strings.Contains(value, "=") {
+		p.pin = value
+		return p, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("expected manager=pin, got %q", pair)
+		}
+		p.pins[irma.NewSchemeManagerIdentifier(pair[:i])] = pair[i+1:]
+	}
+	return p, nil
+}
+
+// configured reports whether any PIN was given, i.e. whether PINs need not be read from stdin.
+func (p *pinSupplier) configured() bool {
+	return p.pin != "" || len(p.pins) > 0
+}
+
+// pinFor returns the PIN for the given scheme managers. irmaclient sends the same PIN to the
+// keyshare servers of all managers involved in a session, so if they have different PINs
+// this returns the PIN of the first manager for which one was given.
+func (p *pinSupplier) pinFor(managers []irma.SchemeManagerIdentifier) string {
+	for _, manager := range managers {
+		if pin, ok := p.pins[manager]; ok {
+			return pin
+		}
+	}
+	return p.pin
+}
+
+// next returns the PIN to supply for the next attempt for the given scheme managers, whether
+// it is the correct one, and the number of the attempt.
+func (p *pinSupplier) next(managers []irma.SchemeManagerIdentifier) (string, bool, int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	pin := p.pinFor(managers)
+	p.attempts++
+	if p.attempts <= p.wrongAttempts {
+		return wrongPin(pin), false, p.attempts
+	}
+	return pin, true, p.attempts
+}
+
+// wrongPin derives an incorrect PIN from the correct one by changing its last digit.
+func wrongPin(pin string) string {
+	if pin == "" {
+		return "00000"
+	}
+	last := pin[len(pin)-1]
+	wrong := byte('0')
+	if last >= '0' && last <= '8' {
+		wrong = last + 1
+	}
+	return pin[:len(pin)-1] + string(wrong)
+}
+
+// keyshareManagers returns the scheme managers involved in the request that use a keyshare
+// server, sorted by identifier.
+func keyshareManagers(conf *irma.Configuration, request irma.SessionRequest) []irma.SchemeManagerIdentifier {
+	managers := []irma.SchemeManagerIdentifier{}
+	for id := range request.Identifiers().SchemeManagers {
+		if manager, ok := conf.SchemeManagers[id]; ok && manager.Distributed() {
+			managers = append(managers, id)
+		}
+	}
+	sort.Slice(managers, func(i, j int) bool { return managers[i].String() < managers[j].String() })
+	return managers
+}
+
+// rememberKeyshareManagers records the scheme managers whose keyshare server the session
+// involves, so that RequestPin can supply the PIN of each of them.
+func (s *SessionHandler) rememberKeyshareManagers(req *permissionRequest) bool {
+	if s.configuration != nil {
+		s.mutex.Lock()
+		s.keyshare = keyshareManagers(s.configuration, req.request)
+		s.mutex.Unlock()
+	}
+	return true
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+)
+
+func TestPinSupplier(t *testing.T) {
+	pins := &pinSupplier{pin: "12345", wrongAttempts: 2}
+	want := []struct {
+		pin     string
+		correct bool
+	}{{"12346", false}, {"12346", false}, {"12345", true}, {"12345", true}}
+	for i, w := range want {
+		pin, correct, attempt := pins.next(nil)
+		if pin != w.pin || correct != w.correct || attempt != i+1 {
+			t.Errorf("attempt %d supplied %q (correct %t) as attempt %d", i+1, pin, correct, attempt)
+		}
+	}
+}
+
+func TestPinSupplierPerManager(t *testing.T) {
+	pins, err := newPinSupplier("irma-demo=11111,test=22222", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	irmaDemo, test := irma.NewSchemeManagerIdentifier("irma-demo"), irma.NewSchemeManagerIdentifier("test")
+	for _, c := range []struct {
+		managers []irma.SchemeManagerIdentifier
+		want     string
+	}{
+		{[]irma.SchemeManagerIdentifier{irmaDemo}, "11111"},
+		{[]irma.SchemeManagerIdentifier{test}, "22222"},
+		{[]irma.SchemeManagerIdentifier{test, irmaDemo}, "22222"},
+	} {
+		if pin := pins.pinFor(c.managers); pin != c.want {
+			t.Errorf("PIN for %v is %q, want %q", c.managers, pin, c.want)
+		}
+	}
+
+	if _, err := newPinSupplier("irma-demo=11111,22222", 0); err == nil {
+		t.Error("expected an error for a pair without a manager")
+	}
+}
+
+func TestWrongPin(t *testing.T) {
+	for pin, want := range map[string]string{"12345": "12346", "12349": "12340", "": "00000"} {
+		if wrong := wrongPin(pin); wrong != want {
+			t.Errorf("wrong PIN for %q is %q, want %q", pin, wrong, want)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	irma "github.com/privacybydesign/irmago"
+)
+
+const (
+	universalLinkPrefix = "https://irma.app/-/session#"
+	irmaSchemePrefix    = "irma://qr/json/"
+)
+
+// resolveSessionPointer validates the input as something irmaclient can start a session
+// from, and returns it in the form NewSession expects. Besides the session pointer JSON
+// this accepts universal links and irma:// URLs wrapping it. Manual session requests (i.e.
+// disclosure or signature requests) are passed on as they are.
+func resolveSessionPointer(input string) (string, error) {
+	pointer := strings.TrimSpace(input)
+	if pointer == "" {
+		return "", fmt.Errorf("empty session pointer")
+	}
+
+	for _, prefix := range []string{universalLinkPrefix, irmaSchemePrefix} {
+		if strings.HasPrefix(pointer, prefix) {
+			unescaped, err := url.PathUnescape(strings.TrimPrefix(pointer, prefix))
+			if err != nil {
+				return "", fmt.Errorf("malformed link: %v", err)
+			}
+			pointer = unescaped
+		}
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(pointer), &fields); err != nil {
+		return "", fmt.Errorf("not a session pointer, link or session request: %v", err)
+	}
+	_, hasURL := fields["u"]
+	_, hasType := fields["irmaqr"]
+	if !hasURL && !hasType {
+		// A manual session request; irmaclient validates these itself without network access
+		return pointer, nil
+	}
+
+	qr := &irma.Qr{}
+	if err := json.Unmarshal([]byte(pointer), qr); err != nil {
+		return "", fmt.Errorf("malformed session pointer: %v", err)
+	}
+	if qr.URL == "" {
+		return "", fmt.Errorf("session pointer has no URL (\"u\")")
+	}
+	if _, err := url.ParseRequestURI(qr.URL); err != nil {
+		return "", fmt.Errorf("session pointer URL is invalid: %v", err)
+	}
+	switch qr.Type {
+	case irma.ActionDisclosing, irma.ActionIssuing, irma.ActionSigning, irma.ActionRedirect:
+	default:
+		return "", fmt.Errorf("unsupported session type (\"irmaqr\") %q", qr.Type)
+	}
+	return pointer, nil
+}
+
+// NewSessionFromQR encodes the session pointer in the string form that NewSession expects,
+// validating it like a session pointer read from stdin.
+func NewSessionFromQR(qr *irma.Qr) (string, error) {
+	bts, err := json.Marshal(qr)
+	if err != nil {
+		return "", err
+	}
+	return resolveSessionPointer(strings.TrimSpace(string(bts)))
+}
+
+// readSessionPointer returns the contents of the file at path, or fetches the document at
+// location; exactly one of them should be set. Over http:// only in developer mode, like
+// irmaclient itself.
+func readSessionPointer(path, location string, developerMode bool) (string, error) {
+	if path != "" {
+		bts, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return string(bts), nil
+	}
+
+	if strings.HasPrefix(location, "http://") && !developerMode {
+		return "", fmt.Errorf("refusing to fetch %s over http:// without developer mode", location)
+	}
+	res, err := http.Get(location)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching %s: %s", location, res.Status)
+	}
+	bts, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(bts), nil
+}
+
+// sessionPointerURL returns the server URL of the session pointer, if it has one.
+func sessionPointerURL(pointer string) string {
+	qr := &irma.Qr{}
+	if err := json.Unmarshal([]byte(pointer), qr); err != nil {
+		return ""
+	}
+	return qr.URL
+}
+
+// excerpt shortens input for inclusion in an error message.
+func excerpt(input string) string {
+	const max = 80
+	input = strings.TrimSpace(input)
+	if len(input) > max {
+		return input[:max] + "..."
+	}
+	return input
+}
+
+// printRequestStructure emits the disjunctions, conjunctions and attribute requests of the
+// disclosure or signature request, as authored. Session pointers are refused: obtaining the
+// request behind them would start the session at the server.
+func printRequestStructure(input string) {
+	request, err := parseSessionRequest(input)
+	if err != nil {
+		emit("request-structure-failed", "error", err)
+		return
+	}
+
+	disclose := request.Disclosure().Disclose
+	emit("request-structure", "action", request.Action(), "disjunctions", len(disclose))
+	for i, discon := range disclose {
+		optional := false
+		for _, con := range discon {
+			if len(con) == 0 {
+				optional = true
+			}
+		}
+		emit("request-disjunction", "index", i, "optional", optional, "conjunctions", len(discon))
+		for j, con := range discon {
+			for _, attr := range con {
+				value := ""
+				if attr.Value != nil {
+					value = *attr.Value
+				}
+				emit("request-attribute", "disjunction", i, "conjunction", j, "type", attr.Type,
+					"value", value, "constrained", attr.Value != nil, "not_null", attr.NotNull)
+			}
+		}
+	}
+}
+
+// parseSessionRequest parses a signature or disclosure request, in the same order as
+// irmaclient does when it is passed to NewSession.
+func parseSessionRequest(input string) (irma.SessionRequest, error) {
+	resolved, err := resolveSessionPointer(input)
+	if err != nil {
+		return nil, err
+	}
+	bts := []byte(resolved)
+
+	qr := &irma.Qr{}
+	if err := json.Unmarshal(bts, qr); err == nil && qr.IsQr() {
+		return nil, fmt.Errorf("cannot show the request behind a session pointer without starting the session")
+	}
+	sigRequest := &irma.SignatureRequest{}
+	if err := json.Unmarshal(bts, sigRequest); err == nil && sigRequest.IsSignatureRequest() {
+		return sigRequest, sigRequest.Validate()
+	}
+	disclosureRequest := &irma.DisclosureRequest{}
+	if err := json.Unmarshal(bts, disclosureRequest); err == nil && disclosureRequest.IsDisclosureRequest() {
+		return disclosureRequest, disclosureRequest.Validate()
+	}
+	return nil, fmt.Errorf("not a disclosure or signature request")
+}
+
+// signedFile is a file whose contents a sign-file session must sign.
+type signedFile struct {
+	path     string
+	contents string
+}
+
+// parseSignFile parses the arguments of "sign-file <pointer> <path>", reading the file.
+func parseSignFile(args string) (string, *signedFile, error) {
+	i := strings.LastIndexAny(args, " \t")
+	if i < 0 {
+		return "", nil, fmt.Errorf("expected sign-file <pointer> <path>")
+	}
+	path := args[i+1:]
+	bts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	return strings.TrimSpace(args[:i]), &signedFile{path: path, contents: string(bts)}, nil
+}
+
+// matches checks that the request is a signature request over the contents of the file.
+func (f *signedFile) matches(request irma.SessionRequest) error {
+	sigRequest, ok := request.(*irma.SignatureRequest)
+	if !ok {
+		return fmt.Errorf("not a signature request but a %s request", request.Action())
+	}
+	if sigRequest.Message != f.contents {
+		return fmt.Errorf("message to sign differs from the contents of %s", f.path)
+	}
+	return nil
+}
+
+// checkSignFile declines the sign-file session if its request is not a signature request over
+// the contents of the file.
+func (s *SessionHandler) checkSignFile(req *permissionRequest) bool {
+	if s.signFile == nil {
+		return true
+	}
+	if err := s.signFile.matches(req.request); err != nil {
+		s.emit("sign-file-mismatch", "path", s.signFile.path, "error", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+)
+
+func TestNewSessionFromQR(t *testing.T) {
+	qr := &irma.Qr{URL: "https://example.com/irma/session/abc123", Type: irma.ActionDisclosing}
+	pointer, err := NewSessionFromQR(qr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pointer != `{"u":"https://example.com/irma/session/abc123","irmaqr":"disclosing"}` {
+		t.Errorf("encoded as %s", pointer)
+	}
+	decoded := &irma.Qr{}
+	if err := json.Unmarshal([]byte(pointer), decoded); err != nil || *decoded != *qr {
+		t.Errorf("decoded as %+v, %v", decoded, err)
+	}
+
+	invalid := []*irma.Qr{
+		{Type: irma.ActionDisclosing},
+		{URL: "example.com/session", Type: irma.ActionDisclosing},
+		{URL: "https://example.com/session", Type: "unknown"},
+	}
+	for _, qr := range invalid {
+		if pointer, err := NewSessionFromQR(qr); err == nil {
+			t.Errorf("%+v encoded as %s", qr, pointer)
+		}
+	}
+}
+
+func TestResolveSessionPointer(t *testing.T) {
+	pointer := `{"u":"https://example.com/irma/session/abc123","irmaqr":"signing"}`
+	inputs := []string{
+		pointer,
+		"  " + pointer + "\n",
+		universalLinkPrefix + url.PathEscape(pointer),
+		irmaSchemePrefix + url.PathEscape(pointer),
+	}
+	for _, input := range inputs {
+		if resolved, err := resolveSessionPointer(input); err != nil || resolved != pointer {
+			t.Errorf("%q resolved to %q, %v", input, resolved, err)
+		}
+	}
+
+	// Manual session requests are passed on unchanged
+	if resolved, err := resolveSessionPointer(studentIDRequest); err != nil || resolved != studentIDRequest {
+		t.Errorf("disclosure request resolved to %q, %v", resolved, err)
+	}
+	for _, input := range []string{"", "not json", `{"u":"https://example.com"}`} {
+		if _, err := resolveSessionPointer(input); err == nil {
+			t.Errorf("%q resolved", input)
+		}
+	}
+}
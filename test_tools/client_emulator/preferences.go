@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/privacybydesign/irmago/irmaclient"
+)
+
+// preferenceNames returns the names of the fields of irmaclient.Preferences, which are the
+// keys that -pref and the prefs command accept.
+func preferenceNames() []string {
+	t := reflect.TypeOf(irmaclient.Preferences{})
+	names := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		names = append(names, t.Field(i).Name)
+	}
+	return names
+}
+
+// setPreferences sets the fields of prefs named by the keys of pairs, matched case-insensitively,
+// to the values parsed from the corresponding values. It fails without changing prefs if a key
+// names no field or a value cannot be parsed.
+func setPreferences(prefs *irmaclient.Preferences, pairs map[string]string) error {
+	updated := *prefs
+	v := reflect.ValueOf(&updated).Elem()
+	for key, value := range pairs {
+		field := v.FieldByNameFunc(func(name string) bool { return strings.EqualFold(name, key) })
+		if !field.IsValid() {
+			return fmt.Errorf("unknown preference %q, expected one of %s", key, strings.Join(preferenceNames(), ", "))
+		}
+		switch field.Kind() {
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("preference %s: expected true or false, got %q", key, value)
+			}
+			field.SetBool(b)
+		case reflect.Int, reflect.Int64:
+			i, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("preference %s: expected an integer, got %q", key, value)
+			}
+			field.SetInt(i)
+		case reflect.String:
+			field.SetString(value)
+		default:
+			return fmt.Errorf("preference %s of type %s cannot be set", key, field.Type())
+		}
+	}
+	*prefs = updated
+	return nil
+}
+
+// preferencesToApply returns the stored preferences with developer mode enabled, unless
+// -no-developer-mode is set, and with the -pref values applied. It returns false if there is
+// nothing to apply, in which case the stored preferences are kept as they are.
+func preferencesToApply(stored irmaclient.Preferences) (irmaclient.Preferences, bool) {
+	if *noDeveloperMode && len(preferenceValues) == 0 {
+		return stored, false
+	}
+	prefs := stored
+	if !*noDeveloperMode {
+		prefs.DeveloperMode = true
+	}
+	// Already validated at startup
+	_ = setPreferences(&prefs, preferenceValues)
+	return prefs, true
+}
+
+// emitPreferences emits the value of every field of prefs in the preferences event.
+func emitPreferences(prefs irmaclient.Preferences) {
+	v := reflect.ValueOf(prefs)
+	fields := make([]interface{}, 0, 2*v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		fields = append(fields, v.Type().Field(i).Name, v.Field(i).Interface())
+	}
+	emit("preferences", fields...)
+}
+
+// changePreferences implements the prefs command: it applies the key=value pairs in args to the
+// client's preferences, if any, and emits the resulting preferences.
+func changePreferences(client *irmaclient.Client, args string) {
+	pairs := stringMap{}
+	for _, pair := range strings.Fields(args) {
+		if err := pairs.Set(pair); err != nil {
+			emit("prefs-failed", "error", err)
+			return
+		}
+	}
+	if len(pairs) > 0 {
+		prefs := client.Preferences
+		if err := setPreferences(&prefs, pairs); err != nil {
+			emit("prefs-failed", "error", err)
+			return
+		}
+		client.SetPreferences(prefs)
+	}
+	emitPreferences(client.Preferences)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/privacybydesign/irmago/irmaclient"
+)
+
+// withPreferenceValues sets the -pref values for the duration of the test.
+func withPreferenceValues(t *testing.T, values stringMap) {
+	previous := preferenceValues
+	preferenceValues = values
+	t.Cleanup(func() { preferenceValues = previous })
+}
+
+func TestPreferencesToApply(t *testing.T) {
+	stored := irmaclient.Preferences{DeveloperMode: false}
+
+	if prefs, ok := preferencesToApply(stored); !ok || !prefs.DeveloperMode {
+		t.Errorf("by default %+v (apply %t), want developer mode enabled", prefs, ok)
+	}
+
+	withPreferenceValues(t, stringMap{"developermode": "false"})
+	if prefs, ok := preferencesToApply(stored); !ok || prefs.DeveloperMode {
+		t.Errorf("with -pref DeveloperMode=false %+v (apply %t), want developer mode disabled", prefs, ok)
+	}
+}
+
+func TestNoDeveloperMode(t *testing.T) {
+	setFlag(t, "no-developer-mode", "true")
+
+	for _, stored := range []irmaclient.Preferences{{DeveloperMode: false}, {DeveloperMode: true}} {
+		if prefs, ok := preferencesToApply(stored); ok || prefs != stored {
+			t.Errorf("stored %+v became %+v (apply %t), want SetPreferences not to be called", stored, prefs, ok)
+		}
+	}
+
+	withPreferenceValues(t, stringMap{"DeveloperMode": "true"})
+	if prefs, ok := preferencesToApply(irmaclient.Preferences{}); !ok || !prefs.DeveloperMode {
+		t.Errorf("with -pref DeveloperMode=true %+v (apply %t), want the -pref applied", prefs, ok)
+	}
+}
+
+func TestSetPreferences(t *testing.T) {
+	prefs := irmaclient.Preferences{}
+	if err := setPreferences(&prefs, map[string]string{"DeveloperMode": "yes"}); err == nil || prefs.DeveloperMode {
+		t.Errorf("invalid value accepted: %+v, %v", prefs, err)
+	}
+	if err := setPreferences(&prefs, map[string]string{"Unknown": "true"}); err == nil {
+		t.Error("unknown preference accepted")
+	}
+}
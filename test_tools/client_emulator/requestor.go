@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+)
+
+// sessionPackage is the part of the response of the irma server to starting a session that
+// the emulator uses.
+type sessionPackage struct {
+	SessionPtr json.RawMessage `json:"sessionPtr"`
+	Token      string          `json:"token"`
+}
+
+// startRequestorSession starts the session request in the file at the irma server, acting as
+// the requestor, so that no separate requestor is needed to test the client.
+func startRequestorSession(server, path, token string) (*sessionPackage, error) {
+	request, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(server, "/")+"/session", bytes.NewReader(request))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	bts, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("starting session: %s: %s", res.Status, excerpt(string(bts)))
+	}
+	pkg := &sessionPackage{}
+	if err := json.Unmarshal(bts, pkg); err != nil {
+		return nil, fmt.Errorf("starting session: %v", err)
+	}
+	if len(pkg.SessionPtr) == 0 || pkg.Token == "" {
+		return nil, fmt.Errorf("starting session: response contains no session pointer or token")
+	}
+	return pkg, nil
+}
+
+// printSessionPointer prints the session pointer and the universal link containing it to
+// stderr, so that other clients can join the session instead.
+func printSessionPointer(pkg *sessionPackage) {
+	ptr := string(pkg.SessionPtr)
+	fmt.Fprintf(os.Stderr, "Session pointer: %s\n", ptr)
+	fmt.Fprintf(os.Stderr, "Universal link: %s%s\n", universalLinkPrefix, url.PathEscape(ptr))
+	fmt.Fprintf(os.Stderr, "irma:// link: %s%s\n", irmaSchemePrefix, url.PathEscape(ptr))
+}
+
+// awaitExternalClient polls the result of the session at the server until it is finished
+// by some other client, or the timeout expires, and returns the exit code. The final status
+// is reported as the server gives it. The requestor token, if any, authenticates the requests
+// as it does when starting the session; the server refusing them fails the wait.
+func awaitExternalClient(server, session, requestorToken string, timeout time.Duration) int {
+	location := fmt.Sprintf("%s/session/%s/result", strings.TrimSuffix(server, "/"), session)
+	deadline := time.Now().Add(timeout)
+	var status irma.ServerStatus
+	for {
+		bts, code, err := getSessionResult(location, requestorToken)
+		if err == nil && code != http.StatusOK {
+			emit("external-result-failed", "status_code", code, "error", excerpt(string(bts)))
+			return exitFailure
+		}
+		if err == nil {
+			var result struct {
+				Status irma.ServerStatus `json:"status"`
+			}
+			if json.Unmarshal(bts, &result) == nil {
+				status = result.Status
+				if status.Finished() {
+					emit("external-result", "status", status, "result", strings.TrimSpace(string(bts)))
+					if status == irma.ServerStatusDone {
+						return exitSuccess
+					}
+					return exitFailure
+				}
+			}
+		}
+		if time.Now().Add(resultPollInterval).After(deadline) {
+			emit("external-timeout", "status", status, "waited", timeout)
+			return exitDismissed
+		}
+		time.Sleep(resultPollInterval)
+	}
+}
+
+// getSessionResult gets the session result at the location, returning the response body and
+// status code.
+func getSessionResult(location, requestorToken string) ([]byte, int, error) {
+	req, err := http.NewRequest(http.MethodGet, location, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if requestorToken != "" {
+		req.Header.Set("Authorization", requestorToken)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+	bts, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	return bts, res.StatusCode, nil
+}
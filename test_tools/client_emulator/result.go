@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	irma "github.com/privacybydesign/irmago"
+)
+
+// rememberDisclosed records the values of the attributes the choice discloses, for the result
+// printed once the session succeeds.
+func (s *SessionHandler) rememberDisclosed(req *permissionRequest, choice *irma.DisclosureChoice) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for id, value := range disclosedValues(s.client.CredentialInfoList(), choice) {
+		s.disclosed[id] = value
+	}
+	return true
+}
+
+// disclosedValues returns the raw values of the chosen attributes, keyed by attribute type, as
+// stored in the credentials they are disclosed from. The candidates only carry the values that
+// the request asks for, if any.
+func disclosedValues(credentials irma.CredentialInfoList, choice *irma.DisclosureChoice) map[string]string {
+	byHash := map[string]*irma.CredentialInfo{}
+	for _, info := range credentials {
+		byHash[info.Hash] = info
+	}
+	values := map[string]string{}
+	for _, chosen := range choice.Attributes {
+		for _, id := range chosen {
+			values[id.Type.String()] = ""
+			if info, ok := byHash[id.CredentialHash]; ok && info.Attributes[id.Type] != nil {
+				values[id.Type.String()] = info.Attributes[id.Type][""]
+			}
+		}
+	}
+	return values
+}
+
+// recordChoice appends the choice to the -record-choices file. Failing to do so is reported,
+// but does not stop the session.
+func (s *SessionHandler) recordChoice(req *permissionRequest, choice *irma.DisclosureChoice) bool {
+	if choiceRecorder != nil {
+		if err := choiceRecorder.Record(choice); err != nil {
+			s.emit("record-choice-failed", "path", choiceRecorder.Path, "error", err)
+		}
+	}
+	return true
+}
+
+// DisclosureChoiceRecorder appends every disclosure choice the emulator makes to the file at
+// Path as a JSON object, one per line, so that tests can assert on the choices afterwards.
+type DisclosureChoiceRecorder struct {
+	Path string
+
+	mutex sync.Mutex
+}
+
+// Record appends the choice to the file, creating it if necessary.
+func (r *DisclosureChoiceRecorder) Record(choice *irma.DisclosureChoice) error {
+	bts, err := json.Marshal(choice)
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	f, err := os.OpenFile(r.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(bts, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// RenameAttributes returns a copy of result in which the keys occurring in renames are
+// replaced by their new name. Renames for keys that are not in result are ignored.
+func RenameAttributes(result map[string]string, renames map[string]string) map[string]string {
+	renamed := make(map[string]string, len(result))
+	for key, value := range result {
+		if name, ok := renames[key]; ok {
+			key = name
+		}
+		renamed[key] = value
+	}
+	return renamed
+}
+
+// printResult prints the attributes disclosed during the session as the disclosed field of a
+// JSON object, next to the session's correlation ID, indented when -result-pretty is set. With
+// -output-format json the object is a result event.
+func printResult(sessionID string, disclosed map[string]string) {
+	renamed := RenameAttributes(disclosed, attributeRenames)
+	if *outputFormat == "json" {
+		fmt.Println(formatJSON("result", []interface{}{"session_id", sessionID, "disclosed", jsonField{renamed}}))
+		return
+	}
+	fmt.Println(marshalResult(sessionResult{SessionID: sessionID, Disclosed: renamed}))
+}
+
+// sessionResult is the result printed in text mode.
+type sessionResult struct {
+	SessionID string            `json:"session_id"`
+	Disclosed map[string]string `json:"disclosed"`
+}
+
+// formatResult formats the disclosed attributes as a JSON object.
+func formatResult(disclosed map[string]string) string {
+	return marshalResult(RenameAttributes(disclosed, attributeRenames))
+}
+
+func marshalResult(v interface{}) string {
+	var bts []byte
+	var err error
+	if *resultPretty {
+		bts, err = json.MarshalIndent(v, "", "    ")
+	} else {
+		bts, err = json.Marshal(v)
+	}
+	if err != nil {
+		panic(err)
+	}
+	return string(bts)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+)
+
+func TestRenameAttributes(t *testing.T) {
+	result := map[string]string{
+		"irma-demo.RU.studentCard.studentID": "456",
+		"irma-demo.RU.studentCard.level":     "42",
+	}
+	tests := []struct {
+		name    string
+		renames map[string]string
+		want    map[string]string
+	}{
+		{"no renames", nil, result},
+		{
+			"one rename",
+			map[string]string{"irma-demo.RU.studentCard.studentID": "student"},
+			map[string]string{"student": "456", "irma-demo.RU.studentCard.level": "42"},
+		},
+		{"unknown key", map[string]string{"irma-demo.MijnOverheid.root.BSN": "bsn"}, result},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if renamed := RenameAttributes(result, test.renames); !reflect.DeepEqual(renamed, test.want) {
+				t.Errorf("renamed to %v, want %v", renamed, test.want)
+			}
+		})
+	}
+	if result["irma-demo.RU.studentCard.studentID"] != "456" {
+		t.Error("renaming modified the result")
+	}
+}
+
+func TestFormatResult(t *testing.T) {
+	previous := attributeRenames
+	attributeRenames = stringMap{"irma-demo.RU.studentCard.studentID": "student"}
+	t.Cleanup(func() { attributeRenames = previous })
+
+	disclosed := map[string]string{"irma-demo.RU.studentCard.studentID": "456"}
+	if formatted := formatResult(disclosed); formatted != `{"student":"456"}` {
+		t.Errorf("formatted as %s", formatted)
+	}
+}
+
+func TestResultPretty(t *testing.T) {
+	args := []string{"-storage", testStorage(t), "-config", testConfiguration(t),
+		"-max-session-count", "1", "-print-result", "-result-pretty"}
+	stdout, stderr, code := runEmulator(t, studentIDRequest+"\nyes\n", true, args...)
+	if code != exitSuccess {
+		t.Fatalf("exit code %d\n%s%s", code, stdout, stderr)
+	}
+	want := regexp.MustCompile(`(?m)^{\n    "session_id": "[0-9a-f-]{36}",\n    "disclosed": {\n        "irma-demo.RU.studentCard.studentID": "456"\n    }\n}$`)
+	if !want.MatchString(stdout) {
+		t.Errorf("result not indented by four spaces:\n%s", stdout)
+	}
+}
+
+func TestResultText(t *testing.T) {
+	args := []string{"-storage", testStorage(t), "-config", testConfiguration(t),
+		"-max-session-count", "1", "-print-result"}
+	stdout, stderr, code := runEmulator(t, studentIDRequest+"\nyes\n", true, args...)
+	if code != exitSuccess {
+		t.Fatalf("exit code %d\n%s%s", code, stdout, stderr)
+	}
+	var result sessionResult
+	for _, line := range strings.Split(stdout, "\n") {
+		if strings.HasPrefix(line, "{") {
+			if err := json.Unmarshal([]byte(line), &result); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if len(result.SessionID) != 36 {
+		t.Errorf("result has session_id %q\n%s", result.SessionID, stdout)
+	}
+	if want := map[string]string{"irma-demo.RU.studentCard.studentID": "456"}; !reflect.DeepEqual(result.Disclosed, want) {
+		t.Errorf("result disclosed %v, want %v\n%s", result.Disclosed, want, stdout)
+	}
+}
+
+func TestPrintResult(t *testing.T) {
+	for _, print := range []bool{false, true} {
+		args := emulatorArgs(t, "-max-session-count", "1")
+		if print {
+			args = append(args, "-print-result")
+		}
+		stdout, stderr, code := runEmulator(t, studentIDRequest+"\nyes\n", true, args...)
+		if code != exitSuccess {
+			t.Fatalf("exit code %d\n%s%s", code, stdout, stderr)
+		}
+		if results := eventsIn(stdout, "result"); (len(results) == 1) != print {
+			t.Errorf("with -print-result=%t the result was printed %d times\n%s", print, len(results), stdout)
+		}
+	}
+}
+
+func TestDisclosedValues(t *testing.T) {
+	log := captureEvents(t)
+	client, _ := newTestClient(t)
+
+	result := runTestSession(t, client, studentIDRequest, "yes\n")
+	if result.kind != outcomeSuccess {
+		t.Fatalf("session finished with %s\n%s", result.kind, log)
+	}
+	want := map[string]string{"irma-demo.RU.studentCard.studentID": "456"}
+	if !reflect.DeepEqual(result.disclosed, want) {
+		t.Errorf("disclosed %v, want %v", result.disclosed, want)
+	}
+}
+
+// recordedChoices returns the choices recorded in the file, in order.
+func recordedChoices(t *testing.T, path string) []irma.DisclosureChoice {
+	t.Helper()
+	bts, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	choices := []irma.DisclosureChoice{}
+	for _, line := range strings.Split(strings.TrimSuffix(string(bts), "\n"), "\n") {
+		choice := irma.DisclosureChoice{}
+		if err := json.Unmarshal([]byte(line), &choice); err != nil {
+			t.Fatalf("malformed line %q: %v", line, err)
+		}
+		choices = append(choices, choice)
+	}
+	return choices
+}
+
+func TestDisclosureChoiceRecorder(t *testing.T) {
+	client, _ := newTestClient(t)
+	path := filepath.Join(t.TempDir(), "choices.jsonl")
+	previous := choiceRecorder
+	choiceRecorder = &DisclosureChoiceRecorder{Path: path}
+	t.Cleanup(func() { choiceRecorder = previous })
+
+	// Two disjunctions, each disclosing an attribute of the studentCard
+	request := `{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[` +
+		`[["irma-demo.RU.studentCard.studentID"]],[["irma-demo.RU.studentCard.level"]]]}`
+	for i := 0; i < 2; i++ {
+		if result := runTestSession(t, client, request, "yes\n"); result.kind != outcomeSuccess {
+			t.Fatalf("session %d finished with %s", i, result.kind)
+		}
+	}
+
+	choices := recordedChoices(t, path)
+	if len(choices) != 2 {
+		t.Fatalf("recorded %d choices, want one per session", len(choices))
+	}
+	hash := newestCredential(client, irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")).Hash
+	for _, choice := range choices {
+		if len(choice.Attributes) != 2 || len(choice.Attributes[0]) != 1 || len(choice.Attributes[1]) != 1 {
+			t.Fatalf("recorded %v, want one attribute for each disjunction", choice.Attributes)
+		}
+		first, second := choice.Attributes[0][0], choice.Attributes[1][0]
+		if first.Type.String() != "irma-demo.RU.studentCard.studentID" || second.Type.String() != "irma-demo.RU.studentCard.level" ||
+			first.CredentialHash != hash || second.CredentialHash != hash {
+			t.Errorf("recorded %v and %v", first, second)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+)
+
+// revocationStatus updates the nonrevocation witnesses of the stored instances of a credential
+// type from its revocation server, and emits for each instance whether it is revoked. The
+// argument is either a credential type, checking all of its instances, or the hash of a single
+// instance. Alongside each instance the latest accumulator at the revocation server is
+// reported; irmaclient does not expose the witnesses themselves, so how stale a witness was
+// before the update is unknown.
+func revocationStatus(client *irmaclient.Client, arg string) {
+	credtype := irma.NewCredentialTypeIdentifier(arg)
+	hash := ""
+	for _, info := range client.CredentialInfoList() {
+		if info.Hash == arg {
+			credtype, hash = info.Identifier(), arg
+		}
+	}
+	ct, ok := client.Configuration.CredentialTypes[credtype]
+	if !ok {
+		emit("revocation-status-failed", "credential", arg, "error", "unknown credential type or hash")
+		return
+	}
+	if !ct.RevocationSupported() {
+		emit("revocation-status-failed", "credential", arg, "error", "credential type does not support revocation")
+		return
+	}
+
+	// The instances to report on, and the issuer key counter of each
+	counters := map[string]uint{}
+	for i := 0; ; i++ {
+		attrs := client.Attributes(credtype, i)
+		if attrs == nil {
+			break
+		}
+		if hash == "" || attrs.Hash() == hash {
+			counters[attrs.Hash()] = attrs.KeyCounter()
+		}
+	}
+	if len(counters) == 0 {
+		emit("revocation-status-failed", "credential", arg, "error", "credential not stored")
+		return
+	}
+	revokedBefore := map[string]bool{}
+	for _, info := range client.CredentialInfoList() {
+		revokedBefore[info.Hash] = info.Revoked
+	}
+
+	if err := client.NonrevUpdateFromServer(credtype); err != nil {
+		emit("revocation-status-failed", "credential", arg, "error", err)
+		return
+	}
+
+	for _, info := range client.CredentialInfoList() {
+		counter, ok := counters[info.Hash]
+		if !ok {
+			continue
+		}
+		fields := []interface{}{"type", credtype, "hash", info.Hash, "revoked", info.Revoked,
+			"newly_revoked", info.Revoked && !revokedBefore[info.Hash], "key_counter", counter}
+		if index, at, err := latestAccumulator(client.Configuration, credtype, counter); err != nil {
+			fields = append(fields, "accumulator_error", err)
+		} else {
+			fields = append(fields, "accumulator_index", index, "accumulator_time", at.UTC().Format(time.RFC3339),
+				"accumulator_age", now().Sub(at).Truncate(time.Second))
+		}
+		emit("revocation-status", fields...)
+	}
+}
+
+// latestAccumulator returns the index and time of the latest accumulator of the credential type
+// and issuer key counter at the revocation server.
+func latestAccumulator(conf *irma.Configuration, credtype irma.CredentialTypeIdentifier, counter uint) (uint64, time.Time, error) {
+	update, err := irma.RevocationClient{Conf: conf}.FetchUpdateLatest(credtype, counter, 0)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	pk, err := conf.PublicKey(credtype.IssuerIdentifier(), counter)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if pk == nil {
+		return 0, time.Time{}, fmt.Errorf("public key %s-%d not found", credtype.IssuerIdentifier(), counter)
+	}
+	acc, err := update.SignedAccumulator.UnmarshalVerify(pk)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return acc.Index, time.Unix(acc.Time, 0), nil
+}
+
+// updateRevocation brings the nonrevocation witnesses of the stored credentials up to date
+// with the revocation server, so that later sessions need not do so, emitting for each
+// credential type how long it took. The argument names a single credential type; when empty,
+// all stored credential types that support revocation are updated. irmaclient exposes neither
+// the witnesses nor the update events it applied to them, so the number of applied events is
+// not reported.
+func updateRevocation(client *irmaclient.Client, arg string) {
+	stored := map[irma.CredentialTypeIdentifier]bool{}
+	for _, info := range client.CredentialInfoList() {
+		credtype := info.Identifier()
+		if arg != "" && credtype.String() != arg {
+			continue
+		}
+		if ct, ok := client.Configuration.CredentialTypes[credtype]; ok && ct.RevocationSupported() {
+			stored[credtype] = true
+		}
+	}
+	if arg != "" && len(stored) == 0 {
+		emit("revocation-update-failed", "type", arg, "error", "no stored credential of this type supports revocation")
+		return
+	}
+
+	credtypes := make([]irma.CredentialTypeIdentifier, 0, len(stored))
+	for credtype := range stored {
+		credtypes = append(credtypes, credtype)
+	}
+	sort.Slice(credtypes, func(i, j int) bool { return credtypes[i].String() < credtypes[j].String() })
+	for _, credtype := range credtypes {
+		start := time.Now()
+		if err := client.NonrevUpdateFromServer(credtype); err != nil {
+			emit("revocation-update-failed", "type", credtype, "error", err)
+			continue
+		}
+		emit("revocation-updated", "type", credtype, "duration", time.Since(start))
+	}
+	emit("revocation-update-done", "types", len(credtypes))
+}
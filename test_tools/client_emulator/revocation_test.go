@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRevocationStatusFailures(t *testing.T) {
+	log := captureEvents(t)
+	client, _ := newTestClient(t)
+
+	tests := map[string]string{
+		"irma-demo.RU.unknownCard": "unknown credential type or hash",
+		"irma-demo.RU.studentCard": "credential type does not support revocation",
+		// Supports revocation, but the test storage holds no instance of it
+		"irma-demo.MijnOverheid.root": "credential not stored",
+	}
+	for arg, want := range tests {
+		revocationStatus(client, arg)
+		failed := log.named("revocation-status-failed")
+		if len(failed) == 0 || failed[len(failed)-1]["credential"] != arg || failed[len(failed)-1]["error"] != want {
+			t.Errorf("revocation-status %s emitted %v, want error %q", arg, failed, want)
+		}
+	}
+	if statuses := log.named("revocation-status"); len(statuses) != 0 {
+		t.Errorf("revocation-status events %v", statuses)
+	}
+}
+
+func TestUpdateRevocation(t *testing.T) {
+	log := captureEvents(t)
+	client, _ := newTestClient(t)
+
+	// None of the credentials in the test storage supports revocation
+	updateRevocation(client, "")
+	if done := log.named("revocation-update-done"); len(done) != 1 || done[0]["types"] != 0.0 || len(log.named("revocation-updated")) != 0 {
+		t.Errorf("updating all credential types emitted\n%s", log)
+	}
+	updateRevocation(client, "irma-demo.RU.studentCard")
+	failed := log.named("revocation-update-failed")
+	if len(failed) != 1 || failed[0]["type"] != "irma-demo.RU.studentCard" ||
+		failed[0]["error"] != "no stored credential of this type supports revocation" {
+		t.Errorf("revocation-update-failed events %v", failed)
+	}
+	if done := log.named("revocation-update-done"); len(done) != 1 {
+		t.Errorf("revocation-update-done events %v after a failed update", done)
+	}
+}
+
+func TestPreloadRevocation(t *testing.T) {
+	stdout, stderr, code := runEmulator(t, studentIDRequest+"\nyes\n", true, emulatorArgs(t, "-preload-revocation", "-print-result")...)
+	if code != exitSuccess {
+		t.Fatalf("exit code %d\n%s%s", code, stdout, stderr)
+	}
+	done, results := eventsIn(stdout, "revocation-update-done"), eventsIn(stdout, "result")
+	if len(done) != 1 || done[0]["types"] != 0.0 || len(results) != 1 {
+		t.Errorf("-preload-revocation emitted\n%s", stdout)
+	}
+	if strings.Index(stdout, `"revocation-update-done"`) > strings.Index(stdout, `"permission-request"`) {
+		t.Errorf("preloaded after the session started\n%s", stdout)
+	}
+}
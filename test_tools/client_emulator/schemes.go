@@ -0,0 +1,636 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+)
+
+// updateSchemes updates all schemes, informing the client and its handler of what was
+// downloaded in the same way irmaclient does when a session needs a newer scheme. If report
+// is not nil, it is called for every scheme with what was downloaded for it.
+func updateSchemes(client *irmaclient.Client, handler irmaclient.ClientHandler,
+	report func(scheme irma.Scheme, downloaded *irma.IrmaIdentifierSet)) (*irma.IrmaIdentifierSet, error) {
+	downloaded := newIdentifierSet()
+	conf := client.Configuration
+	schemes := []irma.Scheme{}
+	for _, scheme := range conf.SchemeManagers {
+		schemes = append(schemes, scheme)
+	}
+	for _, scheme := range conf.RequestorSchemes {
+		schemes = append(schemes, scheme)
+	}
+	for _, scheme := range schemes {
+		set := newIdentifierSet()
+		if err := conf.UpdateScheme(scheme, set); err != nil {
+			return nil, err
+		}
+		if report != nil {
+			report(scheme, set)
+		}
+		mergeIdentifierSet(downloaded, set)
+	}
+
+	if !downloaded.Empty() {
+		if err := client.ConfigurationUpdated(downloaded); err != nil {
+			return nil, err
+		}
+		handler.UpdateConfiguration(downloaded)
+	}
+	return downloaded, nil
+}
+
+func newIdentifierSet() *irma.IrmaIdentifierSet {
+	return &irma.IrmaIdentifierSet{
+		SchemeManagers:   map[irma.SchemeManagerIdentifier]struct{}{},
+		Issuers:          map[irma.IssuerIdentifier]struct{}{},
+		CredentialTypes:  map[irma.CredentialTypeIdentifier]struct{}{},
+		PublicKeys:       map[irma.IssuerIdentifier][]uint{},
+		AttributeTypes:   map[irma.AttributeTypeIdentifier]struct{}{},
+		RequestorSchemes: map[irma.RequestorSchemeIdentifier]struct{}{},
+	}
+}
+
+func mergeIdentifierSet(dst, src *irma.IrmaIdentifierSet) {
+	for id := range src.SchemeManagers {
+		dst.SchemeManagers[id] = struct{}{}
+	}
+	for id := range src.Issuers {
+		dst.Issuers[id] = struct{}{}
+	}
+	for id := range src.CredentialTypes {
+		dst.CredentialTypes[id] = struct{}{}
+	}
+	for id, counters := range src.PublicKeys {
+		dst.PublicKeys[id] = append(dst.PublicKeys[id], counters...)
+	}
+	for id := range src.AttributeTypes {
+		dst.AttributeTypes[id] = struct{}{}
+	}
+	for id := range src.RequestorSchemes {
+		dst.RequestorSchemes[id] = struct{}{}
+	}
+}
+
+// updateSchemesAtStartup updates all schemes before the session starts, emitting per scheme
+// whether it was up to date or what changed. It gives up after the timeout.
+func updateSchemesAtStartup(client *irmaclient.Client, handler irmaclient.ClientHandler, timeout time.Duration) error {
+	report := func(scheme irma.Scheme, downloaded *irma.IrmaIdentifierSet) {
+		id, timestamp := schemeInfo(scheme)
+		if downloaded.Empty() {
+			emit("scheme-up-to-date", "id", id, "timestamp", timestamp)
+			return
+		}
+		emit("scheme-updated",
+			"id", id,
+			"timestamp", timestamp,
+			"issuers", identifiers(downloaded.Issuers),
+			"credential_types", identifiers(downloaded.CredentialTypes),
+			"public_keys", identifiers(downloaded.PublicKeys),
+		)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := updateSchemes(client, handler, report)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("updating schemes took longer than %s", timeout)
+	}
+}
+
+// schemeInfo returns the identifier and the (Unix) timestamp of the scheme.
+func schemeInfo(scheme irma.Scheme) (string, int64) {
+	switch scheme := scheme.(type) {
+	case *irma.SchemeManager:
+		return scheme.ID, time.Time(scheme.Timestamp).Unix()
+	case *irma.RequestorScheme:
+		return scheme.ID.String(), time.Time(scheme.Timestamp).Unix()
+	}
+	return "", 0
+}
+
+// schemesMutex serialises the scheme updates triggered by the force-update command,
+// -auto-update-interval and SIGHUP, which run in different goroutines.
+var schemesMutex sync.Mutex
+
+func forceUpdate(client *irmaclient.Client, handler irmaclient.ClientHandler) {
+	schemesMutex.Lock()
+	defer schemesMutex.Unlock()
+	downloaded, err := updateSchemes(client, handler, nil)
+	if err != nil {
+		emit("update-failed", "error", err)
+	} else if downloaded.Empty() {
+		emit("config-unchanged")
+	}
+}
+
+// autoUpdateSchemes periodically updates the schemes in the background, until the returned
+// function is called, which waits for an update in progress to finish so that the client can be
+// closed afterwards.
+func autoUpdateSchemes(client *irmaclient.Client, handler irmaclient.ClientHandler, interval time.Duration) func() {
+	ticker := time.NewTicker(interval)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-ticker.C:
+				forceUpdate(client, handler)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(stop)
+		<-done
+	}
+}
+
+// updateSchemesOnHangup updates the schemes in the background whenever SIGHUP is received, so
+// that a long-running emulator picks up scheme updates without being restarted. This goes on
+// until the returned function is called, which waits for a reload in progress to finish so that
+// the client can be closed afterwards.
+func updateSchemesOnHangup(client *irmaclient.Client, handler irmaclient.ClientHandler) func() {
+	hangups := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		defer close(done)
+		for range hangups {
+			emit("config-reload", "signal", "SIGHUP")
+			forceUpdate(client, handler)
+		}
+	}()
+	return func() {
+		signal.Stop(hangups)
+		close(hangups)
+		<-done
+	}
+}
+
+// Canonical locations of the schemes installed by -auto-demo-scheme and -auto-pbdf-scheme
+const (
+	demoSchemeURL = "https://privacybydesign.foundation/schememanager/irma-demo"
+	pbdfSchemeURL = "https://privacybydesign.foundation/schememanager/pbdf"
+)
+
+// noSchemes reports whether the configuration contains no schemes at all.
+func noSchemes(conf *irma.Configuration) bool {
+	return len(conf.SchemeManagers) == 0 && len(conf.RequestorSchemes) == 0
+}
+
+// installScheme downloads the scheme at the URL and installs it into the configuration,
+// verifying its signature against publicKey, the PEM-encoded public key of the scheme. Without
+// publicKey, the public key published alongside the scheme is trusted on first use instead.
+// Installing a scheme that is already present is reported and otherwise ignored, provided that
+// it has the given public key.
+func installScheme(conf *irma.Configuration, url string, publicKey []byte) error {
+	if publicKey != nil {
+		if block, _ := pem.Decode(publicKey); block == nil {
+			return errors.New("public key is not PEM encoded")
+		}
+	}
+	if id, timestamp, ok := schemeByURL(conf, url); ok {
+		if publicKey != nil {
+			if err := checkSchemeKey(conf, id, publicKey); err != nil {
+				return err
+			}
+		}
+		emit("scheme-present", "id", id, "url", url, "timestamp", time.Time(timestamp).Unix())
+		return nil
+	}
+
+	var err error
+	if publicKey != nil {
+		err = conf.InstallScheme(url, publicKey)
+	} else {
+		err = conf.DangerousTOFUInstallScheme(url)
+	}
+	if err != nil {
+		return err
+	}
+	id, timestamp, ok := schemeByURL(conf, url)
+	if !ok {
+		return fmt.Errorf("scheme at %s was installed but cannot be found in the configuration", url)
+	}
+	emit("scheme-installed", "id", id, "url", url, "timestamp", time.Time(timestamp).Unix())
+	return nil
+}
+
+// parseSchemeInstall parses an -install-scheme <url>=<pubkeyfile>, reading the public key from
+// the file. The URL ends at the last =, as it may itself contain one.
+func parseSchemeInstall(spec string) (string, []byte, error) {
+	i := strings.LastIndex(spec, "=")
+	if i <= 0 || i == len(spec)-1 {
+		return "", nil, fmt.Errorf("expected <url>=<pubkeyfile>, got %q", spec)
+	}
+	publicKey, err := ioutil.ReadFile(spec[i+1:])
+	if err != nil {
+		return "", nil, err
+	}
+	return spec[:i], publicKey, nil
+}
+
+// checkSchemeKey checks that the scheme in the configuration has the PEM-encoded public key.
+func checkSchemeKey(conf *irma.Configuration, id string, publicKey []byte) error {
+	given, _ := pem.Decode(publicKey)
+	if given == nil {
+		return errors.New("public key is not PEM encoded")
+	}
+	stored, err := ioutil.ReadFile(filepath.Join(conf.Path, id, "pk.pem"))
+	if err != nil {
+		return err
+	}
+	if block, _ := pem.Decode(stored); block == nil || !bytes.Equal(block.Bytes, given.Bytes) {
+		return errors.New("the scheme in the configuration has a different public key")
+	}
+	return nil
+}
+
+// trustedScheme is an entry of the -trusted-schemes file, pinning the public key of a scheme.
+type trustedScheme struct {
+	ID        string `json:"id"`
+	URL       string `json:"url"` // only needed when the scheme is not yet in the configuration
+	PublicKey string `json:"public_key"`
+}
+
+// trustSchemes adds the schemes listed in the -trusted-schemes file to the configuration.
+// Schemes that are not yet present are installed from their URL, trusting only the given
+// public key instead of the key found at the URL; for schemes that are present the stored
+// public key must be the given one.
+func trustSchemes(conf *irma.Configuration, path string) error {
+	bts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var entries []trustedScheme
+	if err := json.Unmarshal(bts, &entries); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	for i, entry := range entries {
+		if entry.ID == "" || entry.PublicKey == "" {
+			return fmt.Errorf("entry %d: id and public_key are required", i)
+		}
+		if block, _ := pem.Decode([]byte(entry.PublicKey)); block == nil {
+			return fmt.Errorf("entry %d (%s): public_key is not PEM encoded", i, entry.ID)
+		}
+
+		_, manager := conf.SchemeManagers[irma.NewSchemeManagerIdentifier(entry.ID)]
+		_, requestor := conf.RequestorSchemes[irma.NewRequestorSchemeIdentifier(entry.ID)]
+		if manager || requestor {
+			if err := checkSchemeKey(conf, entry.ID, []byte(entry.PublicKey)); err != nil {
+				return fmt.Errorf("entry %d (%s): %v", i, entry.ID, err)
+			}
+			emit("scheme-trusted", "id", entry.ID, "installed", false)
+			continue
+		}
+
+		if entry.URL == "" {
+			return fmt.Errorf("entry %d (%s): scheme is not in the configuration and no url is given", i, entry.ID)
+		}
+		if err := conf.InstallScheme(entry.URL, []byte(entry.PublicKey)); err != nil {
+			return fmt.Errorf("entry %d (%s): %v", i, entry.ID, err)
+		}
+		if id, _, ok := schemeByURL(conf, entry.URL); !ok || id != entry.ID {
+			return fmt.Errorf("entry %d (%s): the scheme at %s has id %q", i, entry.ID, entry.URL, id)
+		}
+		emit("scheme-trusted", "id", entry.ID, "installed", true)
+	}
+	return nil
+}
+
+// schemeByURL returns the identifier and timestamp of the installed scheme with the URL.
+func schemeByURL(conf *irma.Configuration, url string) (string, irma.Timestamp, bool) {
+	url = strings.TrimSuffix(url, "/")
+	for id, scheme := range conf.SchemeManagers {
+		if strings.TrimSuffix(scheme.URL, "/") == url {
+			return id.String(), scheme.Timestamp, true
+		}
+	}
+	for id, scheme := range conf.RequestorSchemes {
+		if strings.TrimSuffix(scheme.URL, "/") == url {
+			return id.String(), scheme.Timestamp, true
+		}
+	}
+	return "", irma.Timestamp{}, false
+}
+
+// identifiers formats the keys of an identifier map as a sorted, comma-separated list.
+func identifiers(set interface{}) string {
+	ids := []string{}
+	switch set := set.(type) {
+	case map[irma.SchemeManagerIdentifier]struct{}:
+		for id := range set {
+			ids = append(ids, id.String())
+		}
+	case map[irma.IssuerIdentifier]struct{}:
+		for id := range set {
+			ids = append(ids, id.String())
+		}
+	case map[irma.CredentialTypeIdentifier]struct{}:
+		for id := range set {
+			ids = append(ids, id.String())
+		}
+	case map[irma.AttributeTypeIdentifier]struct{}:
+		for id := range set {
+			ids = append(ids, id.String())
+		}
+	case map[irma.RequestorSchemeIdentifier]struct{}:
+		for id := range set {
+			ids = append(ids, id.String())
+		}
+	case map[irma.IssuerIdentifier][]uint:
+		for id := range set {
+			ids = append(ids, id.String())
+		}
+	case []irma.SchemeManagerIdentifier:
+		for _, id := range set {
+			ids = append(ids, id.String())
+		}
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+// readConfiguration parses the irma_configuration directory at path without modifying it.
+func readConfiguration(path string) (*irma.Configuration, error) {
+	// irma.NewConfiguration creates the directory if it does not exist
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	conf, err := irma.NewConfiguration(path, irma.ConfigurationOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	if err = conf.ParseFolder(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// listSchemeManagers emits the identifier and URL of every scheme manager in the
+// irma_configuration directory at path, without starting the client.
+func listSchemeManagers(path string) int {
+	conf, err := readConfiguration(path)
+	if err != nil {
+		return configurationFailure(path, err)
+	}
+
+	ids := []string{}
+	for id := range conf.SchemeManagers {
+		ids = append(ids, id.String())
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		emit("scheme-manager", "id", id, "url", conf.SchemeManagers[irma.NewSchemeManagerIdentifier(id)].URL)
+	}
+	return exitSuccess
+}
+
+// listCredentialTypes emits every credential type in the irma_configuration directory at
+// path, along with its issuer and scheme, without starting the client.
+func listCredentialTypes(path string) int {
+	conf, err := readConfiguration(path)
+	if err != nil {
+		return configurationFailure(path, err)
+	}
+
+	ids := []string{}
+	for id := range conf.CredentialTypes {
+		ids = append(ids, id.String())
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		credtype := irma.NewCredentialTypeIdentifier(id)
+		emit("credential-type", "id", id, "issuer", credtype.IssuerIdentifier(), "scheme", credtype.Root())
+	}
+	return exitSuccess
+}
+
+// listAttributeTypes emits the attribute types of the credential type in the
+// irma_configuration directory at path, in the order in which the credential type
+// defines them, without starting the client.
+func listAttributeTypes(path string, credtype irma.CredentialTypeIdentifier) int {
+	conf, err := readConfiguration(path)
+	if err != nil {
+		return configurationFailure(path, err)
+	}
+	ct, ok := conf.CredentialTypes[credtype]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown credential type %s\n", credtype)
+		return exitFailure
+	}
+
+	for _, attr := range ct.AttributeTypes {
+		emit("attribute-type",
+			"id", attr.GetAttributeTypeIdentifier(),
+			"optional", attr.IsOptional(),
+			"name", LocalisedName(*attr, *attributeLocale),
+			"description", localised(attr.Description, *attributeLocale),
+		)
+	}
+	return exitSuccess
+}
+
+// LocalisedName returns the name of the attribute type in the given language, falling back to
+// English and then to any other language the scheme specifies it in.
+func LocalisedName(t irma.AttributeType, locale string) string {
+	return localised(t.Name, locale)
+}
+
+// localised returns the translation of ts in the given language, falling back to English and
+// then to the first other language in alphabetical order, or "" if there is none.
+func localised(ts irma.TranslatedString, locale string) string {
+	if text := ts[locale]; text != "" {
+		return text
+	}
+	if text := ts["en"]; text != "" {
+		return text
+	}
+	languages := make([]string, 0, len(ts))
+	for language := range ts {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+	for _, language := range languages {
+		if text := ts[language]; text != "" {
+			return text
+		}
+	}
+	return ""
+}
+
+// configurationFailure reports that the configuration at path could not be read, and returns
+// the exit code for it.
+func configurationFailure(path string, err error) int {
+	if msg, ok := schemeFailure(err); ok {
+		fmt.Fprintln(os.Stderr, msg)
+		return exitScheme
+	}
+	fmt.Fprintf(os.Stderr, "Failed to read configuration %s: %v\n", path, err)
+	return exitStartup
+}
+
+// schemeFailure describes why a scheme failed to load, identifying the scheme and, where
+// possible, the file at fault. It returns false if err is not about a specific scheme.
+func schemeFailure(err error) (string, bool) {
+	serr, ok := err.(*irma.SchemeManagerError)
+	if !ok {
+		return "", false
+	}
+
+	file := regexp.MustCompile(`\S*` + regexp.QuoteMeta(serr.Scheme) + `/\S*`).FindString(serr.Err.Error())
+	if file == "" {
+		switch serr.Status {
+		case irma.SchemeManagerStatusInvalidSignature:
+			file = "index.sig"
+		case irma.SchemeManagerStatusInvalidIndex:
+			file = "index"
+		case irma.SchemeManagerStatusParsingError:
+			file = "description.xml"
+		default:
+			file = "unknown"
+		}
+	}
+
+	msg := fmt.Sprintf("Scheme %s failed to load (%s), file %s: %v", serr.Scheme, serr.Status, file, serr.Err)
+	switch serr.Status {
+	case irma.SchemeManagerStatusInvalidIndex, irma.SchemeManagerStatusInvalidSignature:
+		msg += "\nThe scheme was modified after it was signed; developer and test schemes need to be " +
+			"re-signed with the scheme's signing key (irma scheme sign), or downloaded anew"
+	}
+	return msg, true
+}
+
+// issueURL returns the URL at which the credential type can be obtained according to its
+// scheme, preferring the English one, or "" if the scheme does not specify it.
+func issueURL(conf *irma.Configuration, credtype irma.CredentialTypeIdentifier) string {
+	ct, ok := conf.CredentialTypes[credtype]
+	if !ok || len(ct.IssueURL) == 0 {
+		return ""
+	}
+	if url := ct.IssueURL["en"]; url != "" {
+		return url
+	}
+	languages := make([]string, 0, len(ct.IssueURL))
+	for language := range ct.IssueURL {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+	for _, language := range languages {
+		if url := ct.IssueURL[language]; url != "" {
+			return url
+		}
+	}
+	return ""
+}
+
+// issuerKey identifies a public key of an issuer.
+type issuerKey struct {
+	issuer  irma.IssuerIdentifier
+	counter uint
+}
+
+func (k issuerKey) String() string {
+	return fmt.Sprintf("%s-%d", k.issuer, k.counter)
+}
+
+// requiredKeys returns the issuer public keys the client needs to perform the session: those
+// of the credentials to be issued, and those of the credentials in storage that can be
+// disclosed, sorted.
+func requiredKeys(client *irmaclient.Client, request irma.SessionRequest, candidates [][]irmaclient.DisclosureCandidates) []issuerKey {
+	keys := map[issuerKey]struct{}{}
+	if issuance, ok := request.(*irma.IssuanceRequest); ok {
+		for _, cred := range issuance.Credentials {
+			keys[issuerKey{cred.CredentialTypeID.IssuerIdentifier(), cred.KeyCounter}] = struct{}{}
+		}
+	}
+	for _, discon := range candidates {
+		for _, con := range discon {
+			for _, candidate := range con {
+				if candidate.CredentialHash == "" {
+					continue
+				}
+				credtype := candidate.Type.CredentialTypeIdentifier()
+				for i := 0; ; i++ {
+					attrs := client.Attributes(credtype, i)
+					if attrs == nil {
+						break
+					}
+					if attrs.Hash() == candidate.CredentialHash {
+						keys[issuerKey{credtype.IssuerIdentifier(), attrs.KeyCounter()}] = struct{}{}
+						break
+					}
+				}
+			}
+		}
+	}
+
+	sorted := make([]issuerKey, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].issuer != sorted[j].issuer {
+			return sorted[i].issuer.String() < sorted[j].issuer.String()
+		}
+		return sorted[i].counter < sorted[j].counter
+	})
+	return sorted
+}
+
+func joinKeys(keys []issuerKey) string {
+	strs := make([]string, len(keys))
+	for i, key := range keys {
+		strs[i] = key.String()
+	}
+	return strings.Join(strs, ",")
+}
+
+// missingKeys returns the keys that are not present in the client's copy of the schemes.
+func missingKeys(conf *irma.Configuration, keys []issuerKey) []issuerKey {
+	missing := []issuerKey{}
+	for _, key := range keys {
+		if pk, err := conf.PublicKey(key.issuer, key.counter); err != nil || pk == nil {
+			missing = append(missing, key)
+		}
+	}
+	return missing
+}
+
+// reportMissingKeys emits which issuer public keys the request of a check-keys session
+// requires and which of those are missing, and then declines it, as such a session only checks
+// the keys.
+func (s *SessionHandler) reportMissingKeys(req *permissionRequest) bool {
+	if !s.checkKeys {
+		return true
+	}
+	keys := requiredKeys(s.client, req.request, req.candidates)
+	missing := missingKeys(s.client.Configuration, keys)
+	s.emit("missing-keys", "required", joinKeys(keys), "missing", joinKeys(missing), "count", len(missing))
+	return false
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+)
+
+func TestListSchemeManagers(t *testing.T) {
+	log := captureEvents(t)
+	if code := listSchemeManagers(testConfiguration(t)); code != exitSuccess {
+		t.Fatalf("exit code %d\n%s", code, log)
+	}
+	managers := map[string]interface{}{}
+	for _, event := range log.named("scheme-manager") {
+		managers[event["id"].(string)] = event["url"]
+	}
+	want := map[string]interface{}{
+		"irma-demo": "http://localhost:48681/irma_configuration/irma-demo",
+		"test":      "http://localhost:48681/irma_configuration/test",
+	}
+	if !reflect.DeepEqual(managers, want) {
+		t.Errorf("listed %v, want %v", managers, want)
+	}
+
+	nonexistent := filepath.Join(t.TempDir(), "nonexistent")
+	if code := listSchemeManagers(nonexistent); code != exitStartup {
+		t.Errorf("listing a nonexistent directory gave exit code %d", code)
+	}
+	if _, err := os.Stat(nonexistent); !os.IsNotExist(err) {
+		t.Error("listing created the directory")
+	}
+}
+
+func TestListCredentialTypes(t *testing.T) {
+	stdout, stderr, code := runEmulator(t, "", true,
+		"-credential-type-list", "-config", testConfiguration(t), "-output-format", "json")
+	if code != exitSuccess {
+		t.Fatalf("exit code %d\n%s%s", code, stdout, stderr)
+	}
+	listed := eventsIn(stdout, "credential-type")
+	ids := []string{}
+	for _, event := range listed {
+		ids = append(ids, event["id"].(string))
+		if event["id"] == "irma-demo.RU.studentCard" && (event["issuer"] != "irma-demo.RU" || event["scheme"] != "irma-demo") {
+			t.Errorf("studentCard listed as %v", event)
+		}
+	}
+	if !sort.StringsAreSorted(ids) || !containsString(ids, "irma-demo.RU.studentCard") || !containsString(ids, "test.test.mijnirma") {
+		t.Errorf("listed %v", ids)
+	}
+
+	stdout, _, _ = runEmulator(t, "", true, "-credential-type-list", "-config", testConfiguration(t))
+	if !strings.Contains(stdout, "credential-type id=irma-demo.RU.studentCard issuer=irma-demo.RU scheme=irma-demo\n") {
+		t.Errorf("text output lacks the studentCard:\n%s", stdout)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestListAttributeTypes(t *testing.T) {
+	log := captureEvents(t)
+	credtype := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	if code := listAttributeTypes(testConfiguration(t), credtype); code != exitSuccess {
+		t.Fatalf("exit code %d\n%s", code, log)
+	}
+	listed := []string{}
+	for _, event := range log.named("attribute-type") {
+		listed = append(listed, event["id"].(string))
+	}
+	want := []string{
+		"irma-demo.RU.studentCard.university",
+		"irma-demo.RU.studentCard.studentCardNumber",
+		"irma-demo.RU.studentCard.studentID",
+		"irma-demo.RU.studentCard.level",
+	}
+	if !reflect.DeepEqual(listed, want) {
+		t.Fatalf("listed %v, want %v in the order of the scheme", listed, want)
+	}
+	if first := log.named("attribute-type")[0]; first["name"] != "University" || first["description"] != "The name of the university" {
+		t.Errorf("university listed as %v", first)
+	}
+
+	unknown := irma.NewCredentialTypeIdentifier("irma-demo.RU.nothing")
+	if code := listAttributeTypes(testConfiguration(t), unknown); code != exitFailure {
+		t.Errorf("listing an unknown credential type gave exit code %d", code)
+	}
+}
+
+func TestLocalisedName(t *testing.T) {
+	attr := irma.AttributeType{Name: irma.TranslatedString{"en": "Type", "nl": "Soort"}}
+	tests := []struct {
+		attr   irma.AttributeType
+		locale string
+		want   string
+	}{
+		{attr, "en", "Type"},
+		{attr, "nl", "Soort"},
+		{attr, "de", "Type"},
+		{irma.AttributeType{Name: irma.TranslatedString{"nl": "Soort", "fr": "Sorte"}}, "de", "Sorte"},
+		{irma.AttributeType{}, "en", ""},
+	}
+	for _, test := range tests {
+		if name := LocalisedName(test.attr, test.locale); name != test.want {
+			t.Errorf("name %v in %s is %q, want %q", test.attr.Name, test.locale, name, test.want)
+		}
+	}
+}
+
+func TestAttributeLocale(t *testing.T) {
+	for locale, want := range map[string]string{"en": "Type", "nl": "Soort"} {
+		log := captureEvents(t)
+		setFlag(t, "attribute-locale", locale)
+		if code := listAttributeTypes(testConfiguration(t), irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")); code != exitSuccess {
+			t.Fatalf("exit code %d", code)
+		}
+		listed := log.named("attribute-type")
+		if len(listed) != 4 || listed[3]["name"] != want {
+			t.Errorf("level listed in %s as %v, want name %q", locale, listed, want)
+		}
+	}
+}
+
+func TestConfigReloadOnHangup(t *testing.T) {
+	log := captureEvents(t)
+	client, handler := newTestClient(t)
+	stop := updateSchemesOnHangup(client, handler)
+	defer stop()
+
+	process, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Signal(syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	// The schemes' servers do not run, so the update is triggered but fails
+	deadline := time.Now().Add(10 * time.Second)
+	for len(log.named("update-failed"))+len(log.named("config-unchanged")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if reloads := log.named("config-reload"); len(reloads) != 1 || reloads[0]["signal"] != "SIGHUP" {
+		t.Errorf("config-reload events %v\n%s", reloads, log)
+	}
+	if len(log.named("update-failed"))+len(log.named("config-unchanged")) != 1 {
+		t.Errorf("no scheme update after SIGHUP\n%s", log)
+	}
+}
+
+func TestAutoUpdateSchemes(t *testing.T) {
+	log := captureEvents(t)
+	client, handler := newTestClient(t)
+	stop := autoUpdateSchemes(client, handler, 10*time.Millisecond)
+
+	// The schemes' servers do not run, so the updates are triggered but fail
+	updates := func() int { return len(log.named("update-failed")) + len(log.named("config-unchanged")) }
+	deadline := time.Now().Add(10 * time.Second)
+	for updates() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if updates() < 2 {
+		t.Fatalf("fewer than 2 periodic scheme updates\n%s", log)
+	}
+
+	// After stopping no further updates run, so the client can be closed safely
+	stop()
+	stopped := updates()
+	time.Sleep(50 * time.Millisecond)
+	if updates() != stopped {
+		t.Errorf("scheme updates continued after stopping\n%s", log)
+	}
+}
+
+func TestInstallScheme(t *testing.T) {
+	log := captureEvents(t)
+	conf, err := irma.NewConfiguration(testConfiguration(t), irma.ConfigurationOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.ParseFolder(); err != nil {
+		t.Fatal(err)
+	}
+	demoKey, err := ioutil.ReadFile(filepath.Join(testConfiguration(t), "irma-demo", "pk.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testKey, err := ioutil.ReadFile(filepath.Join(testConfiguration(t), "test", "pk.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A scheme already in the configuration is recognised by its URL, with or without a trailing
+	// slash, and must have the given public key, if any
+	url := "http://localhost:48681/irma_configuration/irma-demo"
+	for _, key := range [][]byte{demoKey, nil} {
+		for _, u := range []string{url, url + "/"} {
+			if err := installScheme(conf, u, key); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	present := log.named("scheme-present")
+	if len(present) != 4 || present[0]["id"] != "irma-demo" || present[0]["url"] != url || len(log.named("scheme-installed")) != 0 {
+		t.Errorf("installing a present scheme emitted\n%s", log)
+	}
+	if err := installScheme(conf, url, testKey); err == nil || !strings.Contains(err.Error(), "different public key") {
+		t.Errorf("installing a present scheme with another public key: %v", err)
+	}
+	if err := installScheme(conf, url, []byte("not a key")); err == nil || !strings.Contains(err.Error(), "not PEM encoded") {
+		t.Errorf("installing with an invalid public key: %v", err)
+	}
+
+	// Anything else is downloaded, which irmago refuses over plain http
+	for _, key := range [][]byte{demoKey, nil} {
+		if err := installScheme(conf, "http://localhost:48681/irma_configuration/nonexistent", key); err == nil {
+			t.Error("installed a scheme over plain http")
+		}
+	}
+	if len(log.named("scheme-installed")) != 0 {
+		t.Errorf("failed install emitted\n%s", log)
+	}
+}
+
+func TestParseSchemeInstall(t *testing.T) {
+	keyFile := filepath.Join(testConfiguration(t), "irma-demo", "pk.pem")
+	url, key, err := parseSchemeInstall("https://example.com/schemes/irma-demo?v=1=" + keyFile)
+	if err != nil || url != "https://example.com/schemes/irma-demo?v=1" || !bytes.HasPrefix(key, []byte("-----BEGIN PUBLIC KEY-----")) {
+		t.Errorf("parsed as %q, %q, %v", url, key, err)
+	}
+	for _, spec := range []string{"https://example.com/schemes/irma-demo", "=" + keyFile, "https://example.com/schemes/irma-demo=", "https://example.com/x=/nonexistent"} {
+		if _, _, err := parseSchemeInstall(spec); err == nil {
+			t.Errorf("parsed %q", spec)
+		}
+	}
+}
+
+func TestInstallSchemeFlags(t *testing.T) {
+	url := "http://localhost:48681/irma_configuration/irma-demo"
+	keyFile := filepath.Join(testConfiguration(t), "irma-demo", "pk.pem")
+
+	stdout, stderr, code := runEmulator(t, "", true, emulatorArgs(t, "-install-scheme", url+"="+keyFile, "-install-scheme-tofu", url)...)
+	if !strings.Contains(stderr, "No session pointer received") {
+		t.Fatalf("exit code %d\n%s%s", code, stdout, stderr)
+	}
+	if present := eventsIn(stdout, "scheme-present"); len(present) != 2 || present[0]["id"] != "irma-demo" {
+		t.Errorf("scheme-present events %v", present)
+	}
+
+	// The URL alone does not suffice, as the public key has to be given
+	stdout, stderr, code = runEmulator(t, "", true, emulatorArgs(t, "-install-scheme", url)...)
+	if code != exitStartup || !strings.Contains(stderr, "Invalid -install-scheme: expected <url>=<pubkeyfile>") {
+		t.Errorf("exit code %d without a public key\n%s%s", code, stdout, stderr)
+	}
+}
+
+func TestAutoSchemes(t *testing.T) {
+	empty := t.TempDir()
+	args := []string{"-storage", t.TempDir(), "-config", empty, "-output-format", "json"}
+
+	stdout, stderr, code := runEmulator(t, "", true, args...)
+	if !strings.Contains(stderr, "contains no schemes") || !strings.Contains(stderr, "--auto-demo-scheme <pubkeyfile>") {
+		t.Errorf("exit code %d without schemes\n%s%s", code, stdout, stderr)
+	}
+
+	// The public key is required, as the scheme is verified against it
+	missing := filepath.Join(empty, "nonexistent.pem")
+	stdout, stderr, code = runEmulator(t, "", true, append(args, "-auto-demo-scheme", missing)...)
+	if code != exitStartup || !strings.Contains(stderr, "Cannot read the public key of the scheme at "+demoSchemeURL) {
+		t.Errorf("exit code %d with a missing public key\n%s%s", code, stdout, stderr)
+	}
+	if installing := eventsIn(stdout, "scheme-installing"); len(installing) != 0 {
+		t.Errorf("scheme-installing events %v without a public key", installing)
+	}
+}
+
+func TestSchemeFailure(t *testing.T) {
+	if _, ok := schemeFailure(errors.New("no scheme")); ok {
+		t.Error("reported a failure that is not about a scheme")
+	}
+
+	err := &irma.SchemeManagerError{
+		Scheme: "irma-demo",
+		Status: irma.SchemeManagerStatusInvalidSignature,
+		Err:    errors.New("hash of /config/irma-demo/RU/description.xml does not match"),
+	}
+	msg, ok := schemeFailure(err)
+	if !ok || !strings.Contains(msg, "Scheme irma-demo failed to load") || !strings.Contains(msg, "file /config/irma-demo/RU/description.xml") {
+		t.Errorf("reported as %q", msg)
+	}
+
+	err.Err = errors.New("signature does not match")
+	if msg, _ = schemeFailure(err); !strings.Contains(msg, "file index.sig") || !strings.Contains(msg, "re-signed") {
+		t.Errorf("without a file in the error reported as %q", msg)
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+)
+
+// ActiveSession describes a session that has started but not yet finished.
+type ActiveSession struct {
+	ID        int       `json:"id"`
+	SessionID string    `json:"session_id"` // the correlation ID also found in the session's events
+	Pointer   string    `json:"pointer"`    // the session pointer or manual session request
+	Type      string    `json:"type"`       // the session's action, once the client knows it
+	StartedAt time.Time `json:"started_at"`
+	Status    string    `json:"status"`
+}
+
+type registeredSession struct {
+	handler   *SessionHandler
+	startedAt time.Time
+}
+
+// SessionRegistry keeps track of the sessions in progress, so that they can be listed
+// by GET /sessions on the -listen address and the pending-sessions command, and waited for
+// by wait-status.
+type SessionRegistry struct {
+	mutex    sync.Mutex
+	next     int
+	sessions map[int]registeredSession
+	latest   *SessionHandler // the most recently started session, while it is in progress
+	last     *SessionHandler // the most recently started session, also once it has finished
+	changed  chan struct{}   // closed and replaced when a session is registered
+}
+
+func NewSessionRegistry() *SessionRegistry {
+	return &SessionRegistry{sessions: map[int]registeredSession{}, changed: make(chan struct{})}
+}
+
+// The sessions in progress
+var activeSessions = NewSessionRegistry()
+
+// Register adds the session performed by the handler, returning its identifier: the
+// handler's own identifier when sessions run in parallel, and a sequence number otherwise.
+func (r *SessionRegistry) Register(handler *SessionHandler) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.next++
+	id := r.next
+	if handler.id != 0 {
+		id = handler.id
+	}
+	r.sessions[id] = registeredSession{handler: handler, startedAt: time.Now()}
+	r.latest, r.last = handler, handler
+	close(r.changed)
+	r.changed = make(chan struct{})
+	return id
+}
+
+// Unregister removes the session with the given identifier once it has finished.
+func (r *SessionRegistry) Unregister(id int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if session, ok := r.sessions[id]; ok && session.handler == r.latest {
+		r.latest = nil
+	}
+	delete(r.sessions, id)
+}
+
+// awaitLatest returns the most recently started session that is still in progress. If there
+// is none, it waits for the next session to start and returns that one, even if it has
+// finished by the time the waiting ends.
+func (r *SessionRegistry) awaitLatest(timeout <-chan time.Time) (*SessionHandler, error) {
+	r.mutex.Lock()
+	latest, started := r.latest, r.next
+	r.mutex.Unlock()
+	if latest != nil {
+		return latest, nil
+	}
+	for {
+		r.mutex.Lock()
+		last, next, changed := r.last, r.next, r.changed
+		r.mutex.Unlock()
+		if next > started {
+			return last, nil
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			return nil, errors.New("timeout expired before a session started")
+		}
+	}
+}
+
+// List returns the sessions in progress, ordered by identifier.
+func (r *SessionRegistry) List() []ActiveSession {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	list := []ActiveSession{}
+	for id, session := range r.sessions {
+		session.handler.mutex.Lock()
+		list = append(list, ActiveSession{
+			ID:        id,
+			SessionID: session.handler.correlationID,
+			Pointer:   session.handler.pointer,
+			Type:      string(session.handler.action),
+			StartedAt: session.startedAt,
+			Status:    string(session.handler.status),
+		})
+		session.handler.mutex.Unlock()
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func (r *SessionRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	bts, err := json.Marshal(r.List())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(bts)
+}
+
+// SessionEvent is the data of an event sent by GET /events.
+type SessionEvent struct {
+	ID        int    `json:"id,omitempty"` // the session's number when sessions run in parallel
+	SessionID string `json:"session_id"`
+	Action    string `json:"action,omitempty"`
+	Status    string `json:"status,omitempty"` // for status events
+	Origin    string `json:"origin,omitempty"` // for cancelled events: client or server
+}
+
+type sessionEventMessage struct {
+	name string
+	data []byte
+}
+
+// The number of events buffered for a GET /events client; further events are dropped until
+// the client catches up, so that a slow client never holds up a session
+const eventStreamBuffer = 64
+
+// EventStream broadcasts the status updates, successes and cancellations of all sessions to
+// the clients of GET /events on the -listen address, as server-sent events.
+type EventStream struct {
+	mutex       sync.Mutex
+	subscribers map[chan sessionEventMessage]struct{}
+	closed      bool
+	serving     sync.WaitGroup
+}
+
+func NewEventStream() *EventStream {
+	return &EventStream{subscribers: map[chan sessionEventMessage]struct{}{}}
+}
+
+// The events of all sessions
+var sessionEvents = NewEventStream()
+
+// Publish sends the event to all current clients, without waiting for any of them.
+func (e *EventStream) Publish(name string, event SessionEvent) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if len(e.subscribers) == 0 {
+		return
+	}
+	bts, err := json.Marshal(event)
+	if err != nil {
+		panic(err)
+	}
+	for subscriber := range e.subscribers {
+		select {
+		case subscriber <- sessionEventMessage{name: name, data: bts}:
+		default:
+		}
+	}
+}
+
+func (e *EventStream) subscribe() chan sessionEventMessage {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	subscriber := make(chan sessionEventMessage, eventStreamBuffer)
+	if e.closed {
+		close(subscriber)
+	} else {
+		e.subscribers[subscriber] = struct{}{}
+	}
+	return subscriber
+}
+
+func (e *EventStream) unsubscribe(subscriber chan sessionEventMessage) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	delete(e.subscribers, subscriber)
+}
+
+// The maximum time Close waits for the clients of GET /events to receive the last events
+const eventStreamDrainTimeout = time.Second
+
+// Close ends the responses to all clients of GET /events once they have been sent the events
+// published so far, waiting at most eventStreamDrainTimeout for that, so that the last events
+// are not lost when the emulator exits.
+func (e *EventStream) Close() {
+	e.mutex.Lock()
+	e.closed = true
+	for subscriber := range e.subscribers {
+		close(subscriber)
+		delete(e.subscribers, subscriber)
+	}
+	e.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		e.serving.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(eventStreamDrainTimeout):
+	}
+}
+
+func (e *EventStream) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	e.serving.Add(1)
+	defer e.serving.Done()
+	subscriber := e.subscribe()
+	defer e.unsubscribe(subscriber)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case message, ok := <-subscriber:
+			if !ok {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", message.name, message.data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// printPendingSessions emits the sessions in progress.
+func printPendingSessions(registry *SessionRegistry) {
+	sessions := registry.List()
+	emit("pending-sessions", "count", len(sessions), "sessions", jsonField{sessions})
+}
+
+// serveSessions serves GET /sessions and GET /events on the given address in the background.
+// Listening happens before returning, so that an unusable address is reported at startup.
+func serveSessions(addr string, registry *SessionRegistry, stream *EventStream, metrics *PrometheusExporter) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/sessions", registry)
+	mux.Handle("/events", stream)
+	mux.Handle("/metrics", metrics)
+	go func() {
+		_ = http.Serve(listener, mux)
+	}()
+	emit("listening", "address", listener.Addr())
+	return nil
+}
+
+// newCorrelationID returns a random (version 4) UUID identifying a session attempt.
+func newCorrelationID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// The statuses irmaclient reports, which wait-status can wait for
+var clientStatuses = []irma.ClientStatus{
+	irma.ClientStatusConnected,
+	irma.ClientStatusCommunicating,
+	irma.ClientStatusManualStarted,
+}
+
+// waitStatus handles "wait-status <status> [timeout]", blocking the reading of further
+// commands until the most recent session has reached the status. It runs on the reading
+// goroutine, so an answer the session needs to reach the status must be typed before it.
+func waitStatus(registry *SessionRegistry, args string) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 || len(fields) > 2 {
+		emit("wait-status-failed", "error", "expected wait-status <status> [timeout]")
+		return
+	}
+	var status irma.ClientStatus
+	for _, known := range clientStatuses {
+		if strings.EqualFold(fields[0], string(known)) {
+			status = known
+		}
+	}
+	if status == "" {
+		emit("wait-status-failed", "status", fields[0], "error", fmt.Sprintf("unknown status, expected one of %v", clientStatuses))
+		return
+	}
+	var timeout <-chan time.Time
+	if len(fields) == 2 {
+		d, err := time.ParseDuration(fields[1])
+		if err != nil {
+			emit("wait-status-failed", "status", status, "error", err)
+			return
+		}
+		timeout = time.After(d)
+	}
+
+	handler, err := registry.awaitLatest(timeout)
+	if err != nil {
+		emit("wait-status-failed", "status", status, "error", err)
+		return
+	}
+	if err := handler.waitStatus(status, timeout); err != nil {
+		emitFor(handler.id, "wait-status-failed", "status", status, "error", err)
+		return
+	}
+	emitFor(handler.id, "wait-status-reached", "status", status)
+}
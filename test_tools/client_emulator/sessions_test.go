@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+)
+
+// getSessions returns the sessions listed by GET /sessions on the server.
+func getSessions(t *testing.T, server *httptest.Server) []ActiveSession {
+	t.Helper()
+	res, err := http.Get(server.URL + "/sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("GET /sessions gave %s, %s", res.Status, res.Header.Get("Content-Type"))
+	}
+	list := []ActiveSession{}
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+func TestSessionRegistry(t *testing.T) {
+	registry := NewSessionRegistry()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	if list := getSessions(t, server); len(list) != 0 {
+		t.Errorf("listed %v before any session started", list)
+	}
+
+	first := newSessionHandler(newCommands(""), nil)
+	first.correlationID, first.pointer = "first", studentIDRequest
+	first.action, first.status = irma.ActionDisclosing, irma.ClientStatusConnected
+	second := newSessionHandler(newCommands(""), nil)
+	second.correlationID = "second"
+	firstID, secondID := registry.Register(first), registry.Register(second)
+
+	list := getSessions(t, server)
+	if len(list) != 2 || list[0].ID != firstID || list[1].ID != secondID {
+		t.Fatalf("listed %v, want sessions %d and %d", list, firstID, secondID)
+	}
+	if list[0].SessionID != "first" || list[0].Pointer != studentIDRequest || list[0].Type != "disclosing" ||
+		list[0].Status != "connected" || list[0].StartedAt.IsZero() {
+		t.Errorf("first session listed as %+v", list[0])
+	}
+	if list[1].SessionID != "second" || list[1].Type != "" || list[1].Status != "" {
+		t.Errorf("second session listed as %+v", list[1])
+	}
+
+	registry.Unregister(firstID)
+	if list := getSessions(t, server); len(list) != 1 || list[0].SessionID != "second" {
+		t.Errorf("listed %v after the first session finished", list)
+	}
+
+	res, err := http.Post(server.URL+"/sessions", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST /sessions gave %s", res.Status)
+	}
+}
+
+func TestSessionRegistryParallelIDs(t *testing.T) {
+	registry := NewSessionRegistry()
+	handler := newSessionHandler(newCommands(""), nil)
+	handler.id = 7
+	if id := registry.Register(handler); id != 7 {
+		t.Errorf("parallel session registered as %d", id)
+	}
+}
+
+func TestCorrelationIDs(t *testing.T) {
+	input := strings.Repeat(studentIDRequest+"\nyes\n", 2)
+	stdout, stderr, code := runEmulator(t, input, true, emulatorArgs(t, "-max-session-count", "2", "-print-result")...)
+	if code != exitSuccess {
+		t.Fatalf("exit code %d\n%s%s", code, stdout, stderr)
+	}
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	results := eventsIn(stdout, "result")
+	if len(results) != 2 {
+		t.Fatalf("result events %v", results)
+	}
+	ids := []string{}
+	for _, result := range results {
+		id, _ := result["session_id"].(string)
+		if !uuid.MatchString(id) {
+			t.Errorf("session_id %q is not a version 4 UUID", id)
+		}
+		ids = append(ids, id)
+	}
+	if ids[0] == ids[1] {
+		t.Errorf("both sessions have session_id %s", ids[0])
+	}
+	// Every event of a session carries its ID
+	for i, event := range eventsIn(stdout, "permission-request") {
+		if i >= len(ids) || event["session_id"] != ids[i] {
+			t.Errorf("permission-request %d has session_id %v, want %v", i, event["session_id"], ids)
+		}
+	}
+}
+
+type streamedEvent struct {
+	name string
+	data SessionEvent
+}
+
+// readEvents reads count server-sent events from the response.
+func readEvents(t *testing.T, res *http.Response, count int) []streamedEvent {
+	t.Helper()
+	read := []streamedEvent{}
+	scanner := bufio.NewScanner(res.Body)
+	event := streamedEvent{}
+	for len(read) < count && scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event.data); err != nil {
+				t.Fatal(err)
+			}
+		case line == "":
+			read = append(read, event)
+			event = streamedEvent{}
+		}
+	}
+	if len(read) < count {
+		t.Fatalf("read %v before the stream ended, want %d events: %v", read, count, scanner.Err())
+	}
+	return read
+}
+
+// getEvents starts a GET /events request on the server, which is subscribed once it returns.
+// The body is closed on cleanup, which must precede closing the server, as that waits for the
+// response to end.
+func getEvents(t *testing.T, server *httptest.Server) *http.Response {
+	t.Helper()
+	res, err := http.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("GET /events gave %s, %s", res.Status, res.Header.Get("Content-Type"))
+	}
+	return res
+}
+
+func TestEventStream(t *testing.T) {
+	server := httptest.NewServer(sessionEvents)
+	t.Cleanup(server.Close)
+	res := getEvents(t, server)
+
+	succeeding := newSessionHandler(newCommands(""), nil)
+	succeeding.correlationID = "succeeding"
+	succeeding.StatusUpdate(irma.ActionDisclosing, irma.ClientStatusConnected)
+	succeeding.Success("")
+	declined := newSessionHandler(newCommands(""), nil)
+	declined.correlationID, declined.id, declined.declined = "declined", 2, true
+	declined.Cancelled()
+
+	events := readEvents(t, res, 3)
+	want := []streamedEvent{
+		{"status", SessionEvent{SessionID: "succeeding", Action: "disclosing", Status: "connected"}},
+		{"success", SessionEvent{SessionID: "succeeding", Action: "disclosing"}},
+		{"cancelled", SessionEvent{ID: 2, SessionID: "declined", Origin: "client"}},
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Errorf("event %d is %+v, want %+v", i, events[i], want[i])
+		}
+	}
+
+	res, err := http.Post(server.URL+"/events", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST /events gave %s", res.Status)
+	}
+}
+
+func TestEventStreamClose(t *testing.T) {
+	stream := NewEventStream()
+	server := httptest.NewServer(stream)
+	t.Cleanup(server.Close)
+	res := getEvents(t, server)
+
+	stream.Publish("success", SessionEvent{SessionID: "last"})
+	stream.Close()
+	// The event published before closing is still sent, after which the response ends
+	if events := readEvents(t, res, 1); events[0].data.SessionID != "last" {
+		t.Errorf("read %+v", events)
+	}
+	if rest, err := ioutil.ReadAll(res.Body); err != nil || len(rest) != 0 {
+		t.Errorf("read %q, %v after the last event", rest, err)
+	}
+	// Clients arriving after closing get an empty stream
+	if rest, err := ioutil.ReadAll(getEvents(t, server).Body); err != nil || len(rest) != 0 {
+		t.Errorf("read %q, %v from a closed stream", rest, err)
+	}
+}
+
+func TestWaitStatusCommand(t *testing.T) {
+	// The status command typed after wait-status must only be handled once the status is seen
+	input := studentIDRequest + "\nyes\nwait-status communicating 10s\nstatus\n" + studentIDRequest + "\nyes\n"
+	stdout, stderr, code := runEmulator(t, input, false, emulatorArgs(t, "-max-session-count", "2")...)
+	if code != exitSuccess {
+		t.Fatalf("exit code %d\n%s%s", code, stdout, stderr)
+	}
+	order := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(stdout), "\n") {
+		var event struct{ Event string }
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("stdout line is not JSON: %s", line)
+		}
+		if strings.HasPrefix(event.Event, "wait-status") || event.Event == "status" {
+			order = append(order, event.Event)
+		}
+	}
+	if !reflect.DeepEqual(order, []string{"wait-status-reached", "status"}) {
+		t.Errorf("events in order %v\n%s", order, stdout)
+	}
+}
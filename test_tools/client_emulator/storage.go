@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+	"go.etcd.io/bbolt"
+)
+
+// The file, buckets and keys of the storage database, as irmaclient lays them out
+const (
+	storageDatabase  = "db"
+	userdataBucket   = "userdata"
+	attributesBucket = "attrs"
+	signaturesBucket = "sigs"
+	preferencesKey   = "preferences"
+	keyshareKey      = "kss"
+)
+
+// storageContents is the part of a client's storage that determines whether two wallets are
+// equivalent, leaving out everything that differs between otherwise identical wallets, such
+// as credential hashes, signatures and keyshare usernames.
+type storageContents struct {
+	credentials map[string][]string // credential type to the sorted attribute values of each instance
+	keyshare    []string            // the sorted scheme managers the client is enrolled at
+	preferences *irmaclient.Preferences
+	logs        int
+}
+
+// diffStorage compares the client storages in the directories a and b, emitting a
+// storage-diff event for every difference, and returns exitSuccess if they are equivalent.
+func diffStorage(a, b string) int {
+	contentsA, err := readStorage(a)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read storage %s: %v\n", a, err)
+		return exitStartup
+	}
+	contentsB, err := readStorage(b)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read storage %s: %v\n", b, err)
+		return exitStartup
+	}
+
+	differences := 0
+	diff := func(aspect string, fields ...interface{}) {
+		differences++
+		emit("storage-diff", append([]interface{}{"aspect", aspect}, fields...)...)
+	}
+
+	credtypes := map[string]struct{}{}
+	for credtype := range contentsA.credentials {
+		credtypes[credtype] = struct{}{}
+	}
+	for credtype := range contentsB.credentials {
+		credtypes[credtype] = struct{}{}
+	}
+	for _, credtype := range sortedKeys(credtypes) {
+		onlyA, onlyB := subtract(contentsA.credentials[credtype], contentsB.credentials[credtype]),
+			subtract(contentsB.credentials[credtype], contentsA.credentials[credtype])
+		if len(onlyA) > 0 || len(onlyB) > 0 {
+			diff("credentials", "type", credtype,
+				"count_a", len(contentsA.credentials[credtype]), "count_b", len(contentsB.credentials[credtype]),
+				"only_a", jsonField{onlyA}, "only_b", jsonField{onlyB})
+		}
+	}
+	if onlyA, onlyB := subtract(contentsA.keyshare, contentsB.keyshare), subtract(contentsB.keyshare, contentsA.keyshare); len(onlyA) > 0 || len(onlyB) > 0 {
+		diff("keyshare", "only_a", strings.Join(onlyA, ","), "only_b", strings.Join(onlyB, ","))
+	}
+	if !reflect.DeepEqual(contentsA.preferences, contentsB.preferences) {
+		diff("preferences", "a", jsonField{contentsA.preferences}, "b", jsonField{contentsB.preferences})
+	}
+	if contentsA.logs != contentsB.logs {
+		diff("logs", "count_a", contentsA.logs, "count_b", contentsB.logs)
+	}
+
+	emit("storage-compared", "a", a, "b", b, "equivalent", differences == 0, "differences", differences)
+	if differences > 0 {
+		return exitFailure
+	}
+	return exitSuccess
+}
+
+// readStorage reads the storage database in dir without modifying it. The client's copy of
+// the schemes is only used to ignore revocation attributes, whose values are random, and
+// is not required to be present, so that storages of older emulator versions can be read.
+func readStorage(dir string) (*storageContents, error) {
+	db, err := openStorage(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	conf, _ := readConfiguration(filepath.Join(dir, "irma_configuration"))
+
+	contents := &storageContents{credentials: map[string][]string{}, keyshare: []string{}}
+	err = db.View(func(tx *bbolt.Tx) error {
+		if bucket := tx.Bucket([]byte(attributesBucket)); bucket != nil {
+			err := bucket.ForEach(func(key, value []byte) error {
+				var lists []*irma.AttributeList
+				if err := json.Unmarshal(value, &lists); err != nil {
+					return fmt.Errorf("credentials of %s: %v", key, err)
+				}
+				credtype := irma.NewCredentialTypeIdentifier(string(key))
+				for _, list := range lists {
+					contents.credentials[credtype.String()] = append(contents.credentials[credtype.String()],
+						attributeValues(conf, credtype, list))
+				}
+				sort.Strings(contents.credentials[credtype.String()])
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if bucket := tx.Bucket([]byte(userdataBucket)); bucket != nil {
+			if bts := bucket.Get([]byte(keyshareKey)); bts != nil {
+				var servers map[irma.SchemeManagerIdentifier]json.RawMessage
+				if err := json.Unmarshal(bts, &servers); err != nil {
+					return fmt.Errorf("keyshare enrollments: %v", err)
+				}
+				for manager := range servers {
+					contents.keyshare = append(contents.keyshare, manager.String())
+				}
+				sort.Strings(contents.keyshare)
+			}
+			if bts := bucket.Get([]byte(preferencesKey)); bts != nil {
+				contents.preferences = &irmaclient.Preferences{}
+				if err := json.Unmarshal(bts, contents.preferences); err != nil {
+					return fmt.Errorf("preferences: %v", err)
+				}
+			}
+		}
+
+		if bucket := tx.Bucket([]byte(historyBucket)); bucket != nil {
+			contents.logs = bucket.Stats().KeyN
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return contents, nil
+}
+
+// openStorage opens the storage database in dir read-only, failing if it does not exist.
+func openStorage(dir string) (*bbolt.DB, error) {
+	path := filepath.Join(dir, storageDatabase)
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second, ReadOnly: true})
+}
+
+// snapshotStorage opens a copy of the storage database in dir read-only, so that it can be
+// read while the client keeps the database itself locked. As the client may write to the
+// database while it is copied, copies that are not consistent are made again. The returned
+// function closes and removes the copy.
+func snapshotStorage(dir string) (*bbolt.DB, func(), error) {
+	tmp, err := ioutil.TempDir("", "storage-snapshot")
+	if err != nil {
+		return nil, nil, err
+	}
+	for attempt := 0; attempt < 3; attempt++ {
+		var db *bbolt.DB
+		if db, err = copyStorage(dir, filepath.Join(tmp, strconv.Itoa(attempt))); err == nil {
+			return db, func() {
+				db.Close()
+				os.RemoveAll(tmp)
+			}, nil
+		}
+	}
+	os.RemoveAll(tmp)
+	return nil, nil, fmt.Errorf("cannot copy storage %s: %v", dir, err)
+}
+
+// copyStorage copies the storage database in dir to path and opens the copy read-only,
+// failing if the copy is not consistent.
+func copyStorage(dir, path string) (*bbolt.DB, error) {
+	bts, err := ioutil.ReadFile(filepath.Join(dir, storageDatabase))
+	if err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(path, bts, 0600); err != nil {
+		return nil, err
+	}
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	err = db.View(func(tx *bbolt.Tx) error {
+		var first error
+		for err := range tx.Check() {
+			if first == nil {
+				first = err
+			}
+		}
+		return first
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// validateStore checks every credential in the storage database in dir against the schemes in
+// the irma_configuration directory confPath, emitting a store-inconsistency event for each
+// problem, and returns exitSuccess if there are none. Neither directory is modified.
+func validateStore(dir, confPath string) int {
+	conf, err := readConfiguration(confPath)
+	if err != nil {
+		return configurationFailure(confPath, err)
+	}
+	db, err := openStorage(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read storage %s: %v\n", dir, err)
+		return exitStartup
+	}
+	defer db.Close()
+
+	credentials, inconsistencies := 0, 0
+	inconsistent := func(credtype string, index int, problem string, fields ...interface{}) {
+		inconsistencies++
+		emit("store-inconsistency", append([]interface{}{"type", credtype, "index", index, "problem", problem}, fields...)...)
+	}
+	err = db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(attributesBucket))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(key, value []byte) error {
+			var lists []*irma.AttributeList
+			if err := json.Unmarshal(value, &lists); err != nil {
+				inconsistent(string(key), -1, "unreadable", "error", err)
+				return nil
+			}
+			credentials += len(lists)
+			credtype := irma.NewCredentialTypeIdentifier(string(key))
+			ct, ok := conf.CredentialTypes[credtype]
+			if !ok {
+				inconsistent(string(key), -1, "unknown-credential-type", "instances", len(lists))
+				return nil
+			}
+			for i, list := range lists {
+				if len(list.Ints) == 0 {
+					inconsistent(string(key), i, "no-metadata")
+					continue
+				}
+				validateCredential(conf, ct, list, func(problem string, fields ...interface{}) {
+					inconsistent(string(key), i, problem, fields...)
+				})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read storage %s: %v\n", dir, err)
+		return exitStartup
+	}
+
+	emit("store-validated", "storage", dir, "config", confPath, "credentials", credentials, "inconsistencies", inconsistencies)
+	if inconsistencies > 0 {
+		return exitFailure
+	}
+	return exitSuccess
+}
+
+// validateCredential calls report for each way in which the stored credential does not match
+// its credential type, with key/value pairs describing the problem.
+func validateCredential(conf *irma.Configuration, ct *irma.CredentialType, list *irma.AttributeList, report func(problem string, fields ...interface{})) {
+	metadata := irma.MetadataFromInt(list.Ints[0], conf)
+	if stored := metadata.CredentialType(); stored == nil || stored.Identifier() != ct.Identifier() {
+		report("credential-type-mismatch")
+	}
+	// The metadata version irmaclient gives credentials issued in new sessions
+	current := irma.GetMetadataVersion(irma.NewVersion(2, 8))
+	if version := metadata.Version(); version != current {
+		report("metadata-version", "version", version, "current", current)
+	}
+	if pk, err := conf.PublicKey(ct.IssuerIdentifier(), metadata.KeyCounter()); err != nil || pk == nil {
+		report("missing-public-key", "key_counter", metadata.KeyCounter())
+	}
+
+	values := list.Ints[1:]
+	if len(values) > len(ct.AttributeTypes) {
+		report("unknown-attributes", "stored", len(values), "defined", len(ct.AttributeTypes))
+	}
+	var missing []string
+	for i, attr := range ct.AttributeTypes {
+		switch {
+		case i >= len(values):
+			missing = append(missing, attr.ID)
+		case attr.RevocationAttribute || attr.IsOptional():
+		case values[i] == nil || (metadata.Version() >= 3 && values[i].Sign() == 0):
+			// As of metadata version 3 a zero value encodes an absent attribute
+			missing = append(missing, attr.ID)
+		}
+	}
+	if len(missing) > 0 {
+		report("missing-attributes", "attributes", strings.Join(missing, ","))
+	}
+}
+
+// attributeValues encodes the attribute values of a credential as a single string, leaving out
+// the metadata attribute and, if the credential type is known, the revocation attribute.
+func attributeValues(conf *irma.Configuration, credtype irma.CredentialTypeIdentifier, list *irma.AttributeList) string {
+	revocationIndex := -1
+	if conf != nil {
+		if ct, ok := conf.CredentialTypes[credtype]; ok && list.RevocationSupported {
+			revocationIndex = ct.RevocationIndex
+		}
+	}
+	values := []string{}
+	for i, value := range list.Ints {
+		if i == 0 || i-1 == revocationIndex {
+			continue
+		}
+		values = append(values, value.String())
+	}
+	return strings.Join(values, ",")
+}
+
+// subtract returns the elements of the sorted list a that are not matched by an element of
+// the sorted list b, counting duplicates.
+func subtract(a, b []string) []string {
+	remaining := []string{}
+	j := 0
+	for _, value := range a {
+		for j < len(b) && b[j] < value {
+			j++
+		}
+		if j < len(b) && b[j] == value {
+			j++
+			continue
+		}
+		remaining = append(remaining, value)
+	}
+	return remaining
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// storedCredentials returns the number of credential instances in the storage.
+func storedCredentials(t *testing.T, storage string) int {
+	t.Helper()
+	contents, err := readStorage(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, instances := range contents.credentials {
+		count += len(instances)
+	}
+	return count
+}
+
+func TestCredentialCountAssert(t *testing.T) {
+	storage := testStorage(t)
+	stored := storedCredentials(t, storage)
+	if stored == 0 {
+		t.Fatal("test storage holds no credentials")
+	}
+
+	for _, expected := range []int{stored, stored + 1} {
+		args := []string{"-storage", storage, "-config", testConfiguration(t),
+			"-output-format", "json", "-credential-count-assert", strconv.Itoa(expected)}
+		stdout, stderr, code := runEmulator(t, studentIDRequest+"\nyes\n", true, args...)
+		want := exitSuccess
+		if expected != stored {
+			want = exitFailure
+		}
+		if code != want {
+			t.Errorf("asserting %d of %d credentials gave exit code %d, want %d\n%s%s", expected, stored, code, want, stdout, stderr)
+		}
+		counts := eventsIn(stdout, "credential-count")
+		if len(counts) != 1 || counts[0]["expected"] != float64(expected) || counts[0]["actual"] != float64(stored) {
+			t.Errorf("credential-count events %v", counts)
+		}
+	}
+}
+
+// updateCredentials calls fn with the credentials bucket of the storage database in dir.
+func updateCredentials(t *testing.T, dir string, fn func(bucket *bbolt.Bucket) error) {
+	t.Helper()
+	db, err := bbolt.Open(filepath.Join(dir, storageDatabase), 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Update(func(tx *bbolt.Tx) error { return fn(tx.Bucket([]byte(attributesBucket))) }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiffStorage(t *testing.T) {
+	log := captureEvents(t)
+	a, b := testStorage(t), testStorage(t)
+	if code := diffStorage(a, b); code != exitSuccess {
+		t.Errorf("exit code %d for copies of the same storage\n%s", code, log)
+	}
+	if compared := log.named("storage-compared"); len(compared) != 1 || compared[0]["equivalent"] != true || len(log.named("storage-diff")) != 0 {
+		t.Errorf("comparing copies of the same storage emitted\n%s", log)
+	}
+
+	updateCredentials(t, b, func(bucket *bbolt.Bucket) error {
+		return bucket.Delete([]byte("irma-demo.RU.studentCard"))
+	})
+	if code := diffStorage(a, b); code != exitFailure {
+		t.Errorf("exit code %d after deleting a credential\n%s", code, log)
+	}
+	diffs := log.named("storage-diff")
+	if len(diffs) != 1 || diffs[0]["aspect"] != "credentials" || diffs[0]["type"] != "irma-demo.RU.studentCard" ||
+		diffs[0]["count_a"] != 1.0 || diffs[0]["count_b"] != 0.0 {
+		t.Errorf("storage-diff events %v", diffs)
+	}
+	if compared := log.named("storage-compared"); len(compared) != 2 || compared[1]["equivalent"] != false || compared[1]["differences"] != 1.0 {
+		t.Errorf("storage-compared events %v", compared)
+	}
+}
+
+func TestValidateStore(t *testing.T) {
+	log := captureEvents(t)
+	storage, conf := testStorage(t), testConfiguration(t)
+	if code := validateStore(storage, conf); code != exitSuccess {
+		t.Errorf("exit code %d for the test storage\n%s", code, log)
+	}
+
+	// A credential of a type that the schemes do not define
+	updateCredentials(t, storage, func(bucket *bbolt.Bucket) error {
+		return bucket.Put([]byte("irma-demo.RU.unknownCard"), bucket.Get([]byte("irma-demo.RU.studentCard")))
+	})
+	if code := validateStore(storage, conf); code != exitFailure {
+		t.Errorf("exit code %d with an unknown credential type\n%s", code, log)
+	}
+	problems := log.named("store-inconsistency")
+	if len(problems) != 1 || problems[0]["type"] != "irma-demo.RU.unknownCard" ||
+		problems[0]["problem"] != "unknown-credential-type" || problems[0]["instances"] != 1.0 {
+		t.Errorf("store-inconsistency events %v", problems)
+	}
+	if validated := log.named("store-validated"); len(validated) != 2 || validated[1]["inconsistencies"] != 1.0 {
+		t.Errorf("store-validated events %v", validated)
+	}
+}